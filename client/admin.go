@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Everything in this file is limited to system admins.
+
+// AuditFilter filters and pages ListAuditEvents.
+type AuditFilter struct {
+	ActorID   int
+	ProjectID int
+	// Action matches actions starting with it, e.g. "DELETE" or "POST /api/v1/vms".
+	Action string
+	// Result is "success", "failure" or "denied".
+	Result string
+	Since  time.Time
+	Until  time.Time
+	// Before is the next page token ListAuditEvents returned for the previous page.
+	Before int64
+	Limit  int
+}
+
+// ListAuditEvents lists a page of the audit trail, newest first. next is zero on the last
+// page and otherwise is passed as Before to get the next one.
+func (c *Client) ListAuditEvents(ctx context.Context, f AuditFilter) (events []AuditEvent, next int64, err error) {
+	q := url.Values{}
+	if f.ActorID != 0 {
+		q.Set("actor_id", itoa(f.ActorID))
+	}
+	if f.ProjectID != 0 {
+		q.Set("project_id", itoa(f.ProjectID))
+	}
+	if f.Action != "" {
+		q.Set("action", f.Action)
+	}
+	if f.Result != "" {
+		q.Set("result", f.Result)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.Before != 0 {
+		q.Set("before", strconv.FormatInt(f.Before, 10))
+	}
+	if f.Limit != 0 {
+		q.Set("limit", itoa(f.Limit))
+	}
+
+	var resp struct {
+		Data struct {
+			Events     []AuditEvent `json:"events"`
+			NextBefore int64        `json:"next_before"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/audit", q, nil, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Data.Events, resp.Data.NextBefore, nil
+}
+
+// ListUnmanagedDomains lists libvirt domains no project manages.
+func (c *Client) ListUnmanagedDomains(ctx context.Context) ([]UnmanagedDomain, error) {
+	var resp struct {
+		Data struct {
+			Domains []UnmanagedDomain `json:"domains"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/domains/unmanaged", nil, nil, &resp)
+	return resp.Data.Domains, err
+}
+
+// ListHostKeys lists the SSH host keys cloudkit accepts, from host only unless it's empty.
+func (c *Client) ListHostKeys(ctx context.Context, host string) ([]HostKey, error) {
+	q := url.Values{}
+	if host != "" {
+		q.Set("host", host)
+	}
+	var resp struct {
+		Data struct {
+			HostKeys []HostKey `json:"host_keys"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/host-keys", q, nil, &resp)
+	return resp.Data.HostKeys, err
+}
+
+// PinHostKey makes publicKey, in authorized_keys format, the only key accepted from host.
+// Hosts are written as in known_hosts: the bare host for port 22, [host]:port otherwise.
+func (c *Client) PinHostKey(ctx context.Context, host, publicKey string) (HostKey, error) {
+	var resp struct {
+		Data struct {
+			HostKey HostKey `json:"host_key"`
+		} `json:"data"`
+	}
+	body := struct {
+		PublicKey string `json:"public_key"`
+	}{publicKey}
+	err := c.do(ctx, http.MethodPut, "/api/v1/host-keys/"+url.PathEscape(host), nil, body, &resp)
+	return resp.Data.HostKey, err
+}
+
+// DeleteHostKeys forgets a host's keys.
+func (c *Client) DeleteHostKeys(ctx context.Context, host string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/host-keys/"+url.PathEscape(host), nil, nil, nil)
+}
@@ -0,0 +1,211 @@
+// Package client is a typed Go client for the cloudkit API, as described by the OpenAPI
+// spec the server serves at /api/v1/openapi.json.
+//
+//	c := client.New("https://cloudkit.example.com", os.Getenv("CLOUDKIT_API_KEY"))
+//	vms, _, err := c.InProject(3).ListVMs(ctx, client.ListVMsOptions{State: "running"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProjectHeader selects the project requests act on.
+const ProjectHeader = "X-Cloudkit-Project"
+
+// Client calls the cloudkit API. It's safe for concurrent use.
+type Client struct {
+	baseURL   string
+	apiKey    string
+	project   int
+	http      *http.Client
+	userAgent string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with h rather than a client with a 60 second timeout.
+// Event streams need a client without a timeout; Events always uses one.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// WithProject makes requests act on project id. Callers who belong to exactly one project
+// can leave it out.
+func WithProject(id int) Option {
+	return func(c *Client) { c.project = id }
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the cloudkit server at baseURL, e.g. https://cloudkit.example.com,
+// authenticating with apiKey.
+func New(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		apiKey:    apiKey,
+		http:      &http.Client{Timeout: 60 * time.Second},
+		userAgent: "cloudkit-go-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// InProject returns a copy of c that acts on project id.
+func (c *Client) InProject(id int) *Client {
+	cp := *c
+	cp.project = id
+	return &cp
+}
+
+// newRequest builds a request for the API path, e.g. /api/v1/vms, encoding body as JSON
+// if it isn't nil.
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.project != 0 {
+		req.Header.Set(ProjectHeader, strconv.Itoa(c.project))
+	}
+	return req, nil
+}
+
+// do sends a request and decodes a successful response's JSON into out, if it isn't nil.
+// Failed requests are returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// Ping checks the server is up.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/ping", nil, nil, nil)
+}
+
+// Health reports whether the server can reach libvirt. An unreachable libvirt isn't an
+// error; check Connected.
+func (c *Client) Health(ctx context.Context) (ConnectionStatus, error) {
+	var resp struct {
+		Libvirt ConnectionStatus `json:"libvirt"`
+	}
+	err := c.getReport(ctx, "/healthz", &resp)
+	return resp.Libvirt, err
+}
+
+// MonitorHealth reports how the VM monitor's last pass went for the project's VMs. An
+// unhealthy monitor isn't an error; check Health.
+func (c *Client) MonitorHealth(ctx context.Context) (MonitorStatus, error) {
+	var resp struct {
+		Data struct {
+			Monitor MonitorStatus `json:"monitor"`
+		} `json:"data"`
+	}
+	err := c.getReport(ctx, "/api/v1/monitor/health", &resp)
+	return resp.Data.Monitor, err
+}
+
+// getReport is do for health checks, which answer with a 503 but the usual body while
+// whatever they check is unhealthy.
+func (c *Client) getReport(ctx context.Context, path string, out interface{}) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusServiceUnavailable {
+		return decodeError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var env struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(body, &env) == nil && env.Error != nil {
+		env.Error.StatusCode = resp.StatusCode
+		return env.Error
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			// Not a report; most likely a proxy's error page.
+			return &Error{StatusCode: resp.StatusCode, Code: CodeUnavailable, Message: http.StatusText(resp.StatusCode)}
+		}
+		return fmt.Errorf("decoding %s response: %w", path, err)
+	}
+	return nil
+}
+
+// OpenAPISpec returns the server's OpenAPI document.
+func (c *Client) OpenAPISpec(ctx context.Context) (json.RawMessage, error) {
+	var spec json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/api/v1/openapi.json", nil, nil, &spec)
+	return spec, err
+}
+
+// itoa formats an ID for a path.
+func itoa(id int) string {
+	return strconv.Itoa(id)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestServer returns a client for a server answering every request with handler.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/", "secret", WithProject(3))
+}
+
+func TestListAllVMs(t *testing.T) {
+	var calls int
+	c := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/vms" {
+			t.Errorf("got %s %s, want GET /api/v1/vms", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the API key", got)
+		}
+		if got := r.Header.Get(ProjectHeader); got != "3" {
+			t.Errorf("%s = %q, want 3", ProjectHeader, got)
+		}
+		if got := r.URL.Query().Get("state"); got != "running" {
+			t.Errorf("state = %q, want running", got)
+		}
+
+		// Two pages: the first points at the second, which has no next page.
+		switch r.URL.Query().Get("after") {
+		case "":
+			fmt.Fprint(w, `{"data":{"vms":[{"id":1,"name":"a","state":"running"}],"next_after":1}}`)
+		case "1":
+			fmt.Fprint(w, `{"data":{"vms":[{"id":2,"name":"b","state":"running"}],"next_after":0}}`)
+		default:
+			t.Errorf("after = %q, want the previous page's next_after", r.URL.Query().Get("after"))
+		}
+	})
+
+	vms, err := c.ListAllVMs(context.Background(), "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(vms) != 2 || vms[0].ID != 1 || vms[1].Name != "b" {
+		t.Errorf("ListAllVMs() = %+v after %d requests, want VMs 1 and 2 from 2 pages", vms, calls)
+	}
+}
+
+func TestGetVM(t *testing.T) {
+	c := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/vms/7" {
+			t.Errorf("path = %s, want /api/v1/vms/7", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"data":{"vm":{"id":7,"domain_id":12,"name":"web","state":"running","current_mem":1048576},"memory_usage":[{"usage":42}]}}`)
+	})
+
+	vm, usage, err := c.GetVM(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ID != 7 || vm.DomainID != 12 || vm.Name != "web" || vm.CurrentMem != 1048576 {
+		t.Errorf("GetVM() vm = %+v", vm)
+	}
+	if len(usage) != 1 || usage[0].Usage != 42 {
+		t.Errorf("GetVM() usage = %+v", usage)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   Error
+	}{
+		{
+			name:   "envelope",
+			status: http.StatusNotFound,
+			body:   `{"error":{"code":"not_found","message":"vm not found","request_id":"req-1"}}`,
+			want:   Error{StatusCode: http.StatusNotFound, Code: CodeNotFound, Message: "vm not found", RequestID: "req-1"},
+		},
+		{
+			name:   "proxy page",
+			status: http.StatusBadGateway,
+			body:   `<html>bad gateway</html>`,
+			want:   Error{StatusCode: http.StatusBadGateway, Code: CodeUnavailable, Message: "Bad Gateway", RequestID: "req-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Request-ID", "req-2")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+
+			err := c.DeleteVM(context.Background(), 7)
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("DeleteVM() = %v, want an *Error", err)
+			}
+			if e.StatusCode != tt.want.StatusCode || e.Code != tt.want.Code || e.Message != tt.want.Message || e.RequestID != tt.want.RequestID {
+				t.Errorf("DeleteVM() = %+v, want %+v", *e, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthUnavailable(t *testing.T) {
+	c := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"libvirt":{"connected":false,"address":"/var/run/libvirt/libvirt-sock","last_error":"connection refused"}}`)
+	})
+
+	status, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatalf("Health() = %v, want the report without an error", err)
+	}
+	if status.Connected || status.LastError != "connection refused" {
+		t.Errorf("Health() = %+v, want a disconnected libvirt", status)
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Error codes the API fails requests with.
+const (
+	CodeInvalidArgument  = "invalid_argument"
+	CodeUnauthenticated  = "unauthenticated"
+	CodePermissionDenied = "permission_denied"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeCanceled         = "canceled"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal"
+)
+
+// Error is a request the API failed.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// Details adds structured information for some codes. Decode it with FieldErrors or
+	// QuotaError.
+	Details   json.RawMessage `json:"details,omitempty"`
+	RequestID string          `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("cloudkit: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("cloudkit: %s (%d %s, request %s)", e.Message, e.StatusCode, e.Code, e.RequestID)
+}
+
+// FieldErrors returns the fields an invalid_argument request broke, if the API listed them.
+func (e *Error) FieldErrors() []FieldError {
+	var fields []FieldError
+	if e.Code == CodeInvalidArgument && len(e.Details) > 0 {
+		json.Unmarshal(e.Details, &fields)
+	}
+	return fields
+}
+
+// QuotaError returns the limit a quota_exceeded request hit.
+func (e *Error) QuotaError() (QuotaError, bool) {
+	var q QuotaError
+	if e.Code != CodeQuotaExceeded || json.Unmarshal(e.Details, &q) != nil {
+		return QuotaError{}, false
+	}
+	return q, true
+}
+
+// FieldError describes one field of a request that failed validation.
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+}
+
+// QuotaError describes the limit a request would have exceeded.
+type QuotaError struct {
+	Resource  string `json:"resource"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Requested int    `json:"requested"`
+}
+
+// IsCode reports whether err is an *Error with the given code.
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// IsNotFound reports whether err is a not_found *Error.
+func IsNotFound(err error) bool {
+	return IsCode(err, CodeNotFound)
+}
+
+// decodeError reads an error envelope from a failed response. Responses without one, e.g.
+// from a proxy, are described by their status.
+func decodeError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	var env struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(body, &env) == nil && env.Error != nil && env.Error.Code != "" {
+		env.Error.StatusCode = resp.StatusCode
+		return env.Error
+	}
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       codeForStatus(resp.StatusCode),
+		Message:    http.StatusText(resp.StatusCode),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+}
+
+// codeForStatus guesses the code of an error response without an envelope.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidArgument
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return CodeUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeDeadlineExceeded
+	}
+	return CodeInternal
+}
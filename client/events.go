@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Event types.
+const (
+	EventVMCreated         = "vm.created"
+	EventVMDeleted         = "vm.deleted"
+	EventVMImported        = "vm.imported"
+	EventVMStarted         = "vm.started"
+	EventVMStopped         = "vm.stopped"
+	EventVMCrashed         = "vm.crashed"
+	EventVMRebooted        = "vm.rebooted"
+	EventOperationProgress = "operation.progress"
+)
+
+// EventFilter narrows an event stream. Empty fields match everything.
+type EventFilter struct {
+	VMs   []string
+	Types []string
+	// After resumes a stream after the event with this ID, replaying the recent events the
+	// server still has since then.
+	After uint64
+}
+
+// EventStream is a stream of the project's events, read with Next.
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	lastID  uint64
+}
+
+// Events streams the project's events until ctx is done or the stream is closed.
+func (c *Client) Events(ctx context.Context, f EventFilter) (*EventStream, error) {
+	q := url.Values{}
+	if len(f.VMs) > 0 {
+		q.Set("vm", strings.Join(f.VMs, ","))
+	}
+	if len(f.Types) > 0 {
+		q.Set("type", strings.Join(f.Types, ","))
+	}
+	if f.After != 0 {
+		q.Set("last_event_id", strconv.FormatUint(f.After, 10))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/v1/events", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// Streams last as long as the caller wants them to, so mustn't time out.
+	h := *c.http
+	h.Timeout = 0
+	resp, err := h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(make([]byte, 64*1024), 1<<20)
+	return &EventStream{body: resp.Body, scanner: s, lastID: f.After}, nil
+}
+
+// Next blocks until the next event arrives. It returns io.EOF once the server ends the
+// stream, after which it can be resumed by opening another with After set to LastID.
+func (s *EventStream) Next() (Event, error) {
+	var data strings.Builder
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if data.Len() == 0 {
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(data.String()), &ev); err != nil {
+				return Event{}, fmt.Errorf("decoding event: %w", err)
+			}
+			s.lastID = ev.ID
+			return ev, nil
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		// Comments (keepalives) have no field, and id and event are repeated in the data.
+		if field == "data" {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// LastID returns the ID of the last event Next returned.
+func (s *EventStream) LastID() uint64 {
+	return s.lastID
+}
+
+// Close ends the stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// WaitOperation follows the operation with the given ID until it succeeds or fails,
+// returning its final state. Only events published after the stream s was opened are seen,
+// so open it before starting the operation.
+func (s *EventStream) WaitOperation(id string) (Operation, error) {
+	for {
+		ev, err := s.Next()
+		if err != nil {
+			return Operation{}, err
+		}
+		if ev.Type != EventOperationProgress {
+			continue
+		}
+		var op Operation
+		if err := json.Unmarshal(ev.Data, &op); err != nil {
+			return Operation{}, fmt.Errorf("decoding operation: %w", err)
+		}
+		if op.ID != id {
+			continue
+		}
+		if op.Status == OperationSucceeded || op.Status == OperationFailed {
+			return op, nil
+		}
+	}
+}
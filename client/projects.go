@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// ListProjects lists the projects the caller belongs to, with their role in each.
+func (c *Client) ListProjects(ctx context.Context) ([]Project, error) {
+	var resp struct {
+		Data struct {
+			Projects []Project `json:"projects"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/projects", nil, nil, &resp)
+	return resp.Data.Projects, err
+}
+
+// CreateProject creates a project with the caller as its admin.
+func (c *Client) CreateProject(ctx context.Context, name string) (Project, error) {
+	var resp struct {
+		Data struct {
+			Project Project `json:"project"`
+		} `json:"data"`
+	}
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+	err := c.do(ctx, http.MethodPost, "/api/v1/projects", nil, body, &resp)
+	return resp.Data.Project, err
+}
+
+// ListProjectMembers lists a project's members.
+func (c *Client) ListProjectMembers(ctx context.Context, projectID int) ([]ProjectMember, error) {
+	var resp struct {
+		Data struct {
+			Members []ProjectMember `json:"members"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, projectPath(projectID, "/members"), nil, nil, &resp)
+	return resp.Data.Members, err
+}
+
+// AddProjectMember adds a user to a project with role, or as a viewer if role is empty.
+func (c *Client) AddProjectMember(ctx context.Context, projectID, userID int, role string) error {
+	body := struct {
+		UserID int    `json:"user_id"`
+		Role   string `json:"role,omitempty"`
+	}{userID, role}
+	return c.do(ctx, http.MethodPost, projectPath(projectID, "/members"), nil, body, nil)
+}
+
+// SetProjectMemberRole changes a member's role. It fails with a conflict if it would leave
+// the project without an admin.
+func (c *Client) SetProjectMemberRole(ctx context.Context, projectID, userID int, role string) error {
+	body := struct {
+		Role string `json:"role"`
+	}{role}
+	return c.do(ctx, http.MethodPut, projectPath(projectID, "/members/"+itoa(userID)), nil, body, nil)
+}
+
+// RemoveProjectMember removes a member from a project. It fails with a conflict if it
+// would leave the project without an admin.
+func (c *Client) RemoveProjectMember(ctx context.Context, projectID, userID int) error {
+	return c.do(ctx, http.MethodDelete, projectPath(projectID, "/members/"+itoa(userID)), nil, nil, nil)
+}
+
+// GetProjectQuota returns a project's limits and usage.
+func (c *Client) GetProjectQuota(ctx context.Context, projectID int) (Quota, error) {
+	var resp struct {
+		Data struct {
+			Quotas Quota `json:"quotas"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, projectPath(projectID, "/quotas"), nil, nil, &resp)
+	return resp.Data.Quotas, err
+}
+
+// SetProjectQuota sets a project's limits, -1 lifting one. It's limited to system admins.
+func (c *Client) SetProjectQuota(ctx context.Context, projectID int, limits Resources) (Resources, error) {
+	var resp struct {
+		Data struct {
+			Quotas Quota `json:"quotas"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPut, projectPath(projectID, "/quotas"), nil, limits, &resp)
+	return resp.Data.Quotas.Limits, err
+}
+
+func projectPath(id int, rest string) string {
+	return "/api/v1/projects/" + itoa(id) + rest
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ConnectionStatus describes the server's connection to libvirt.
+type ConnectionStatus struct {
+	Connected bool      `json:"connected"`
+	Address   string    `json:"address"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// User is a cloudkit user.
+type User struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey is a key a user authenticates with. Token is only set when the key is issued.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Project roles, from least to most privileged.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Project owns VMs. Role is the caller's role in it, when listing the caller's projects.
+type Project struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Role      string    `json:"role,omitempty"`
+}
+
+// ProjectMember is a user's membership of a project.
+type ProjectMember struct {
+	User
+	Role string `json:"role"`
+}
+
+// Resources are amounts of what a project's quota limits. In limits, -1 means unlimited.
+type Resources struct {
+	VMs       int `json:"vms"`
+	VCPUs     int `json:"vcpus"`
+	MemoryMiB int `json:"memory_mib"`
+	DiskGB    int `json:"disk_gb"`
+	Snapshots int `json:"snapshots"`
+}
+
+// Quota is a project's limits and how much of them it uses.
+type Quota struct {
+	Limits Resources `json:"limits"`
+	Usage  Resources `json:"usage"`
+}
+
+// VM is a VM as cloudkit has it stored. ID addresses the VM for its whole life, unlike
+// DomainID, which libvirt hands out afresh each time the VM starts and is -1 while it's
+// off.
+type VM struct {
+	ID        int        `json:"id"`
+	ProjectID int        `json:"project_id"`
+	DomainID  int        `json:"domain_id"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Host      string     `json:"host"`
+	IP        string     `json:"ip"`
+	VCPUs     int        `json:"vcpus"`
+	MemoryMiB int        `json:"memory_mib"`
+	DiskGB    int        `json:"disk_gb"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Domain is a VM as libvirt describes it.
+type Domain struct {
+	ID       int    `json:"id,omitempty"`
+	DomainID int    `json:"domain_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	State    string `json:"state"`
+	Host     string `json:"host,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	// Mem is the maximum memory in KiB.
+	Mem int `json:"mem,omitempty"`
+	// CurrentMem is the memory currently in KiB.
+	CurrentMem int `json:"current_mem,omitempty"`
+	VCPUs      int `json:"vcpus,omitempty"`
+	// Type and Devices are as in libvirt's domain XML.
+	Type    json.RawMessage `json:"type,omitempty"`
+	Devices json.RawMessage `json:"devices,omitempty"`
+}
+
+// MemUsage is the percent of a VM's memory in use at a time.
+type MemUsage struct {
+	Time  string  `json:"time,omitempty"`
+	Usage float64 `json:"usage"`
+}
+
+// VMEvent is a change to a VM's state.
+type VMEvent struct {
+	Type     string    `json:"type"`
+	VMName   string    `json:"vm_name"`
+	DomainID int       `json:"domain_id,omitempty"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// MemoryBounds limit how far the memory balancer may resize a VM. Zero is the balancer's
+// default.
+type MemoryBounds struct {
+	MinMiB int `json:"min_mib"`
+	MaxMiB int `json:"max_mib"`
+}
+
+// Metrics are a VM's metrics over a time range.
+type Metrics struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Step   string    `json:"step"`
+	Series []Series  `json:"metrics"`
+}
+
+// Series is one metric, of one device if it's per device, bucketed over time.
+type Series struct {
+	Metric string      `json:"metric"`
+	Device string      `json:"device,omitempty"`
+	Points []Aggregate `json:"points"`
+}
+
+// Aggregate summarises a metric over one bucket.
+type Aggregate struct {
+	Time string  `json:"time"`
+	Avg  float64 `json:"avg"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	P95  float64 `json:"p95"`
+}
+
+// Operation statuses.
+const (
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+)
+
+// Operation is the progress of a long running request, published as operation.progress
+// events.
+type Operation struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Event is an event from an event stream. Data is a VMEvent for vm.* events, except
+// vm.unmanaged which carries an UnmanagedDomain, an Operation for operation.progress and
+// an Alert for alert.* events.
+type Event struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	VMName    string          `json:"vm_name,omitempty"`
+	ProjectID int             `json:"project_id,omitempty"`
+	Time      time.Time       `json:"time"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// AuditEvent is an entry in the audit trail.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	ActorID    int             `json:"actor_id,omitempty"`
+	ActorEmail string          `json:"actor_email,omitempty"`
+	ProjectID  int             `json:"project_id,omitempty"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Status     int             `json:"status"`
+	Result     string          `json:"result"`
+	SourceIP   string          `json:"source_ip"`
+}
+
+// UnmanagedDomain is a libvirt domain no project manages.
+type UnmanagedDomain struct {
+	Name        string    `json:"name"`
+	DomainID    int       `json:"domain_id"`
+	Host        string    `json:"host"`
+	State       string    `json:"state"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// HostKey is an SSH host key cloudkit accepts from a hypervisor host.
+type HostKey struct {
+	Host        string    `json:"host"`
+	Type        string    `json:"type"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"`
+	Pinned      bool      `json:"pinned"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+// MonitorStatus describes the VM monitor's last pass.
+type MonitorStatus struct {
+	Health    string    `json:"health"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastEnd   time.Time `json:"last_end,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+	VMsPolled int       `json:"vms_polled"`
+	VMsFailed int       `json:"vms_failed"`
+	// VMsUnmanaged counts domains cloudkit doesn't manage, which don't affect Health.
+	VMsUnmanaged int       `json:"vms_unmanaged"`
+	Errors       []string  `json:"errors,omitempty"`
+	Interval     string    `json:"interval"`
+	StaleAfter   time.Time `json:"stale_after,omitempty"`
+}
+
+// Webhook delivers events to a URL. Secret is only set when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id"`
+	ProjectID int       `json:"project_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID            int        `json:"id"`
+	ProjectID     int        `json:"project_id"`
+	WebhookID     int        `json:"webhook_id"`
+	EventID       uint64     `json:"event_id"`
+	EventType     string     `json:"event_type"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ResponseCode  *int       `json:"response_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// AlertRule raises an alert when a metric crosses a threshold.
+type AlertRule struct {
+	ID              int       `json:"id"`
+	ProjectID       int       `json:"project_id"`
+	Name            string    `json:"name"`
+	Metric          string    `json:"metric"`
+	Comparison      string    `json:"comparison"`
+	Threshold       float64   `json:"threshold"`
+	DurationSeconds int       `json:"duration_seconds"`
+	VMName          string    `json:"vm_name,omitempty"`
+	Notify          []string  `json:"notify"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Alert is a rule firing for a VM.
+type Alert struct {
+	ID         int        `json:"id"`
+	ProjectID  int        `json:"project_id"`
+	RuleID     int        `json:"rule_id"`
+	RuleName   string     `json:"rule_name"`
+	VMName     string     `json:"vm_name"`
+	Metric     string     `json:"metric"`
+	Comparison string     `json:"comparison"`
+	Threshold  float64    `json:"threshold"`
+	Value      float64    `json:"value"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
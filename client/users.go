@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// CurrentUser returns the user the client's API key belongs to.
+func (c *Client) CurrentUser(ctx context.Context) (User, error) {
+	var resp struct {
+		Data struct {
+			User User `json:"user"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users/me", nil, nil, &resp)
+	return resp.Data.User, err
+}
+
+// ListAPIKeys lists the caller's API keys, without their tokens.
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var resp struct {
+		Data struct {
+			APIKeys []APIKey `json:"api_keys"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/keys", nil, nil, &resp)
+	return resp.Data.APIKeys, err
+}
+
+// CreateAPIKey issues the caller a new API key. Its token can't be recovered later.
+func (c *Client) CreateAPIKey(ctx context.Context, name string) (APIKey, error) {
+	return c.issueAPIKey(ctx, "/api/v1/keys", name)
+}
+
+// RevokeAPIKey revokes one of the caller's API keys.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/keys/"+itoa(id), nil, nil, nil)
+}
+
+// ListUsers lists every user. It's limited to system admins.
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var resp struct {
+		Data struct {
+			Users []User `json:"users"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users", nil, nil, &resp)
+	return resp.Data.Users, err
+}
+
+// CreateUserRequest describes a user to create.
+type CreateUserRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+	Admin bool   `json:"admin,omitempty"`
+}
+
+// CreateUser creates a user. It's limited to system admins.
+func (c *Client) CreateUser(ctx context.Context, req CreateUserRequest) (User, error) {
+	var resp struct {
+		Data struct {
+			User User `json:"user"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/users", nil, req, &resp)
+	return resp.Data.User, err
+}
+
+// CreateUserAPIKey issues a user an API key. It's limited to system admins.
+func (c *Client) CreateUserAPIKey(ctx context.Context, userID int, name string) (APIKey, error) {
+	return c.issueAPIKey(ctx, "/api/v1/users/"+itoa(userID)+"/keys", name)
+}
+
+func (c *Client) issueAPIKey(ctx context.Context, path, name string) (APIKey, error) {
+	var resp struct {
+		Data struct {
+			APIKey APIKey `json:"api_key"`
+		} `json:"data"`
+	}
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+	err := c.do(ctx, http.MethodPost, path, nil, body, &resp)
+	return resp.Data.APIKey, err
+}
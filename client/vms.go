@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ListVMsOptions filters and pages ListVMs.
+type ListVMsOptions struct {
+	State string
+	// After is the next page token ListVMs returned for the previous page.
+	After int
+	// Limit defaults to 100 and is capped at 500.
+	Limit int
+}
+
+// ListVMs lists a page of the project's VMs. next is zero on the last page and otherwise
+// is passed as After to get the next one. VMs are listed as cloudkit has them stored, so
+// their state, host and IP can lag libvirt by up to the reconciler's interval; GetVM
+// reports what libvirt has now, along with the MAC address and current memory.
+func (c *Client) ListVMs(ctx context.Context, opts ListVMsOptions) (vms []VM, next int, err error) {
+	q := url.Values{}
+	if opts.State != "" {
+		q.Set("state", opts.State)
+	}
+	if opts.After != 0 {
+		q.Set("after", itoa(opts.After))
+	}
+	if opts.Limit != 0 {
+		q.Set("limit", itoa(opts.Limit))
+	}
+
+	var resp struct {
+		Data struct {
+			VMs       []VM `json:"vms"`
+			NextAfter int  `json:"next_after"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/vms", q, nil, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Data.VMs, resp.Data.NextAfter, nil
+}
+
+// ListAllVMs lists all of the project's VMs, a page at a time.
+func (c *Client) ListAllVMs(ctx context.Context, state string) ([]VM, error) {
+	var all []VM
+	opts := ListVMsOptions{State: state}
+	for {
+		vms, next, err := c.ListVMs(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, vms...)
+		if next == 0 {
+			return all, nil
+		}
+		opts.After = next
+	}
+}
+
+// GetVM returns a VM as libvirt describes it, with its memory usage over the last 15
+// minutes. VMs are addressed by their ID, VM.ID, not their libvirt domain ID, which
+// changes each time a VM starts.
+func (c *Client) GetVM(ctx context.Context, id int) (Domain, []MemUsage, error) {
+	var resp struct {
+		Data struct {
+			VM          Domain     `json:"vm"`
+			MemoryUsage []MemUsage `json:"memory_usage"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/vms/"+itoa(id), nil, nil, &resp); err != nil {
+		return Domain{}, nil, err
+	}
+	return resp.Data.VM, resp.Data.MemoryUsage, nil
+}
+
+// CreateVMRequest describes a VM to create.
+type CreateVMRequest struct {
+	MachineType string `json:"machineType"`
+	// MemoryGB is the VM's memory in GB.
+	MemoryGB int `json:"memory"`
+	VCPUs    int `json:"vcpus"`
+}
+
+// CreateVM starts creating a VM, returning the ID of the operation that creates it in the
+// background. The VM is ready once that operation's operation.progress events report it
+// succeeded; open an event stream first so none are missed.
+func (c *Client) CreateVM(ctx context.Context, req CreateVMRequest) (operationID string, err error) {
+	var resp struct {
+		OperationID string `json:"operation_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms", nil, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.OperationID, nil
+}
+
+// ImportVM brings the named libvirt domain, which cloudkit didn't create, under the
+// project's management. The returned Domain's ID addresses it from then on.
+func (c *Client) ImportVM(ctx context.Context, name string) (Domain, error) {
+	var resp struct {
+		Data struct {
+			VM Domain `json:"vm"`
+		} `json:"data"`
+	}
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/import", nil, body, &resp); err != nil {
+		return Domain{}, err
+	}
+	return resp.Data.VM, nil
+}
+
+// DeleteVM destroys a VM.
+func (c *Client) DeleteVM(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/vms/"+itoa(id), nil, nil, nil)
+}
+
+// MetricsOptions picks the time range and resolution of GetVMMetrics. Zero values use the
+// server's defaults: the 15 minutes to now in 1 minute buckets.
+type MetricsOptions struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+// GetVMMetrics returns a VM's metrics over time.
+func (c *Client) GetVMMetrics(ctx context.Context, id int, opts MetricsOptions) (Metrics, error) {
+	q := url.Values{}
+	if !opts.Start.IsZero() {
+		q.Set("start", opts.Start.Format(time.RFC3339))
+	}
+	if !opts.End.IsZero() {
+		q.Set("end", opts.End.Format(time.RFC3339))
+	}
+	if opts.Step != 0 {
+		q.Set("step", opts.Step.String())
+	}
+
+	var resp struct {
+		Data Metrics `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/vms/"+itoa(id)+"/metrics", q, nil, &resp)
+	return resp.Data, err
+}
+
+// GetVMStateHistory returns a VM's recent state changes, newest first.
+func (c *Client) GetVMStateHistory(ctx context.Context, id int) ([]VMEvent, error) {
+	var resp struct {
+		Data struct {
+			History []VMEvent `json:"history"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/vms/"+itoa(id)+"/history", nil, nil, &resp)
+	return resp.Data.History, err
+}
+
+// SetVMMemoryBounds sets how far the memory balancer may resize a VM. It's limited to
+// system admins.
+func (c *Client) SetVMMemoryBounds(ctx context.Context, id int, bounds MemoryBounds) (MemoryBounds, error) {
+	var resp struct {
+		Data struct {
+			MemoryBounds MemoryBounds `json:"memory_bounds"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPut, "/api/v1/vms/"+itoa(id)+"/memory-bounds", nil, bounds, &resp)
+	return resp.Data.MemoryBounds, err
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Webhooks and alerts belong to the project the client acts on. Operators can read
+// webhooks and manage alerts; only project admins can manage webhooks.
+
+// ListWebhooks lists webhooks, without their secrets.
+func (c *Client) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var resp struct {
+		Data struct {
+			Webhooks []Webhook `json:"webhooks"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/webhooks", nil, nil, &resp)
+	return resp.Data.Webhooks, err
+}
+
+// CreateWebhookRequest describes a webhook to register.
+type CreateWebhookRequest struct {
+	// URL must be an absolute http or https URL with a public address. Redirects aren't
+	// followed.
+	URL string `json:"url"`
+	// Events optionally filters deliveries, e.g. ["vm.crashed", "alert.*"].
+	Events []string `json:"events,omitempty"`
+	// Secret signs deliveries. One is generated when left empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// CreateWebhook registers a webhook, returning it with its secret.
+func (c *Client) CreateWebhook(ctx context.Context, req CreateWebhookRequest) (Webhook, error) {
+	var resp struct {
+		Data struct {
+			Webhook Webhook `json:"webhook"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/webhooks", nil, req, &resp)
+	return resp.Data.Webhook, err
+}
+
+// DeleteWebhook deletes a webhook.
+func (c *Client) DeleteWebhook(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/webhooks/"+itoa(id), nil, nil, nil)
+}
+
+// ListWebhookDeliveries lists a webhook's recent deliveries.
+func (c *Client) ListWebhookDeliveries(ctx context.Context, webhookID int) ([]WebhookDelivery, error) {
+	var resp struct {
+		Data struct {
+			Deliveries []WebhookDelivery `json:"deliveries"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/webhooks/"+itoa(webhookID)+"/deliveries", nil, nil, &resp)
+	return resp.Data.Deliveries, err
+}
+
+// ReplayWebhookDelivery queues a delivery to be sent again.
+func (c *Client) ReplayWebhookDelivery(ctx context.Context, webhookID, deliveryID int) error {
+	path := "/api/v1/webhooks/" + itoa(webhookID) + "/deliveries/" + itoa(deliveryID) + "/replay"
+	return c.do(ctx, http.MethodPost, path, nil, nil, nil)
+}
+
+// ListAlerts lists recent alerts, only those with status if it isn't empty: "firing" or
+// "resolved".
+func (c *Client) ListAlerts(ctx context.Context, status string) ([]Alert, error) {
+	q := url.Values{}
+	if status != "" {
+		q.Set("status", status)
+	}
+	var resp struct {
+		Data struct {
+			Alerts []Alert `json:"alerts"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/alerts", q, nil, &resp)
+	return resp.Data.Alerts, err
+}
+
+// ListAlertRules lists alert rules.
+func (c *Client) ListAlertRules(ctx context.Context) ([]AlertRule, error) {
+	var resp struct {
+		Data struct {
+			Rules []AlertRule `json:"rules"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/alerts/rules", nil, nil, &resp)
+	return resp.Data.Rules, err
+}
+
+// CreateAlertRuleRequest describes an alert rule to create, e.g. {Name: "high memory",
+// Metric: "memory_usage", Comparison: ">", Threshold: 90, Duration: "5m"}.
+type CreateAlertRuleRequest struct {
+	Name       string  `json:"name"`
+	Metric     string  `json:"metric"`
+	Comparison string  `json:"comparison"`
+	Threshold  float64 `json:"threshold"`
+	// Duration is how long the condition must hold before firing, as a Go duration.
+	Duration string `json:"duration,omitempty"`
+	// VMName optionally limits the rule to a single VM.
+	VMName string `json:"vm_name,omitempty"`
+	// Notify optionally limits which sinks are notified: "log", "webhook" or "email".
+	Notify []string `json:"notify,omitempty"`
+}
+
+// CreateAlertRule creates an alert rule.
+func (c *Client) CreateAlertRule(ctx context.Context, req CreateAlertRuleRequest) (AlertRule, error) {
+	var resp struct {
+		Data struct {
+			Rule AlertRule `json:"rule"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/alerts/rules", nil, req, &resp)
+	return resp.Data.Rule, err
+}
+
+// DeleteAlertRule deletes an alert rule.
+func (c *Client) DeleteAlertRule(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/alerts/rules/"+itoa(id), nil, nil, nil)
+}
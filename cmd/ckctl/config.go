@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is ckctl's config file: named profiles and which one to use by default.
+type Config struct {
+	CurrentProfile string             `yaml:"current_profile,omitempty"`
+	Profiles       map[string]Profile `yaml:"profiles,omitempty"`
+}
+
+// Profile is a cloudkit server and how to talk to it.
+type Profile struct {
+	Server  string `yaml:"server,omitempty"`
+	APIKey  string `yaml:"api_key,omitempty"`
+	Project int    `yaml:"project,omitempty"`
+}
+
+// defaultConfigPath is ckctl/config.yaml in the user's config directory.
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding config directory: %w", err)
+	}
+	return filepath.Join(dir, "ckctl", "config.yaml"), nil
+}
+
+// loadConfig reads the config file at path, which is empty until one is saved.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{Profiles: map[string]Profile{}}
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = map[string]Profile{}
+	}
+	return cfg, nil
+}
+
+// save writes the config to path, readable only by the user since it holds API keys.
+func (cfg *Config) save(path string) error {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func configSetCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return errors.New("usage: ckctl config set <profile> [-server url] [-api-key key] [-project id]")
+			}
+			name := args[0]
+			p := e.cfg.Profiles[name]
+			// Only what's given on the command line is saved, not what the environment set.
+			e.flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "server":
+					p.Server = strings.TrimSuffix(f.Value.String(), "/")
+				case "api-key":
+					p.APIKey = f.Value.String()
+				case "project":
+					p.Project = e.profile.Project
+				}
+			})
+			if p.Server == "" {
+				return errors.New("a profile needs a -server")
+			}
+			e.cfg.Profiles[name] = p
+			if e.cfg.CurrentProfile == "" {
+				e.cfg.CurrentProfile = name
+			}
+			if err := e.cfg.save(e.path); err != nil {
+				return err
+			}
+			fmt.Printf("saved profile %q to %s\n", name, e.path)
+			return nil
+		},
+	}
+}
+
+func configUseCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return errors.New("usage: ckctl config use <profile>")
+			}
+			if _, ok := e.cfg.Profiles[args[0]]; !ok {
+				return fmt.Errorf("no profile named %q in %s", args[0], e.path)
+			}
+			e.cfg.CurrentProfile = args[0]
+			if err := e.cfg.save(e.path); err != nil {
+				return err
+			}
+			fmt.Printf("using profile %q\n", args[0])
+			return nil
+		},
+	}
+}
+
+func configListCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			names := make([]string, 0, len(e.cfg.Profiles))
+			for name := range e.cfg.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			type row struct {
+				Name    string `json:"name"`
+				Current bool   `json:"current"`
+				Server  string `json:"server"`
+				Project int    `json:"project,omitempty"`
+			}
+			rows := make([]row, 0, len(names))
+			for _, name := range names {
+				p := e.cfg.Profiles[name]
+				rows = append(rows, row{name, name == e.cfg.CurrentProfile, p.Server, p.Project})
+			}
+			return e.out.print(rows, []string{"CURRENT", "NAME", "SERVER", "PROJECT"}, func(add func(...interface{})) {
+				for _, r := range rows {
+					current := ""
+					if r.Current {
+						current = "*"
+					}
+					add(current, r.Name, r.Server, optional(r.Project))
+				}
+			})
+		},
+	}
+}
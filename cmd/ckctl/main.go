@@ -0,0 +1,216 @@
+// Command ckctl manages cloudkit from the command line through its REST API.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/client"
+)
+
+const usage = `usage: ckctl <command> [flags]
+
+commands:
+  vm list                  list the project's VMs
+  vm get <vm id>           show a VM as libvirt describes it
+  vm create                create a VM
+  vm delete <vm id>        destroy a VM
+  project list             list the projects you belong to
+  config set <profile>     create or update a profile
+  config use <profile>     make a profile the default
+  config list              list profiles
+
+There are no vm start, vm stop, image list or snapshot create commands: cloudkit's VMs
+are transient libvirt domains that can't be restarted once stopped, so delete and
+recreate a VM instead, and it has no image or snapshot API yet.
+
+global flags, accepted by every command:
+  -profile name      profile to use (default the current one, or $CKCTL_PROFILE)
+  -server url        cloudkit server, overriding the profile's (or $CLOUDKIT_URL)
+  -api-key key       API key, overriding the profile's (or $CLOUDKIT_API_KEY)
+  -project id        project to act on, overriding the profile's
+  -o format          output as table, json or yaml (default table)
+  -config file       config file (default $XDG_CONFIG_HOME/ckctl/config.yaml)
+
+Run "ckctl <command> -h" for a command's own flags.`
+
+// requestTimeout bounds every request but streams.
+const requestTimeout = 2 * time.Minute
+
+// globals are the flags every command accepts.
+type globals struct {
+	profile    string
+	server     string
+	apiKey     string
+	project    int
+	output     string
+	configPath string
+}
+
+func (g *globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.profile, "profile", os.Getenv("CKCTL_PROFILE"), "profile to use")
+	fs.StringVar(&g.server, "server", os.Getenv("CLOUDKIT_URL"), "cloudkit server URL")
+	fs.StringVar(&g.apiKey, "api-key", os.Getenv("CLOUDKIT_API_KEY"), "API key")
+	fs.IntVar(&g.project, "project", 0, "project ID")
+	fs.StringVar(&g.output, "o", "table", "output format: table, json or yaml")
+	fs.StringVar(&g.configPath, "config", "", "config file")
+}
+
+// command is a ckctl subcommand. Its flags are parsed before run is called.
+type command struct {
+	flags func(fs *flag.FlagSet)
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"vm": {
+		"list":   vmListCommand(),
+		"get":    vmGetCommand(),
+		"create": vmCreateCommand(),
+		"delete": vmDeleteCommand(),
+	},
+	"project": {
+		"list": projectListCommand(),
+	},
+	"config": {
+		"set":  configSetCommand(),
+		"use":  configUseCommand(),
+		"list": configListCommand(),
+	},
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "ckctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	group, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", args[0]+" "+args[1], usage)
+	}
+
+	name := args[0] + " " + args[1]
+	fs := flag.NewFlagSet("ckctl "+name, flag.ContinueOnError)
+	var g globals
+	g.register(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	positional, err := parseInterspersed(fs, args[2:])
+	if err != nil {
+		return err
+	}
+
+	e, err := newEnv(g)
+	if err != nil {
+		return err
+	}
+	e.flags = fs
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return cmd.run(ctx, e, positional)
+}
+
+// parseInterspersed parses flags wherever they appear among args, so that both
+// "ckctl vm get -o json 12" and "ckctl vm get 12 -o json" work, returning the rest.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// env is what commands run with: the resolved profile, a client for it and how to print.
+type env struct {
+	cfg     *Config
+	path    string
+	profile Profile
+	client  *client.Client
+	out     printer
+	flags   *flag.FlagSet
+}
+
+// newEnv resolves the profile to use, letting flags and the environment override it.
+func newEnv(g globals) (*env, error) {
+	path := g.configPath
+	if path == "" {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	name := g.profile
+	if name == "" {
+		name = cfg.CurrentProfile
+	}
+	p, ok := cfg.Profiles[name]
+	if g.profile != "" && !ok {
+		return nil, fmt.Errorf("no profile named %q in %s", g.profile, path)
+	}
+	if g.server != "" {
+		p.Server = g.server
+	}
+	if g.apiKey != "" {
+		p.APIKey = g.apiKey
+	}
+	if g.project != 0 {
+		p.Project = g.project
+	}
+
+	out, err := newPrinter(strings.ToLower(g.output))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &env{cfg: cfg, path: path, profile: p, out: out}
+	if p.Server != "" {
+		e.client = client.New(p.Server, p.APIKey, client.WithProject(p.Project), client.WithUserAgent("ckctl"))
+	}
+	return e, nil
+}
+
+// api returns the client for the profile, failing if there's no server to talk to.
+func (e *env) api() (*client.Client, error) {
+	if e.client == nil {
+		return nil, errors.New(`no server configured; run "ckctl config set <profile> -server URL -api-key KEY" or set CLOUDKIT_URL`)
+	}
+	return e.client, nil
+}
+
+// withTimeout bounds a single request.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, requestTimeout)
+}
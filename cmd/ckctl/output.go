@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// printer prints a command's result as a table, JSON or YAML.
+type printer string
+
+const (
+	outputTable printer = "table"
+	outputJSON  printer = "json"
+	outputYAML  printer = "yaml"
+)
+
+func newPrinter(format string) (printer, error) {
+	switch p := printer(format); p {
+	case outputTable, outputJSON, outputYAML:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown output format %q, want table, json or yaml", format)
+}
+
+// print prints v, as JSON or YAML, or as a table with the given headers and the rows
+// added by rows.
+func (p printer) print(v interface{}, headers []string, rows func(add func(...interface{}))) error {
+	switch p {
+	case outputJSON:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+
+	case outputYAML:
+		// Going through JSON keeps the API's field names and skips what it omits.
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(b, &generic); err != nil {
+			return err
+		}
+		if b, err = yaml.Marshal(generic); err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	rows(func(cols ...interface{}) {
+		s := make([]string, len(cols))
+		for i, c := range cols {
+			s[i] = fmt.Sprint(c)
+		}
+		fmt.Fprintln(w, strings.Join(s, "\t"))
+	})
+	return w.Flush()
+}
+
+// optional shows zero values as "-" in tables.
+func optional(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		if v == 0 {
+			return "-"
+		}
+	case string:
+		if v == "" {
+			return "-"
+		}
+	}
+	return v
+}
+
+// age is how long ago t was, roughly, for tables.
+func age(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bradford-hamilton/cloudkit-core/client"
+)
+
+func projectListCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			c, err := e.api()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withTimeout(ctx)
+			defer cancel()
+
+			projects, err := c.ListProjects(ctx)
+			if err != nil {
+				return err
+			}
+			if projects == nil {
+				projects = []client.Project{}
+			}
+			return e.out.print(projects, []string{"ID", "NAME", "ROLE", "AGE"}, func(add func(...interface{})) {
+				for _, p := range projects {
+					add(p.ID, p.Name, optional(p.Role), age(p.CreatedAt))
+				}
+			})
+		},
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/client"
+)
+
+func vmListCommand() command {
+	var state string
+	return command{
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&state, "state", "", "only list VMs in this state, e.g. running")
+		},
+		run: func(ctx context.Context, e *env, args []string) error {
+			c, err := e.api()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withTimeout(ctx)
+			defer cancel()
+
+			vms, err := c.ListAllVMs(ctx, state)
+			if err != nil {
+				return err
+			}
+			if vms == nil {
+				vms = []client.VM{}
+			}
+			return e.out.print(vms, []string{"ID", "NAME", "STATE", "IP", "VCPUS", "MEMORY", "HOST", "AGE"}, func(add func(...interface{})) {
+				for _, vm := range vms {
+					add(vm.ID, vm.Name, vm.State, optional(vm.IP), vm.VCPUs, fmt.Sprintf("%dMiB", vm.MemoryMiB), optional(vm.Host), age(vm.CreatedAt))
+				}
+			})
+		},
+	}
+}
+
+func vmGetCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			id, err := vmIDArg("get", args)
+			if err != nil {
+				return err
+			}
+			c, err := e.api()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withTimeout(ctx)
+			defer cancel()
+
+			vm, usage, err := c.GetVM(ctx, id)
+			if err != nil {
+				return err
+			}
+			result := struct {
+				VM          client.Domain     `json:"vm"`
+				MemoryUsage []client.MemUsage `json:"memory_usage"`
+			}{vm, usage}
+			return e.out.print(result, []string{"ID", "NAME", "STATE", "IP", "MAC", "VCPUS", "MEMORY", "MEMORY USED", "HOST"}, func(add func(...interface{})) {
+				used := "-"
+				if len(usage) > 0 {
+					used = fmt.Sprintf("%.0f%%", usage[len(usage)-1].Usage)
+				}
+				add(id, vm.Name, vm.State, optional(vm.IP), optional(vm.MAC), vm.VCPUs, fmt.Sprintf("%dMiB", vm.CurrentMem/1024), used, optional(vm.Host))
+			})
+		},
+	}
+}
+
+func vmCreateCommand() command {
+	var req client.CreateVMRequest
+	var wait bool
+	var timeout time.Duration
+	return command{
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&req.MachineType, "machine-type", "ubuntu-18.04", "machine type")
+			fs.IntVar(&req.MemoryGB, "memory", 1, "memory in GB")
+			fs.IntVar(&req.VCPUs, "vcpus", 1, "number of vCPUs")
+			fs.BoolVar(&wait, "wait", false, "wait for the VM to be created and print it")
+			fs.DurationVar(&timeout, "timeout", 15*time.Minute, "how long to wait")
+		},
+		run: func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 0 {
+				return errors.New("usage: ckctl vm create [-machine-type type] [-memory GB] [-vcpus n] [-wait]")
+			}
+			c, err := e.api()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			// The operation's events are only seen by streams already open when it starts.
+			var stream *client.EventStream
+			if wait {
+				stream, err = c.Events(ctx, client.EventFilter{Types: []string{client.EventOperationProgress}})
+				if err != nil {
+					return fmt.Errorf("following the operation: %w", err)
+				}
+				defer stream.Close()
+			}
+
+			opID, err := c.CreateVM(ctx, req)
+			if err != nil {
+				return err
+			}
+			if !wait {
+				return e.out.print(map[string]string{"operation_id": opID}, []string{"OPERATION"}, func(add func(...interface{})) {
+					add(opID)
+				})
+			}
+
+			fmt.Fprintf(os.Stderr, "waiting for operation %s\n", opID)
+			op, vmName, err := waitOperation(stream, opID)
+			if err != nil {
+				return fmt.Errorf("waiting for operation %s: %w", opID, err)
+			}
+			if op.Status == client.OperationFailed {
+				return fmt.Errorf("operation %s failed: %s", opID, op.Detail)
+			}
+
+			vms, err := c.ListAllVMs(ctx, "")
+			if err != nil {
+				return err
+			}
+			for _, vm := range vms {
+				if vm.Name == vmName {
+					return e.out.print(vm, []string{"ID", "NAME", "STATE", "IP", "VCPUS", "MEMORY", "HOST"}, func(add func(...interface{})) {
+						add(vm.ID, vm.Name, vm.State, optional(vm.IP), vm.VCPUs, fmt.Sprintf("%dMiB", vm.MemoryMiB), optional(vm.Host))
+					})
+				}
+			}
+			return fmt.Errorf("operation %s succeeded but VM %q isn't listed", opID, vmName)
+		},
+	}
+}
+
+// waitOperation follows the operation with the given ID like EventStream.WaitOperation,
+// also returning the name of the VM its final event was about.
+func waitOperation(s *client.EventStream, id string) (client.Operation, string, error) {
+	for {
+		ev, err := s.Next()
+		if err != nil {
+			return client.Operation{}, "", err
+		}
+		if ev.Type != client.EventOperationProgress {
+			continue
+		}
+		var op client.Operation
+		if err := json.Unmarshal(ev.Data, &op); err != nil {
+			return client.Operation{}, "", fmt.Errorf("decoding operation: %w", err)
+		}
+		if op.ID == id && (op.Status == client.OperationSucceeded || op.Status == client.OperationFailed) {
+			return op, ev.VMName, nil
+		}
+	}
+}
+
+func vmDeleteCommand() command {
+	return command{
+		run: func(ctx context.Context, e *env, args []string) error {
+			id, err := vmIDArg("delete", args)
+			if err != nil {
+				return err
+			}
+			c, err := e.api()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := withTimeout(ctx)
+			defer cancel()
+
+			if err := c.DeleteVM(ctx, id); err != nil {
+				return err
+			}
+			fmt.Printf("deleted VM %d\n", id)
+			return nil
+		},
+	}
+}
+
+// vmIDArg parses the VM ID, as listed by "ckctl vm list", a vm command takes as its only
+// argument.
+func vmIDArg(cmd string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("usage: ckctl vm %s <vm id>", cmd)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid vm id %q", args[0])
+	}
+	return id, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/auth"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// bootstrapKeyDelivery hands over a generated first API key without it reaching the
+// logs: it is written to path if set, or else printed to stderr if that's a terminal.
+// Whether path can be written, or stderr is a terminal, is checked up front.
+func bootstrapKeyDelivery(path string) auth.KeyDelivery {
+	return func() (func(token string) error, error) {
+		if path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+			if err != nil {
+				return nil, err
+			}
+			f.Close()
+			return func(token string) error { return writeKeyFile(path, token) }, nil
+		}
+		if !terminal.IsTerminal(int(os.Stderr.Fd())) {
+			return nil, errors.New("no users exist yet and stderr isn't a terminal to show the first API key on; " +
+				"set auth.admin_key_file (CLOUDKIT_ADMIN_KEY_FILE) or auth.admin_api_key (CLOUDKIT_ADMIN_API_KEY)")
+		}
+		return func(token string) error {
+			_, err := fmt.Fprintf(os.Stderr, "\nCreated the first user with API key %s\nStore it now, it won't be shown again.\n\n", token)
+			return err
+		}, nil
+	}
+}
+
+// writeKeyFile writes token to path, readable only by its owner.
+func writeKeyFile(path, token string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// OpenFile keeps the mode of a file that already exists.
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := fmt.Fprintln(f, token); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,41 +2,128 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/bradford-hamilton/cloudkit-core/internal/alerts"
+	"github.com/bradford-hamilton/cloudkit-core/internal/auth"
+	"github.com/bradford-hamilton/cloudkit-core/internal/balloon"
 	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
+	"github.com/bradford-hamilton/cloudkit-core/internal/metrics"
+	"github.com/bradford-hamilton/cloudkit-core/internal/monitor"
+	"github.com/bradford-hamilton/cloudkit-core/internal/reconciler"
 	"github.com/bradford-hamilton/cloudkit-core/internal/server"
 	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/bradford-hamilton/cloudkit-core/internal/webhooks"
 	"github.com/sirupsen/logrus"
 )
 
-const tmpConnStr = "206.189.218.106:16509"
-
 func main() {
-	// TODO: env var check
 	// TODO: switch gin to release (prod) mode in prod
 	// TODO: hooks, config, etc for logging
 
+	configPath := flag.String("config", os.Getenv("CLOUDKIT_CONFIG"), "path to a YAML or TOML config file")
+	flag.Parse()
+
 	log := logrus.New()
 	log.WithFields(nil).Info("Application initializing...")
 
-	db, err := storage.NewDatabase()
+	cfg, err := config.Read(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Migrations only need the database, so they don't insist on the rest being set.
+	migrate := flag.Arg(0) == "migrate"
+	validate := cfg.Validate
+	if migrate {
+		validate = cfg.ValidateDatabase
+	}
+	if err := validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	connCtx, cancelConn := context.WithTimeout(context.Background(), 30*time.Second)
+	db, err := storage.NewDatabase(connCtx, cfg.Database)
+	cancelConn()
 	if err != nil {
-		log.Panicf("failed to initialize PostgreSQL connection", err)
+		log.Panicf("failed to initialize PostgreSQL connection: %v", err)
 	}
 	defer db.Close()
 
-	ckm, err := cloudkit.NewVMManager(tmpConnStr, log)
+	if migrate {
+		if err := runMigrate(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.Database.AutoMigrate {
+		applied, err := db.MigrateUp(context.Background())
+		if err != nil {
+			log.Panicf("failed to migrate the database: %v", err)
+		}
+		for _, mg := range applied {
+			log.Infof("applied migration %d_%s", mg.Version, mg.Name)
+		}
+	}
+
+	// cfg.Validate, which migrate commands are the only ones to skip, has already checked
+	// the libvirt URI parses.
+	endpoint, _ := cfg.Libvirt.Endpoint()
+	m := metrics.New(endpoint.Hostname())
+
+	creds, err := hostcreds.New(cfg.Host, db, log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ckm, err := cloudkit.NewVMManager(cfg.Libvirt, cfg.Host, creds, log, m)
 	if err != nil {
-		log.Panicf("failed to initialize new cloudkit", err)
+		log.Panicf("failed to initialize new cloudkit: %v", err)
 	}
 
-	app := server.New(ckm, db, log)
-	httpSrv := &http.Server{Addr: ":4000", Handler: app.Router()}
+	monCfg := monitor.DefaultConfig()
+	monCfg.Interval = cfg.Monitor.Interval.Duration
+	broker := events.NewBroker(1000)
+	sinks := []alerts.Sink{alerts.NewLogSink(log), alerts.NewWebhookSink(broker)}
+	if cfg.Alerts.SMTPAddr != "" {
+		sinks = append(sinks, alerts.NewEmailSink(cfg.Alerts.SMTPAddr, cfg.Alerts.EmailFrom, cfg.Alerts.EmailTo))
+	}
+	evaluator := alerts.NewEvaluator(db, sinks, log)
+
+	mon := monitor.New(ckm, db, m, broker, evaluator, monCfg, log)
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	monDone := make(chan struct{})
+	go func() {
+		mon.Run(bgCtx)
+		close(monDone)
+	}()
+	go ckm.Run(bgCtx)
+	go events.NewWatcher(ckm, db, broker, log).Run(bgCtx)
+	recCfg := reconciler.DefaultConfig()
+	recCfg.Interval = cfg.Reconciler.Interval.Duration
+	go reconciler.NewReconciler(ckm, db, broker, recCfg, log).Run(bgCtx)
+	go webhooks.NewDispatcher(db, broker, webhooks.DefaultConfig(), log).Run(bgCtx)
+	if cfg.Balancer.Enabled {
+		go balloon.NewController(ckm, db, balloon.DefaultConfig(), log).Run(bgCtx)
+	}
+
+	created, err := auth.Bootstrap(context.Background(), db, cfg.Auth.AdminEmail, cfg.Auth.AdminAPIKey, bootstrapKeyDelivery(cfg.Auth.AdminKeyFile))
+	if err != nil {
+		log.Panicf("failed to bootstrap the admin user, err: %+v", err)
+	}
+	if created {
+		log.Infof("created the first user, %s", cfg.Auth.AdminEmail)
+	}
+
+	app := server.New(ckm, db, mon, broker, evaluator, m, cfg.Server, log)
+	httpSrv := &http.Server{Addr: cfg.Server.Listen, Handler: app.Router()}
 
 	// Initialize server in a goroutine so we don't block the graceful shutdown handling below.
 	go func() {
@@ -46,15 +133,27 @@ func main() {
 	}()
 
 	// Wait for interrupt signal to gracefully shutdown
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 	log.Println("Shutting down server...")
 
-	// Gracefully shutdown after five seconds.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Stop the background workers first so no new work starts while the server drains.
+	stopBackground()
+
+	// Give in flight requests up to the configured shutdown timeout to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
 	defer cancel()
 	if err := httpSrv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	if err := app.WaitForCreates(ctx); err != nil {
+		log.Warn("VMs were still being created at shutdown")
+	}
+
+	select {
+	case <-monDone:
+	case <-ctx.Done():
+		log.Warn("VM monitor did not stop in time")
+	}
 }
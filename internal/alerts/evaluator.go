@@ -0,0 +1,298 @@
+// Package alerts evaluates threshold rules against the metrics the VM monitor collects
+// and notifies sinks when alerts fire and resolve.
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics are the names rules can be written against. Disk and network metrics are
+// summed across every device on the VM.
+var Metrics = []string{
+	"memory_usage",
+	"cpu_usage",
+	"disk_read_bytes_per_sec",
+	"disk_write_bytes_per_sec",
+	"disk_read_iops",
+	"disk_write_iops",
+	"net_rx_bytes_per_sec",
+	"net_tx_bytes_per_sec",
+	"net_rx_packets_per_sec",
+	"net_tx_packets_per_sec",
+}
+
+// Comparisons are the operators rules can use.
+var Comparisons = []string{">", ">=", "<", "<="}
+
+// firingLimit caps how many firing alerts are loaded when the evaluator starts.
+const firingLimit = 10000
+
+// notifyTimeout bounds sending one notification to one sink.
+const notifyTimeout = 30 * time.Second
+
+// compare reports whether value breaches threshold under op.
+func compare(op string, value, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	default:
+		return false
+	}
+}
+
+// key identifies a rule applied to one VM.
+type key struct {
+	ruleID int
+	vmName string
+}
+
+// notification is an alert change waiting to be sent to the rule's sinks.
+type notification struct {
+	rule  storage.AlertRule
+	alert storage.Alert
+}
+
+// Evaluator tracks, for every rule and VM, how long a rule has been breached and which
+// alerts are currently firing.
+type Evaluator struct {
+	storage storage.Datastore
+	sinks   []Sink
+	logger  *logrus.Logger
+
+	mu      sync.Mutex
+	loaded  bool
+	pending map[key]time.Time
+	firing  map[key]storage.Alert
+}
+
+// NewEvaluator creates an Evaluator that notifies sinks.
+func NewEvaluator(db storage.Datastore, sinks []Sink, log *logrus.Logger) *Evaluator {
+	return &Evaluator{
+		storage: db,
+		sinks:   sinks,
+		logger:  log,
+		pending: make(map[key]time.Time),
+		firing:  make(map[key]storage.Alert),
+	}
+}
+
+// Evaluate checks every rule against the latest metric values for each of its project's
+// VMs, keyed by VM name then metric name. A VM or metric missing from values leaves its
+// alert state untouched, so a single failed poll neither fires nor resolves anything,
+// unless the VM no longer exists, in which case its firing alerts are resolved. Sinks are notified
+// once the evaluation is done, so a slow sink doesn't hold up the next one.
+func (e *Evaluator) Evaluate(ctx context.Context, values map[string]map[string]float64, now time.Time) {
+	for _, n := range e.collect(ctx, values, now) {
+		e.notify(ctx, n.rule, n.alert)
+	}
+}
+
+// collect updates the alert state and returns the notifications it calls for.
+func (e *Evaluator) collect(ctx context.Context, values map[string]map[string]float64, now time.Time) []notification {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.loaded {
+		if err := e.load(ctx); err != nil {
+			e.logger.Errorf("failed to load firing alerts, err: %+v", err)
+			return nil
+		}
+		e.loaded = true
+	}
+
+	rules, err := e.storage.ListAlertRules(ctx, 0)
+	if err != nil {
+		e.logger.Errorf("failed to list alert rules, err: %+v", err)
+		return nil
+	}
+	// Rules only apply to their own project's VMs.
+	owners, err := e.storage.ListVMProjects(ctx)
+	if err != nil {
+		e.logger.Errorf("failed to list VM projects, err: %+v", err)
+		return nil
+	}
+
+	var notes []notification
+	active := make(map[int]storage.AlertRule, len(rules))
+	for _, r := range rules {
+		active[r.ID] = r
+		for vm, metrics := range values {
+			if owners[vm] != r.ProjectID || r.VMName != "" && r.VMName != vm {
+				continue
+			}
+			if v, ok := metrics[r.Metric]; ok {
+				if n, ok := e.evaluate(ctx, r, vm, v, now); ok {
+					notes = append(notes, n)
+				}
+			}
+		}
+	}
+
+	// Deleting a rule cascades to its alerts, so just forget them.
+	for k := range e.pending {
+		if _, ok := active[k.ruleID]; !ok {
+			delete(e.pending, k)
+		}
+	}
+	for k := range e.firing {
+		if _, ok := active[k.ruleID]; !ok {
+			delete(e.firing, k)
+		}
+	}
+
+	return append(notes, e.resolveGone(ctx, active, owners, now)...)
+}
+
+func (e *Evaluator) evaluate(ctx context.Context, r storage.AlertRule, vm string, value float64, now time.Time) (notification, bool) {
+	k := key{ruleID: r.ID, vmName: vm}
+	a, isFiring := e.firing[k]
+
+	if !compare(r.Comparison, value, r.Threshold) {
+		delete(e.pending, k)
+		if !isFiring {
+			return notification{}, false
+		}
+		return e.resolve(ctx, r, k, a, value, now)
+	}
+
+	if isFiring {
+		return notification{}, false
+	}
+
+	since, ok := e.pending[k]
+	if !ok {
+		since = now
+		e.pending[k] = since
+	}
+	if now.Sub(since) < time.Duration(r.DurationSeconds)*time.Second {
+		return notification{}, false
+	}
+
+	a = storage.Alert{
+		ProjectID:  r.ProjectID,
+		RuleID:     r.ID,
+		RuleName:   r.Name,
+		VMName:     vm,
+		Metric:     r.Metric,
+		Comparison: r.Comparison,
+		Threshold:  r.Threshold,
+		Value:      value,
+		Status:     storage.AlertFiring,
+		StartedAt:  since,
+	}
+	a, err := e.storage.CreateAlert(ctx, a)
+	if err != nil {
+		e.logger.Errorf("failed to record alert for rule %d, err: %+v", r.ID, err)
+		return notification{}, false
+	}
+	delete(e.pending, k)
+	e.firing[k] = a
+	return notification{rule: r, alert: a}, true
+}
+
+// resolve marks a firing alert resolved at value.
+func (e *Evaluator) resolve(ctx context.Context, r storage.AlertRule, k key, a storage.Alert, value float64, now time.Time) (notification, bool) {
+	if err := e.storage.ResolveAlert(ctx, a.ID, value, now); err != nil {
+		e.logger.Errorf("failed to resolve alert %d, err: %+v", a.ID, err)
+		return notification{}, false
+	}
+	delete(e.firing, k)
+	a.Status, a.Value, a.ResolvedAt = storage.AlertResolved, value, &now
+	return notification{rule: r, alert: a}, true
+}
+
+// resolveGone resolves firing alerts, and forgets pending ones, for VMs their rule's
+// project no longer owns, given which project owns each VM. A deleted VM never reports
+// the values that would resolve its alerts otherwise.
+func (e *Evaluator) resolveGone(ctx context.Context, rules map[int]storage.AlertRule, owners map[string]int, now time.Time) []notification {
+	gone := func(k key) bool {
+		return owners[k.vmName] != rules[k.ruleID].ProjectID
+	}
+	for k := range e.pending {
+		if gone(k) {
+			delete(e.pending, k)
+		}
+	}
+	var notes []notification
+	for k, a := range e.firing {
+		if !gone(k) {
+			continue
+		}
+		if n, ok := e.resolve(ctx, rules[k.ruleID], k, a, a.Value, now); ok {
+			notes = append(notes, n)
+		}
+	}
+	return notes
+}
+
+// notify sends a to every sink the rule asks for, giving each notifyTimeout. One failing
+// sink doesn't stop the rest.
+func (e *Evaluator) notify(ctx context.Context, r storage.AlertRule, a storage.Alert) {
+	for _, s := range e.sinks {
+		if len(r.Notify) > 0 && !contains(r.Notify, s.Name()) {
+			continue
+		}
+		sctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := s.Notify(sctx, a)
+		cancel()
+		if err != nil {
+			e.logger.Errorf("failed to notify %s sink about alert %d, err: %+v", s.Name(), a.ID, err)
+		}
+	}
+}
+
+// load restores firing alerts from storage so a restart doesn't fire them again.
+func (e *Evaluator) load(ctx context.Context) error {
+	alerts, err := e.storage.ListAlerts(ctx, 0, storage.AlertFiring, firingLimit)
+	if err != nil {
+		return err
+	}
+	for _, a := range alerts {
+		e.firing[key{ruleID: a.RuleID, vmName: a.VMName}] = a
+	}
+	return nil
+}
+
+// Validate checks that a rule uses a known metric, comparison and notification sinks.
+func (e *Evaluator) Validate(r storage.AlertRule) error {
+	if !contains(Metrics, r.Metric) {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	if !contains(Comparisons, r.Comparison) {
+		return fmt.Errorf("unknown comparison %q", r.Comparison)
+	}
+	if r.DurationSeconds < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	for _, n := range r.Notify {
+		found := false
+		for _, s := range e.sinks {
+			found = found || s.Name() == n
+		}
+		if !found {
+			return fmt.Errorf("unknown notification sink %q", n)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
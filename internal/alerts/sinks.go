@@ -0,0 +1,174 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types published for alerts.
+const (
+	EventAlertFiring   = "alert.firing"
+	EventAlertResolved = "alert.resolved"
+)
+
+// Sink is somewhere alert notifications are sent.
+type Sink interface {
+	// Name is how rules refer to the sink in their notify list.
+	Name() string
+	Notify(ctx context.Context, a storage.Alert) error
+}
+
+// LogSink writes alerts to the application log.
+type LogSink struct {
+	logger *logrus.Logger
+}
+
+// NewLogSink creates a LogSink.
+func NewLogSink(log *logrus.Logger) *LogSink {
+	return &LogSink{logger: log}
+}
+
+// Name implements Sink.
+func (s *LogSink) Name() string { return "log" }
+
+// Notify implements Sink.
+func (s *LogSink) Notify(ctx context.Context, a storage.Alert) error {
+	s.logger.WithFields(logrus.Fields{
+		"rule":   a.RuleName,
+		"vm":     a.VMName,
+		"metric": a.Metric,
+		"value":  a.Value,
+	}).Warnf("alert %s", a.Status)
+	return nil
+}
+
+// WebhookSink publishes alerts to the event broker, from where they are delivered to
+// every registered webhook subscribed to alert events and to event stream clients.
+type WebhookSink struct {
+	broker *events.Broker
+}
+
+// NewWebhookSink creates a WebhookSink.
+func NewWebhookSink(b *events.Broker) *WebhookSink {
+	return &WebhookSink{broker: b}
+}
+
+// Name implements Sink.
+func (s *WebhookSink) Name() string { return "webhook" }
+
+// Notify implements Sink.
+func (s *WebhookSink) Notify(ctx context.Context, a storage.Alert) error {
+	typ := EventAlertFiring
+	if a.Status == storage.AlertResolved {
+		typ = EventAlertResolved
+	}
+	s.broker.PublishProject(a.ProjectID, typ, a.VMName, a)
+	return nil
+}
+
+// EmailSink sends a plain text email per alert through an SMTP relay. It doesn't
+// authenticate, so it is meant for a local relay or a stand-in such as MailHog.
+type EmailSink struct {
+	addr string
+	from string
+	to   []string
+}
+
+// NewEmailSink creates an EmailSink that relays through addr (host:port).
+func NewEmailSink(addr, from string, to []string) *EmailSink {
+	return &EmailSink{addr: addr, from: from, to: to}
+}
+
+// Name implements Sink.
+func (s *EmailSink) Name() string { return "email" }
+
+// Notify implements Sink.
+func (s *EmailSink) Notify(ctx context.Context, a storage.Alert) error {
+	subject := fmt.Sprintf("[cloudkit] %s: %s on %s", strings.ToUpper(a.Status), a.RuleName, a.VMName)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "Rule:      %s\r\n", a.RuleName)
+	fmt.Fprintf(&body, "VM:        %s\r\n", a.VMName)
+	fmt.Fprintf(&body, "Condition: %s %s %g\r\n", a.Metric, a.Comparison, a.Threshold)
+	fmt.Fprintf(&body, "Value:     %g\r\n", a.Value)
+	fmt.Fprintf(&body, "Started:   %s\r\n", a.StartedAt.Format(time.RFC3339))
+	if a.ResolvedAt != nil {
+		fmt.Fprintf(&body, "Resolved:  %s\r\n", a.ResolvedAt.Format(time.RFC3339))
+	}
+
+	return s.send(ctx, body.Bytes())
+}
+
+// send is smtp.SendMail without authentication, giving up once ctx is done.
+func (s *EmailSink) send(ctx context.Context, msg []byte) (err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(s.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,112 @@
+// Package apperr classifies errors by what went wrong rather than where, so the API can
+// answer each with the right status code and a message that's safe to show, without
+// handlers knowing whether it came from libvirt, Postgres or the request itself.
+package apperr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Code says what kind of failure an error is. Codes are part of the API.
+type Code string
+
+// Codes, roughly from the caller's fault to the server's.
+const (
+	InvalidArgument  Code = "invalid_argument"
+	Unauthenticated  Code = "unauthenticated"
+	PermissionDenied Code = "permission_denied"
+	NotFound         Code = "not_found"
+	Conflict         Code = "conflict"
+	QuotaExceeded    Code = "quota_exceeded"
+	Canceled         Code = "canceled"
+	DeadlineExceeded Code = "deadline_exceeded"
+	Unavailable      Code = "unavailable"
+	Internal         Code = "internal"
+)
+
+// statuses maps each Code to the HTTP status it's answered with.
+var statuses = map[Code]int{
+	InvalidArgument:  http.StatusBadRequest,
+	Unauthenticated:  http.StatusUnauthorized,
+	PermissionDenied: http.StatusForbidden,
+	NotFound:         http.StatusNotFound,
+	Conflict:         http.StatusConflict,
+	QuotaExceeded:    http.StatusForbidden,
+	// The client has gone, so no one sees this. 499 is what nginx logs for it.
+	Canceled:         499,
+	DeadlineExceeded: http.StatusGatewayTimeout,
+	Unavailable:      http.StatusServiceUnavailable,
+	Internal:         http.StatusInternalServerError,
+}
+
+// Error is a classified error.
+type Error struct {
+	Code Code
+	// Message describes the failure to API clients, so it mustn't leak internals.
+	Message string
+	// Details optionally adds structured information for clients, e.g. which field of a
+	// request was invalid.
+	Details interface{}
+	// Err is the underlying cause. It's logged but never shown to clients.
+	Err error
+}
+
+// New returns an Error with the given code and client facing message.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap classifies err, describing it to clients with message.
+func Wrap(code Code, err error, message string) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Err == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Err.Error()
+	default:
+		return e.Message + ": " + e.Err.Error()
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// As returns the outermost *Error in err's chain. Context errors are classified too. Any
+// other error is an Internal one, described to clients only as "internal error".
+func As(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		return Wrap(DeadlineExceeded, err, "the request took too long")
+	case errors.Is(err, context.Canceled):
+		return Wrap(Canceled, err, "the request was canceled")
+	}
+	return Wrap(Internal, err, "internal error")
+}
+
+// CodeOf returns err's Code.
+func CodeOf(err error) Code {
+	return As(err).Code
+}
+
+// Is reports whether err has the given code.
+func Is(err error, code Code) bool {
+	return err != nil && CodeOf(err) == code
+}
+
+// HTTPStatus returns the status code an error with code is answered with.
+func HTTPStatus(code Code) int {
+	if s, ok := statuses[code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,119 @@
+// Package auth issues and verifies the bearer tokens API keys are made of.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+)
+
+// TokenPrefix starts every token so they are easy to spot, e.g. in leaked config.
+const TokenPrefix = "ck_"
+
+// prefixLen is how much of a token is kept in the clear to identify its key.
+const prefixLen = len(TokenPrefix) + 8
+
+// NewToken generates a random token along with the prefix and hash that get stored for
+// it. Tokens carry 256 bits of entropy, so a fast unsalted hash is enough to protect them
+// at rest while still allowing lookups by hash.
+func NewToken() (token, prefix, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	token = TokenPrefix + hex.EncodeToString(b)
+	return token, token[:prefixLen], HashToken(token), nil
+}
+
+// HashToken returns the hash a token is stored and looked up by.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidFormat reports whether s could be a token issued by NewToken, so obviously bad
+// credentials can be rejected without a trip to the database.
+func ValidFormat(s string) bool {
+	if !strings.HasPrefix(s, TokenPrefix) || len(s) != len(TokenPrefix)+64 {
+		return false
+	}
+	_, err := hex.DecodeString(s[len(TokenPrefix):])
+	return err == nil
+}
+
+// IssueKey creates an API key for a user and returns it with its token set. The token
+// can't be recovered afterwards.
+func IssueKey(ctx context.Context, db storage.Datastore, userID int, name string) (storage.APIKey, error) {
+	token, _, _, err := NewToken()
+	if err != nil {
+		return storage.APIKey{}, err
+	}
+	return issueToken(ctx, db, userID, name, token)
+}
+
+// issueToken creates an API key for a user from a token made elsewhere.
+func issueToken(ctx context.Context, db storage.Datastore, userID int, name, token string) (storage.APIKey, error) {
+	k, err := db.CreateAPIKey(ctx, storage.APIKey{UserID: userID, Name: name, Prefix: token[:prefixLen]}, HashToken(token))
+	if err != nil {
+		return storage.APIKey{}, err
+	}
+	k.Token = token
+
+	return k, nil
+}
+
+// KeyDelivery readies a way to hand over a generated first API key, failing if there's
+// none, so that's found out before anything is stored.
+type KeyDelivery func() (deliver func(token string) error, err error)
+
+// Bootstrap creates a first user with email, a system admin and admin of the default
+// project, and an API key for them when there are no users yet; otherwise the API would
+// be impossible to call. The user, key and membership are stored together or not at all.
+// The key's token is token if it isn't empty. Otherwise one is generated and handed over
+// through delivery once it's stored. It reports whether the user was created.
+func Bootstrap(ctx context.Context, db storage.Datastore, email, token string, delivery KeyDelivery) (bool, error) {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(users) > 0 {
+		return false, nil
+	}
+
+	if token != "" && !ValidFormat(token) {
+		return false, errors.New("the admin API key must be " + TokenPrefix + " followed by 64 hex digits")
+	}
+	var deliver func(token string) error
+	if token == "" {
+		if deliver, err = delivery(); err != nil {
+			return false, err
+		}
+		if token, _, _, err = NewToken(); err != nil {
+			return false, err
+		}
+	}
+
+	u := storage.User{Email: email, Name: "admin", Admin: true}
+	k := storage.APIKey{Name: "bootstrap", Prefix: token[:prefixLen]}
+	_, _, err = db.BootstrapAdmin(ctx, u, k, HashToken(token))
+	if err == storage.ErrConflict {
+		// Another server bootstrapped first.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if deliver != nil {
+		if err := deliver(token); err != nil {
+			return true, fmt.Errorf("the first user was created but its API key couldn't be handed over: %w", err)
+		}
+	}
+	return true, nil
+}
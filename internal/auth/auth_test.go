@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+)
+
+// bootstrapStore records the order bootstrapping happens in. Any other Datastore method
+// panics through the nil embedded interface.
+type bootstrapStore struct {
+	storage.Datastore
+	err   error
+	steps *[]string
+}
+
+func (b *bootstrapStore) ListUsers(ctx context.Context) ([]storage.User, error) {
+	return nil, nil
+}
+
+func (b *bootstrapStore) BootstrapAdmin(ctx context.Context, u storage.User, k storage.APIKey, tokenHash string) (storage.User, storage.APIKey, error) {
+	*b.steps = append(*b.steps, "store")
+	return u, k, b.err
+}
+
+func TestBootstrapDeliversAfterStoring(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		created bool
+		steps   []string
+	}{
+		{"stored", nil, true, []string{"check", "store", "deliver"}},
+		{"failed", errors.New("connection reset"), false, []string{"check", "store"}},
+		{"bootstrapped elsewhere", storage.ErrConflict, false, []string{"check", "store"}},
+	}
+	for _, tt := range tests {
+		var steps []string
+		delivery := func() (func(string) error, error) {
+			steps = append(steps, "check")
+			return func(token string) error {
+				if !ValidFormat(token) {
+					t.Errorf("%s: delivered %q, want a generated token", tt.name, token)
+				}
+				steps = append(steps, "deliver")
+				return nil
+			}, nil
+		}
+
+		db := &bootstrapStore{err: tt.err, steps: &steps}
+		created, err := Bootstrap(context.Background(), db, "admin@example.com", "", delivery)
+		if created != tt.created || (err != nil) != (tt.err != nil && tt.err != storage.ErrConflict) {
+			t.Errorf("%s: Bootstrap() = %v, %v, want created %v", tt.name, created, err, tt.created)
+		}
+		if len(steps) != len(tt.steps) {
+			t.Errorf("%s: steps %v, want %v", tt.name, steps, tt.steps)
+			continue
+		}
+		for i := range steps {
+			if steps[i] != tt.steps[i] {
+				t.Errorf("%s: steps %v, want %v", tt.name, steps, tt.steps)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package balloon resizes running VMs' memory through the virtio balloon driver, handing
+// memory idle guests aren't using back to the host and returning it when they need it.
+package balloon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/sirupsen/logrus"
+)
+
+// Config controls when and by how much the controller resizes a VM.
+type Config struct {
+	// Interval is the time between balancing passes. It should be no shorter than the
+	// balloon stats period so each pass sees fresh stats.
+	Interval time.Duration
+	// IdleFree is the fraction of a VM's current memory that must be usable by the guest
+	// before it is shrunk.
+	IdleFree float64
+	// PressureFree is the fraction below which a VM is grown.
+	PressureFree float64
+	// Headroom is kept on top of a VM's working set when shrinking, as a fraction of it.
+	Headroom float64
+	// ShrinkStepMiB caps how much a VM is shrunk in a single pass.
+	ShrinkStepMiB uint64
+	// GrowStepMiB is how much a VM under pressure is grown in a single pass.
+	GrowStepMiB uint64
+	// MinChangeMiB skips adjustments smaller than this to avoid churning the balloon.
+	MinChangeMiB uint64
+	// DefaultMinMiB is the floor for VMs without a minimum of their own.
+	DefaultMinMiB uint64
+}
+
+// DefaultConfig shrinks idle VMs gradually and grows VMs under pressure quickly.
+func DefaultConfig() Config {
+	return Config{
+		Interval:      30 * time.Second,
+		IdleFree:      0.4,
+		PressureFree:  0.1,
+		Headroom:      0.25,
+		ShrinkStepMiB: 256,
+		GrowStepMiB:   512,
+		MinChangeMiB:  64,
+		DefaultMinMiB: 512,
+	}
+}
+
+// Controller balances memory across the VMs running on a host. VMs whose guests don't
+// run a balloon driver report no usable memory and are left alone.
+type Controller struct {
+	manager cloudkit.VMController
+	storage storage.Datastore
+	logger  *logrus.Logger
+	cfg     Config
+
+	// lastSwapIn holds each VM's previous swap-in counter. A guest that started swapping
+	// since the last pass is under pressure regardless of how much memory looks free.
+	mu         sync.Mutex
+	lastSwapIn map[string]uint64
+}
+
+// NewController creates a Controller. Call Run to start it.
+func NewController(ckm cloudkit.VMController, db storage.Datastore, cfg Config, log *logrus.Logger) *Controller {
+	return &Controller{
+		manager:    ckm,
+		storage:    db,
+		logger:     log,
+		cfg:        cfg,
+		lastSwapIn: make(map[string]uint64),
+	}
+}
+
+// Run balances memory every Interval until ctx is cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.runOnce(ctx)
+		}
+	}
+}
+
+// runOnce makes a single balancing pass over every running VM cloudkit manages.
+func (c *Controller) runOnce(ctx context.Context) {
+	domains, err := c.manager.GetRunningDomains(ctx)
+	if err != nil {
+		c.logger.Errorf("memory balancer failed to list running domains, err: %+v", err)
+		return
+	}
+
+	bounds, err := c.storage.GetVMMemoryBounds(ctx)
+	if err != nil {
+		c.logger.Errorf("memory balancer failed to load memory bounds, err: %+v", err)
+		return
+	}
+
+	seen := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		if ctx.Err() != nil {
+			return
+		}
+		b, managed := bounds[d.Name]
+		if !managed {
+			continue
+		}
+		seen[d.Name] = true
+		if err := c.balance(ctx, d, b); err != nil {
+			c.logger.Errorf("memory balancer failed on domain %s, err: %+v", d.Name, err)
+		}
+	}
+
+	c.mu.Lock()
+	for name := range c.lastSwapIn {
+		if !seen[name] {
+			delete(c.lastSwapIn, name)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// balance decides on and applies a new balloon size for one VM.
+func (c *Controller) balance(ctx context.Context, domain libvirt.Domain, b cloudkit.MemoryBounds) error {
+	rStats, err := c.manager.DomainMemoryStats(ctx, domain, cloudkit.MaxStats, 0)
+	if err != nil {
+		return err
+	}
+	ms, err := cloudkit.NewMemStats(rStats)
+	if err != nil {
+		return err
+	}
+	if !ms.Has(libvirt.DomainMemoryStatUsable) || !ms.Has(libvirt.DomainMemoryStatActualBalloon) || ms.Actual == 0 {
+		return nil
+	}
+
+	maxKiB, _, err := c.manager.DomainMemory(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	prevSwapIn, seen := c.lastSwapIn[domain.Name]
+	c.lastSwapIn[domain.Name] = ms.SwapIn
+	c.mu.Unlock()
+	swapping := seen && ms.SwapIn > prevSwapIn
+
+	lo, hi := c.limits(b, maxKiB)
+	current := ms.Actual
+	free := float64(ms.Usable) / float64(current)
+
+	var target uint64
+	var reason string
+	switch {
+	case swapping || free < c.cfg.PressureFree:
+		target, reason = current+mib(c.cfg.GrowStepMiB), "pressure"
+	case free > c.cfg.IdleFree:
+		workingSet := current - ms.Usable
+		target = uint64(float64(workingSet) * (1 + c.cfg.Headroom))
+		if floor := current - min(current, mib(c.cfg.ShrinkStepMiB)); target < floor {
+			target = floor
+		}
+		reason = "idle"
+	default:
+		return nil
+	}
+	target = clamp(target, lo, hi)
+
+	if diff(target, current) < mib(c.cfg.MinChangeMiB) {
+		return nil
+	}
+	if err := c.manager.SetDomainMemory(ctx, domain, target); err != nil {
+		return err
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"vm":          domain.Name,
+		"reason":      reason,
+		"from_mib":    current / 1024,
+		"to_mib":      target / 1024,
+		"usable_mib":  ms.Usable / 1024,
+		"swap_in_kib": ms.SwapIn,
+	}).Info("adjusted VM memory")
+
+	return nil
+}
+
+// limits returns the bounds a VM may be resized within, in KiB. A VM can never go above
+// the maximum memory it was defined with.
+func (c *Controller) limits(b cloudkit.MemoryBounds, maxKiB uint64) (lo, hi uint64) {
+	lo, hi = mib(c.cfg.DefaultMinMiB), maxKiB
+	if b.MinMiB > 0 {
+		lo = mib(uint64(b.MinMiB))
+	}
+	if b.MaxMiB > 0 && mib(uint64(b.MaxMiB)) < hi {
+		hi = mib(uint64(b.MaxMiB))
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return lo, hi
+}
+
+func mib(n uint64) uint64 { return n * 1024 }
+
+func clamp(v, lo, hi uint64) uint64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func diff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
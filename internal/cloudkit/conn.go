@@ -0,0 +1,204 @@
+package cloudkit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrDisconnected is returned by VMManager calls made while libvirt is unreachable, and
+// by calls in flight when the connection drops.
+var ErrDisconnected = apperr.New(apperr.Unavailable, "libvirt is unavailable, try again shortly")
+
+const (
+	// connectTimeout bounds dialing libvirt and opening the connection.
+	connectTimeout = 10 * time.Second
+
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// ConnectionStatus describes a VMManager's connection to libvirt.
+type ConnectionStatus struct {
+	Connected bool   `json:"connected"`
+	Address   string `json:"address"`
+	// Since is when the connection was last made or lost.
+	Since time.Time `json:"since"`
+	// LastError is why the connection was lost or why reconnecting last failed.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// connection is a single libvirt connection. It wraps the socket so that as soon as a
+// read fails, or close is called, it closes the socket and lost, recording why, which
+// calls in flight and event streams select on.
+type connection struct {
+	net.Conn
+	libvirt *libvirt.Libvirt
+
+	once sync.Once
+	err  error
+	lost chan struct{}
+}
+
+func (c *connection) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.close(err)
+	}
+	return n, err
+}
+
+// close drops the connection for reason err. Only the first call has any effect. Calls
+// still waiting on libvirt are released by go-libvirt's Disconnect, which is otherwise the
+// only way to get them to return, so that no goroutine waits on a dead connection.
+func (c *connection) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		c.Conn.Close()
+		close(c.lost)
+		// Disconnect fails once it tries to tell libvirt, which is fine: by then it has
+		// released every waiting call.
+		go c.libvirt.Disconnect()
+	})
+}
+
+// connect opens a connection to libvirt through dial, giving up when ctx is done.
+func connect(ctx context.Context, dial dialFunc) (*connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	nc, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := &connection{Conn: nc, lost: make(chan struct{})}
+	conn.libvirt = libvirt.New(conn)
+
+	done := make(chan error, 1)
+	go func() { done <- conn.libvirt.Connect() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			conn.close(err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		conn.close(ctx.Err())
+		return nil, ctx.Err()
+	}
+
+	return conn, nil
+}
+
+// connection returns the current libvirt connection, or nil while disconnected.
+func (v *VMManager) connection() *connection {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.conn
+}
+
+// setConnection records that conn is now the connection to libvirt, or, if conn is nil,
+// that there's no connection because of err.
+func (v *VMManager) setConnection(conn *connection, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if conn != nil {
+		v.conn = conn
+		close(v.ready)
+		v.status = ConnectionStatus{Connected: true, Address: v.address, Since: time.Now()}
+		return
+	}
+
+	if v.conn != nil {
+		v.conn = nil
+		v.ready = make(chan struct{})
+		v.status.Connected = false
+		v.status.Since = time.Now()
+	}
+	if err != nil {
+		v.status.LastError = err.Error()
+	}
+}
+
+// Connection reports whether libvirt is currently reachable.
+func (v *VMManager) Connection() ConnectionStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.status
+}
+
+// WaitConnected blocks until libvirt is reachable or ctx is done.
+func (v *VMManager) WaitConnected(ctx context.Context) error {
+	v.mu.Lock()
+	ready := v.ready
+	v.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run keeps the connection to libvirt alive until ctx is cancelled. Every keepalive
+// interval it pings libvirt, dropping the connection if there's no timely answer, and
+// once the connection is lost it reconnects, backing off up to maxReconnectDelay.
+// Lifecycle event streams close when the connection is lost; subscribe again with
+// LifecycleEvents once WaitConnected returns.
+func (v *VMManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(v.keepalive)
+	defer ticker.Stop()
+
+	delay := minReconnectDelay
+	for {
+		conn := v.connection()
+		if conn == nil {
+			conn, err := connect(ctx, v.dial)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				v.setConnection(nil, err)
+				v.logger.Errorf("failed to reconnect to libvirt at %s, retrying in %s, err: %+v", v.address, delay, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				if delay *= 2; delay > maxReconnectDelay {
+					delay = maxReconnectDelay
+				}
+				continue
+			}
+			delay = minReconnectDelay
+			v.setConnection(conn, nil)
+			v.logger.Infof("reconnected to libvirt at %s", v.address)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.lost:
+			v.setConnection(nil, conn.err)
+			v.logger.Errorf("lost connection to libvirt at %s, err: %+v", v.address, conn.err)
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, v.keepalive)
+			err := v.callOn(pingCtx, conn, "ConnectGetLibVersion", func(l *libvirt.Libvirt) error {
+				_, err := l.ConnectGetLibVersion()
+				return err
+			})
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				conn.close(fmt.Errorf("keepalive: %w", err))
+			}
+		}
+	}
+}
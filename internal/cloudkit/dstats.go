@@ -0,0 +1,195 @@
+package cloudkit
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainStatsTypes are the groups of bulk stats we ask libvirt for on every monitor pass.
+const DomainStatsTypes = libvirt.DomainStatsState | libvirt.DomainStatsCPUTotal |
+	libvirt.DomainStatsVCPU | libvirt.DomainStatsInterface | libvirt.DomainStatsBlock
+
+// DomainStats is a point in time sample of the cumulative counters libvirt keeps for a
+// domain. The counters only ever go up, so on their own they aren't very useful; compare
+// two samples with Usage to turn them into rates.
+type DomainStats struct {
+	DomainID   int
+	Name       string
+	Time       time.Time
+	State      string
+	CPUTime    uint64 // nanoseconds across all vCPUs
+	VCPUs      uint64
+	Disks      []DiskStats
+	Interfaces []InterfaceStats
+}
+
+// DiskStats holds the cumulative counters for a single block device.
+type DiskStats struct {
+	Name    string
+	RdReqs  uint64
+	RdBytes uint64
+	WrReqs  uint64
+	WrBytes uint64
+}
+
+// InterfaceStats holds the cumulative counters for a single network interface.
+type InterfaceStats struct {
+	Name      string
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// NewDomainStats unmarshals the flat list of typed params that libvirt returns from
+// ConnectGetAllDomainStats. Fields look like "cpu.time", "block.0.name", "net.1.rx.bytes".
+func NewDomainStats(rec libvirt.DomainStatsRecord, t time.Time) DomainStats {
+	ds := DomainStats{DomainID: int(rec.Dom.ID), Name: rec.Dom.Name, Time: t}
+
+	disks := map[int]*DiskStats{}
+	ifaces := map[int]*InterfaceStats{}
+
+	for _, p := range rec.Params {
+		parts := strings.SplitN(p.Field, ".", 3)
+		switch {
+		case p.Field == "state.state":
+			ds.State = domainState(int32(typedParamUint(p.Value)))
+		case p.Field == "cpu.time":
+			ds.CPUTime = typedParamUint(p.Value)
+		case p.Field == "vcpu.current":
+			ds.VCPUs = typedParamUint(p.Value)
+		case len(parts) == 3 && parts[0] == "block":
+			i, err := strconv.Atoi(parts[1])
+			if err != nil {
+				continue
+			}
+			d, ok := disks[i]
+			if !ok {
+				d = &DiskStats{}
+				disks[i] = d
+			}
+			switch parts[2] {
+			case "name":
+				d.Name, _ = p.Value.I.(string)
+			case "rd.reqs":
+				d.RdReqs = typedParamUint(p.Value)
+			case "rd.bytes":
+				d.RdBytes = typedParamUint(p.Value)
+			case "wr.reqs":
+				d.WrReqs = typedParamUint(p.Value)
+			case "wr.bytes":
+				d.WrBytes = typedParamUint(p.Value)
+			}
+		case len(parts) == 3 && parts[0] == "net":
+			i, err := strconv.Atoi(parts[1])
+			if err != nil {
+				continue
+			}
+			n, ok := ifaces[i]
+			if !ok {
+				n = &InterfaceStats{}
+				ifaces[i] = n
+			}
+			switch parts[2] {
+			case "name":
+				n.Name, _ = p.Value.I.(string)
+			case "rx.bytes":
+				n.RxBytes = typedParamUint(p.Value)
+			case "rx.pkts":
+				n.RxPackets = typedParamUint(p.Value)
+			case "tx.bytes":
+				n.TxBytes = typedParamUint(p.Value)
+			case "tx.pkts":
+				n.TxPackets = typedParamUint(p.Value)
+			}
+		}
+	}
+
+	for i := 0; i < len(disks); i++ {
+		if d, ok := disks[i]; ok {
+			ds.Disks = append(ds.Disks, *d)
+		}
+	}
+	for i := 0; i < len(ifaces); i++ {
+		if n, ok := ifaces[i]; ok {
+			ds.Interfaces = append(ds.Interfaces, *n)
+		}
+	}
+
+	return ds
+}
+
+// Usage turns two samples of the same domain into per second rates. It returns false
+// when the samples can't be compared, for example when the domain restarted in between
+// and its counters were reset.
+func (ds DomainStats) Usage(prev DomainStats) (VMUsage, bool) {
+	elapsed := ds.Time.Sub(prev.Time).Seconds()
+	if elapsed <= 0 || ds.CPUTime < prev.CPUTime {
+		return VMUsage{}, false
+	}
+
+	ts := ds.Time.Format(time.RFC3339)
+	u := VMUsage{CPU: CPUUsage{Time: ts}}
+
+	if ds.VCPUs > 0 {
+		cpuSecs := float64(ds.CPUTime-prev.CPUTime) / float64(time.Second)
+		u.CPU.Usage = cpuSecs / (elapsed * float64(ds.VCPUs)) * 100
+	}
+
+	for _, d := range ds.Disks {
+		for _, p := range prev.Disks {
+			if d.Name != p.Name || d.RdBytes < p.RdBytes || d.WrBytes < p.WrBytes ||
+				d.RdReqs < p.RdReqs || d.WrReqs < p.WrReqs {
+				continue
+			}
+			u.Disks = append(u.Disks, DiskUsage{
+				Time:         ts,
+				Device:       d.Name,
+				ReadBytesPS:  float64(d.RdBytes-p.RdBytes) / elapsed,
+				WriteBytesPS: float64(d.WrBytes-p.WrBytes) / elapsed,
+				ReadIOPS:     float64(d.RdReqs-p.RdReqs) / elapsed,
+				WriteIOPS:    float64(d.WrReqs-p.WrReqs) / elapsed,
+			})
+		}
+	}
+
+	for _, n := range ds.Interfaces {
+		for _, p := range prev.Interfaces {
+			if n.Name != p.Name || n.RxBytes < p.RxBytes || n.TxBytes < p.TxBytes ||
+				n.RxPackets < p.RxPackets || n.TxPackets < p.TxPackets {
+				continue
+			}
+			u.Interfaces = append(u.Interfaces, NetUsage{
+				Time:        ts,
+				Interface:   n.Name,
+				RxBytesPS:   float64(n.RxBytes-p.RxBytes) / elapsed,
+				TxBytesPS:   float64(n.TxBytes-p.TxBytes) / elapsed,
+				RxPacketsPS: float64(n.RxPackets-p.RxPackets) / elapsed,
+				TxPacketsPS: float64(n.TxPackets-p.TxPackets) / elapsed,
+			})
+		}
+	}
+
+	return u, true
+}
+
+// typedParamUint normalizes the handful of integer types libvirt uses for counters.
+func typedParamUint(v libvirt.TypedParamValue) uint64 {
+	switch i := v.I.(type) {
+	case int32:
+		return uint64(i)
+	case uint32:
+		return uint64(i)
+	case int64:
+		return uint64(i)
+	case uint64:
+		return i
+	case float64:
+		return uint64(i)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,190 @@
+package cloudkit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Event types emitted for VMs.
+const (
+	EventVMCreated     = "vm.created"
+	EventVMDefined     = "vm.defined"
+	EventVMDeleted     = "vm.deleted"
+	EventVMImported    = "vm.imported"
+	EventVMStarted     = "vm.started"
+	EventVMSuspended   = "vm.suspended"
+	EventVMResumed     = "vm.resumed"
+	EventVMShutdown    = "vm.shutdown"
+	EventVMStopped     = "vm.stopped"
+	EventVMPMSuspended = "vm.pmsuspended"
+	EventVMCrashed     = "vm.crashed"
+	EventVMRebooted    = "vm.rebooted"
+
+	// Emitted by the reconciler rather than libvirt.
+	EventVMLost       = "vm.lost"
+	EventVMReconciled = "vm.reconciled"
+	EventVMUnmanaged  = "vm.unmanaged"
+)
+
+// StateLost is the state of a VM cloudkit manages whose domain libvirt no longer has.
+const StateLost = "lost"
+
+// VMEvent is a change to a VM as understood by cloudkit.
+type VMEvent struct {
+	Type     string    `json:"type"`
+	VMName   string    `json:"vm_name"`
+	DomainID int       `json:"domain_id,omitempty"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventBuffer is how many VMEvents a LifecycleEvents subscriber can fall behind by
+// before further events are dropped.
+const eventBuffer = 256
+
+// LifecycleEvents subscribes to libvirt's domain lifecycle and reboot events and
+// translates them into VMEvents. The channel is closed when the libvirt connection is
+// lost, at which point callers should subscribe again once reconnected, or once ctx is
+// done. Events never wait for the caller: once eventBuffer of them are waiting to be
+// read, the rest are dropped and counted until it catches up.
+func (v *VMManager) LifecycleEvents(ctx context.Context) (<-chan VMEvent, error) {
+	conn := v.connection()
+	if conn == nil {
+		return nil, ErrDisconnected
+	}
+
+	// go-libvirt deregisters each stream with libvirt once subCtx is cancelled.
+	subCtx, cancel := context.WithCancel(context.Background())
+	var streams []<-chan interface{}
+	for _, id := range []libvirt.DomainEventID{libvirt.DomainEventIDLifecycle, libvirt.DomainEventIDReboot} {
+		id := id
+		var stream <-chan interface{}
+		err := v.callOn(ctx, conn, "ConnectDomainEventCallbackRegisterAny", func(l *libvirt.Libvirt) (err error) {
+			stream, err = l.SubscribeEvents(subCtx, id, nil)
+			return err
+		})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+
+	events := make(chan VMEvent, eventBuffer)
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream <-chan interface{}) {
+			defer wg.Done()
+			v.forwardEvents(stream, events)
+		}(stream)
+	}
+	go func() {
+		select {
+		case <-conn.lost:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	go func() {
+		wg.Wait()
+		cancel()
+		close(events)
+	}()
+
+	return events, nil
+}
+
+// forwardEvents translates the events from one of go-libvirt's streams onto events until
+// the stream is closed, dropping those events has no room for.
+func (v *VMManager) forwardEvents(stream <-chan interface{}, events chan<- VMEvent) {
+	for raw := range stream {
+		ev, ok := toVMEvent(raw, time.Now())
+		if !ok {
+			continue
+		}
+		select {
+		case events <- ev:
+		default:
+			if v.observer != nil {
+				v.observer.ObserveDroppedEvent(ev.Type)
+			}
+		}
+	}
+}
+
+// toVMEvent translates an event from one of go-libvirt's streams. ok is false for events
+// of any other kind.
+func toVMEvent(raw interface{}, t time.Time) (ev VMEvent, ok bool) {
+	switch msg := raw.(type) {
+	case *libvirt.DomainEventCallbackLifecycleMsg:
+		return newVMEvent(msg.Msg, t), true
+	case *libvirt.DomainEventCallbackRebootMsg:
+		return newRebootEvent(msg.Msg.Dom, t), true
+	}
+	return VMEvent{}, false
+}
+
+// newVMEvent maps a libvirt lifecycle event and its detail code onto a VMEvent. The
+// state is the one the domain is in once the event has happened.
+func newVMEvent(msg libvirt.DomainEventLifecycleMsg, t time.Time) VMEvent {
+	ev := VMEvent{VMName: msg.Dom.Name, DomainID: int(msg.Dom.ID), Time: t}
+
+	switch libvirt.DomainEventType(msg.Event) {
+	case libvirt.DomainEventDefined:
+		ev.Type, ev.State = EventVMDefined, "off"
+		ev.Reason = detailName(msg.Detail, "added", "updated", "renamed", "from snapshot")
+	case libvirt.DomainEventUndefined:
+		ev.Type, ev.State = EventVMDeleted, "deleted"
+		ev.Reason = detailName(msg.Detail, "removed", "renamed")
+	case libvirt.DomainEventStarted:
+		ev.Type, ev.State = EventVMStarted, "running"
+		ev.Reason = detailName(msg.Detail, "booted", "migrated", "restored", "from snapshot", "wakeup")
+	case libvirt.DomainEventSuspended:
+		ev.Type, ev.State = EventVMSuspended, "paused"
+		ev.Reason = detailName(msg.Detail, "paused", "migrated", "io error", "watchdog", "restored",
+			"from snapshot", "api error", "postcopy", "postcopy failed")
+	case libvirt.DomainEventResumed:
+		ev.Type, ev.State = EventVMResumed, "running"
+		ev.Reason = detailName(msg.Detail, "unpaused", "migrated", "from snapshot", "postcopy")
+	case libvirt.DomainEventStopped:
+		ev.Type, ev.State = EventVMStopped, "off"
+		ev.Reason = detailName(msg.Detail, "shutdown", "destroyed", "crashed", "migrated", "saved",
+			"failed", "from snapshot")
+		if libvirt.DomainEventStoppedDetailType(msg.Detail) == libvirt.DomainEventStoppedCrashed {
+			ev.Type, ev.State = EventVMCrashed, "crashed"
+		}
+	case libvirt.DomainEventShutdown:
+		ev.Type, ev.State = EventVMShutdown, "shutting down"
+		ev.Reason = detailName(msg.Detail, "finished", "guest", "host")
+	case libvirt.DomainEventPmsuspended:
+		ev.Type, ev.State = EventVMPMSuspended, "pm suspended"
+		ev.Reason = detailName(msg.Detail, "memory", "disk")
+	case libvirt.DomainEventCrashed:
+		ev.Type, ev.State = EventVMCrashed, "crashed"
+		ev.Reason = detailName(msg.Detail, "panicked")
+	default:
+		ev.Type, ev.State = "vm.unknown", "unknown"
+	}
+
+	return ev
+}
+
+// newRebootEvent is the VMEvent for a guest reset, which libvirt reports separately from
+// lifecycle events since the domain keeps running throughout.
+func newRebootEvent(dom libvirt.Domain, t time.Time) VMEvent {
+	return VMEvent{Type: EventVMRebooted, VMName: dom.Name, DomainID: int(dom.ID), State: "running", Time: t}
+}
+
+// detailName picks the human readable name for a libvirt event detail code. names must be
+// in the same order as libvirt's enum for that event type.
+func detailName(detail int32, names ...string) string {
+	if detail < 0 || int(detail) >= len(names) {
+		return "unknown"
+	}
+	return names[detail]
+}
@@ -0,0 +1,85 @@
+package cloudkit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestToVMEvent(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		raw  interface{}
+		want VMEvent
+		ok   bool
+	}{
+		{
+			name: "stopped",
+			raw: &libvirt.DomainEventCallbackLifecycleMsg{CallbackID: 1, Msg: libvirt.DomainEventLifecycleMsg{
+				Dom:    libvirt.Domain{Name: "ck-db1", ID: 5},
+				Event:  int32(libvirt.DomainEventStopped),
+				Detail: int32(libvirt.DomainEventStoppedDestroyed),
+			}},
+			want: VMEvent{Type: EventVMStopped, VMName: "ck-db1", DomainID: 5, State: "off", Reason: "destroyed", Time: now},
+			ok:   true,
+		},
+		{
+			name: "crashed",
+			raw: &libvirt.DomainEventCallbackLifecycleMsg{CallbackID: 1, Msg: libvirt.DomainEventLifecycleMsg{
+				Dom:    libvirt.Domain{Name: "ck-db1", ID: 5},
+				Event:  int32(libvirt.DomainEventStopped),
+				Detail: int32(libvirt.DomainEventStoppedCrashed),
+			}},
+			want: VMEvent{Type: EventVMCrashed, VMName: "ck-db1", DomainID: 5, State: "crashed", Reason: "crashed", Time: now},
+			ok:   true,
+		},
+		{
+			name: "rebooted",
+			raw: &libvirt.DomainEventCallbackRebootMsg{CallbackID: 2, Msg: libvirt.DomainEventRebootMsg{
+				Dom: libvirt.Domain{Name: "ck-web", ID: 4},
+			}},
+			want: VMEvent{Type: EventVMRebooted, VMName: "ck-web", DomainID: 4, State: "running", Time: now},
+			ok:   true,
+		},
+		{
+			name: "other",
+			raw:  &libvirt.DomainEventCallbackBalloonChangeMsg{CallbackID: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := toVMEvent(tt.raw, now)
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Errorf("toVMEvent() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// droppedEvents counts the events a VMManager reports dropping.
+type droppedEvents map[string]int
+
+func (d droppedEvents) ObserveLibvirtCall(string, time.Duration, error) {}
+
+func (d droppedEvents) ObserveDroppedEvent(eventType string) { d[eventType]++ }
+
+func TestForwardEventsDropsWhenFull(t *testing.T) {
+	dropped := droppedEvents{}
+	v := &VMManager{observer: dropped}
+
+	stream := make(chan interface{}, 3)
+	for i := 0; i < 3; i++ {
+		stream <- &libvirt.DomainEventCallbackRebootMsg{Msg: libvirt.DomainEventRebootMsg{Dom: libvirt.Domain{Name: "ck-web"}}}
+	}
+	close(stream)
+
+	// Nobody reads events, so only the first fits and forwardEvents must still return.
+	events := make(chan VMEvent, 1)
+	v.forwardEvents(stream, events)
+
+	if len(events) != 1 || dropped[EventVMRebooted] != 2 {
+		t.Errorf("forwarded %d events and dropped %v, want 1 forwarded and 2 reboots dropped", len(events), dropped)
+	}
+}
@@ -6,49 +6,142 @@ import (
 	"github.com/digitalocean/go-libvirt"
 )
 
+// The go-libvirt constants stop at disk_caches. Newer libvirt versions also report
+// hugetlb stats, so we name those ourselves.
+const (
+	DomainMemoryStatHugetlbPgalloc libvirt.DomainMemoryStatTags = 11
+	DomainMemoryStatHugetlbPgfail  libvirt.DomainMemoryStatTags = 12
+)
+
+// ErrNoMemStats is returned when libvirt hands back no memory statistics at all for a
+// domain, which usually means the domain isn't running.
+var ErrNoMemStats = errors.New("no memory statistics reported for domain")
+
 // MemStats is a human readable version of the []libvirt.DomainMemoryStat that comes
-// back from libvirt's DomainMemoryStats func.
+// back from libvirt's DomainMemoryStats func. Values are in KiB apart from the fault
+// counters and LastUpdate (seconds since the epoch). Which fields are populated depends
+// on the guest; use Has to tell a zero value from a stat that was never reported.
 type MemStats struct {
-	Actual     uint64
-	SwapIn     uint64
-	SwapOut    uint64
-	MajorFault uint64
-	MinorFault uint64
-	Unused     uint64
-	Available  uint64
-	Usable     uint64
-	LastUpdate uint64
-	Rss        uint64
+	Actual         uint64
+	SwapIn         uint64
+	SwapOut        uint64
+	MajorFault     uint64
+	MinorFault     uint64
+	Unused         uint64
+	Available      uint64
+	Usable         uint64
+	LastUpdate     uint64
+	Rss            uint64
+	DiskCaches     uint64
+	HugetlbPgalloc uint64
+	HugetlbPgfail  uint64
+
+	// Unknown holds any tags newer than this version of cloudkit understands, keyed by tag.
+	Unknown map[int32]uint64
+
+	reported uint64
 }
 
-// NewMemStats is a custom unmarshaller for the array of array of numbers we get
-// when asking libvirt for memory statistics on a domain
+// NewMemStats is a custom unmarshaller for the array of tagged values we get when asking
+// libvirt for memory statistics on a domain. Stats are matched by their tag, so order
+// doesn't matter and guests that only report a few of them (e.g. no balloon driver, which
+// leaves just actual and rss) are handled fine.
 func NewMemStats(data []libvirt.DomainMemoryStat) (MemStats, error) {
-	if len(data) != 10 {
-		return MemStats{}, errors.New("debug MemStats")
+	if len(data) == 0 {
+		return MemStats{}, ErrNoMemStats
+	}
+
+	var ms MemStats
+	for _, stat := range data {
+		tag := libvirt.DomainMemoryStatTags(stat.Tag)
+
+		var field *uint64
+		switch tag {
+		case libvirt.DomainMemoryStatSwapIn:
+			field = &ms.SwapIn
+		case libvirt.DomainMemoryStatSwapOut:
+			field = &ms.SwapOut
+		case libvirt.DomainMemoryStatMajorFault:
+			field = &ms.MajorFault
+		case libvirt.DomainMemoryStatMinorFault:
+			field = &ms.MinorFault
+		case libvirt.DomainMemoryStatUnused:
+			field = &ms.Unused
+		case libvirt.DomainMemoryStatAvailable:
+			field = &ms.Available
+		case libvirt.DomainMemoryStatActualBalloon:
+			field = &ms.Actual
+		case libvirt.DomainMemoryStatRss:
+			field = &ms.Rss
+		case libvirt.DomainMemoryStatUsable:
+			field = &ms.Usable
+		case libvirt.DomainMemoryStatLastUpdate:
+			field = &ms.LastUpdate
+		case libvirt.DomainMemoryStatDiskCaches:
+			field = &ms.DiskCaches
+		case DomainMemoryStatHugetlbPgalloc:
+			field = &ms.HugetlbPgalloc
+		case DomainMemoryStatHugetlbPgfail:
+			field = &ms.HugetlbPgfail
+		default:
+			if ms.Unknown == nil {
+				ms.Unknown = make(map[int32]uint64)
+			}
+			ms.Unknown[stat.Tag] = stat.Val
+			continue
+		}
+
+		*field = stat.Val
+		ms.reported |= 1 << uint(tag)
+	}
+
+	return ms, nil
+}
+
+// Has reports whether the guest sent a value for tag.
+func (ms MemStats) Has(tag libvirt.DomainMemoryStatTags) bool {
+	return tag >= 0 && tag < 64 && ms.reported&(1<<uint(tag)) != 0
+}
+
+// Usage returns the percentage of guest memory in use, computed from whichever stats the
+// guest reported. In order of preference:
+//
+//   - available and usable: what the guest itself considers usable (needs a balloon driver)
+//   - available and unused: treats disk caches, when reported, as reclaimable
+//   - actual and rss: the host's view, how much of the balloon QEMU has actually touched
+//
+// ok is false when none of those pairs are present.
+func (ms MemStats) Usage() (usage float64, ok bool) {
+	switch {
+	case ms.Has(libvirt.DomainMemoryStatAvailable) && ms.Has(libvirt.DomainMemoryStatUsable) && ms.Available > 0:
+		return percentUsed(ms.Available, ms.Usable), true
+	case ms.Has(libvirt.DomainMemoryStatAvailable) && ms.Has(libvirt.DomainMemoryStatUnused) && ms.Available > 0:
+		free := ms.Unused
+		if ms.Has(libvirt.DomainMemoryStatDiskCaches) {
+			free += ms.DiskCaches
+		}
+		return percentUsed(ms.Available, free), true
+	case ms.Has(libvirt.DomainMemoryStatActualBalloon) && ms.Has(libvirt.DomainMemoryStatRss) && ms.Actual > 0:
+		rss := ms.Rss
+		if rss > ms.Actual {
+			rss = ms.Actual
+		}
+		return float64(rss) / float64(ms.Actual) * 100, true
+	default:
+		return 0, false
+	}
+}
+
+func percentUsed(total, free uint64) float64 {
+	if free > total {
+		return 0
 	}
-	return MemStats{
-		Actual:     data[0].Val,
-		SwapIn:     data[1].Val,
-		SwapOut:    data[2].Val,
-		MajorFault: data[3].Val,
-		MinorFault: data[4].Val,
-		Unused:     data[5].Val,
-		Available:  data[6].Val,
-		Usable:     data[7].Val,
-		LastUpdate: data[8].Val,
-		Rss:        data[9].Val,
-	}, nil
+	return float64(total-free) / float64(total) * 100
 }
 
-// rStats come back as a []libvirt.DomainMemoryStat... They all have a "Tag" field as
-// well as their associated Val. I can't for the life of me find anywhere that talks
-// about what the tag means. I initially imagined the data could maybe come back in
-// any order or something, but I could not prove that once ever (out of hundreds).
-// I ended up figuring out which values meant what by comparing them to the output
-// of `virsh dommemstat {domain}`... Thanksfully they were in the same order from
-// top to bottom and I labeled them below. I'll come back to this. I'm sure I'll
-// have to as soon as I add different machines, as I could see this varying.
+// A sample recorded from an ubuntu 18.04 guest with the virtio balloon driver, matching
+// `virsh dommemstat {domain}`. Tags are libvirt's VIR_DOMAIN_MEMORY_STAT_* values, and
+// libvirt makes no promise about the order they come back in.
 
 // rStats: [
 // 	{
@@ -80,6 +173,6 @@ func NewMemStats(data []libvirt.DomainMemoryStat) (MemStats, error) {
 // 		Val: 1605988199 // last_update
 // 	},{
 // 		Tag: 7
-// 		Val: 457240 // rssx`
+// 		Val: 457240 // rss
 // 	}
 // ]
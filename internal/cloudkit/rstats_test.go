@@ -0,0 +1,204 @@
+package cloudkit
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// recordedStats is `virsh dommemstat` from an ubuntu 18.04 guest with the virtio balloon
+// driver, in the order libvirt returned it:
+//
+//	actual 2097152
+//	swap_in 0
+//	swap_out 0
+//	major_fault 922
+//	minor_fault 314341
+//	unused 1787532
+//	available 2041024
+//	usable 1830488
+//	last_update 1605988199
+//	rss 457240
+var recordedStats = []libvirt.DomainMemoryStat{
+	{Tag: 6, Val: 2097152},
+	{Tag: 0, Val: 0},
+	{Tag: 1, Val: 0},
+	{Tag: 2, Val: 922},
+	{Tag: 3, Val: 314341},
+	{Tag: 4, Val: 1787532},
+	{Tag: 5, Val: 2041024},
+	{Tag: 8, Val: 1830488},
+	{Tag: 9, Val: 1605988199},
+	{Tag: 7, Val: 457240},
+}
+
+var recordedMemStats = MemStats{
+	Actual:     2097152,
+	MajorFault: 922,
+	MinorFault: 314341,
+	Unused:     1787532,
+	Available:  2041024,
+	Usable:     1830488,
+	LastUpdate: 1605988199,
+	Rss:        457240,
+}
+
+func TestNewMemStats(t *testing.T) {
+	shuffled := []libvirt.DomainMemoryStat{
+		recordedStats[9], recordedStats[4], recordedStats[0], recordedStats[7], recordedStats[2],
+		recordedStats[5], recordedStats[1], recordedStats[8], recordedStats[3], recordedStats[6],
+	}
+
+	tests := []struct {
+		name    string
+		data    []libvirt.DomainMemoryStat
+		want    MemStats
+		has     []libvirt.DomainMemoryStatTags
+		missing []libvirt.DomainMemoryStatTags
+	}{
+		{
+			name: "balloon driver",
+			data: recordedStats,
+			want: recordedMemStats,
+			has: []libvirt.DomainMemoryStatTags{
+				libvirt.DomainMemoryStatSwapIn, libvirt.DomainMemoryStatActualBalloon,
+				libvirt.DomainMemoryStatUsable, libvirt.DomainMemoryStatRss,
+			},
+			missing: []libvirt.DomainMemoryStatTags{libvirt.DomainMemoryStatDiskCaches},
+		},
+		{
+			name: "shuffled",
+			data: shuffled,
+			want: recordedMemStats,
+		},
+		{
+			// virsh dommemstat on a guest without the balloon driver:
+			//	actual 1048576
+			//	rss 301244
+			name:    "no balloon driver",
+			data:    []libvirt.DomainMemoryStat{{Tag: 6, Val: 1048576}, {Tag: 7, Val: 301244}},
+			want:    MemStats{Actual: 1048576, Rss: 301244},
+			has:     []libvirt.DomainMemoryStatTags{libvirt.DomainMemoryStatActualBalloon, libvirt.DomainMemoryStatRss},
+			missing: []libvirt.DomainMemoryStatTags{libvirt.DomainMemoryStatSwapIn, libvirt.DomainMemoryStatAvailable},
+		},
+		{
+			// libvirt 6.x adds disk_caches and hugetlb_pgalloc/pgfail, then a tag from the
+			// future.
+			name: "newer and unknown tags",
+			data: []libvirt.DomainMemoryStat{
+				{Tag: 10, Val: 1024}, {Tag: 11, Val: 3}, {Tag: 12, Val: 1}, {Tag: 42, Val: 7},
+			},
+			want: MemStats{DiskCaches: 1024, HugetlbPgalloc: 3, HugetlbPgfail: 1, Unknown: map[int32]uint64{42: 7}},
+			has:  []libvirt.DomainMemoryStatTags{libvirt.DomainMemoryStatDiskCaches, DomainMemoryStatHugetlbPgalloc, DomainMemoryStatHugetlbPgfail},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMemStats(tt.data)
+			if err != nil {
+				t.Fatalf("NewMemStats: %v", err)
+			}
+			for _, tag := range tt.has {
+				if !got.Has(tag) {
+					t.Errorf("Has(%d) = false, want true", tag)
+				}
+			}
+			for _, tag := range tt.missing {
+				if got.Has(tag) {
+					t.Errorf("Has(%d) = true, want false", tag)
+				}
+			}
+			got.reported = 0
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewMemStats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMemStatsEmpty(t *testing.T) {
+	if _, err := NewMemStats(nil); !errors.Is(err, ErrNoMemStats) {
+		t.Fatalf("NewMemStats(nil) err = %v, want ErrNoMemStats", err)
+	}
+}
+
+func TestMemStatsUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []libvirt.DomainMemoryStat
+		want   float64
+		wantOK bool
+	}{
+		{
+			name:   "available and usable",
+			data:   recordedStats,
+			want:   (2041024.0 - 1830488.0) / 2041024.0 * 100,
+			wantOK: true,
+		},
+		{
+			name: "available and unused",
+			data: []libvirt.DomainMemoryStat{
+				{Tag: 5, Val: 2041024}, {Tag: 4, Val: 1787532},
+			},
+			want:   (2041024.0 - 1787532.0) / 2041024.0 * 100,
+			wantOK: true,
+		},
+		{
+			name: "disk caches count as free",
+			data: []libvirt.DomainMemoryStat{
+				{Tag: 5, Val: 2041024}, {Tag: 4, Val: 1000000}, {Tag: 10, Val: 500000},
+			},
+			want:   (2041024.0 - 1500000.0) / 2041024.0 * 100,
+			wantOK: true,
+		},
+		{
+			name: "hugetlb stats don't change the fallback",
+			data: []libvirt.DomainMemoryStat{
+				{Tag: 5, Val: 2041024}, {Tag: 4, Val: 1000000}, {Tag: 11, Val: 50}, {Tag: 12, Val: 2},
+			},
+			want:   (2041024.0 - 1000000.0) / 2041024.0 * 100,
+			wantOK: true,
+		},
+		{
+			name:   "actual and rss",
+			data:   []libvirt.DomainMemoryStat{{Tag: 6, Val: 1048576}, {Tag: 7, Val: 301244}},
+			want:   301244.0 / 1048576.0 * 100,
+			wantOK: true,
+		},
+		{
+			name:   "rss over actual",
+			data:   []libvirt.DomainMemoryStat{{Tag: 6, Val: 1048576}, {Tag: 7, Val: 1100000}},
+			want:   100,
+			wantOK: true,
+		},
+		{
+			name: "free over available",
+			data: []libvirt.DomainMemoryStat{
+				{Tag: 5, Val: 1000}, {Tag: 4, Val: 900}, {Tag: 10, Val: 200},
+			},
+			want:   0,
+			wantOK: true,
+		},
+		{
+			name: "nothing to compute from",
+			data: []libvirt.DomainMemoryStat{{Tag: 2, Val: 922}, {Tag: 42, Val: 7}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, err := NewMemStats(tt.data)
+			if err != nil {
+				t.Fatalf("NewMemStats: %v", err)
+			}
+			got, ok := ms.Usage()
+			if ok != tt.wantOK || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Usage() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
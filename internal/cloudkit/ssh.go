@@ -0,0 +1,63 @@
+package cloudkit
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialSSH logs in to addr over SSH, giving up when ctx is done. The ssh package flattens
+// a rejected host key into a generic handshake error, so the host key callback's own
+// error is returned instead, letting callers tell a mismatch apart.
+func dialSSH(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake ignores ctx, so close the connection to interrupt it.
+	defer closeOnDone(ctx, c)()
+
+	var keyErr error
+	checked := *cfg
+	checked.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		keyErr = cfg.HostKeyCallback(hostname, remote, key)
+		return keyErr
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(c, addr, &checked)
+	if err != nil {
+		c.Close()
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		return nil, ctxErr(ctx, err)
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// closeOnDone closes c as soon as ctx is done, since closing is the only way to interrupt
+// most blocking network operations, until the returned stop is called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctxErr prefers ctx's error over err, which is usually just a closed connection when
+// ctx was the reason an operation failed.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package cloudkit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// dialFunc opens a socket to libvirtd.
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// newDialer returns how to reach the libvirtd e describes. Credentials are loaded up
+// front so mistakes in them show at startup rather than on the first reconnect.
+func newDialer(e config.LibvirtEndpoint, lv config.Libvirt, host config.Host, creds *hostcreds.Credentials) (dialFunc, error) {
+	switch e.Transport {
+	case config.TransportUnix:
+		return func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", e.Socket)
+		}, nil
+
+	case config.TransportTCP:
+		return func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", e.Address)
+		}, nil
+
+	case config.TransportTLS:
+		cfg, err := libvirtTLSConfig(lv.TLS, e.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (net.Conn, error) {
+			d := tls.Dialer{Config: cfg}
+			return d.DialContext(ctx, "tcp", e.Address)
+		}, nil
+
+	case config.TransportSSH:
+		return libvirtSSHDialer(e, lv.SSH, host, creds)
+	}
+
+	return nil, fmt.Errorf("unsupported libvirt transport %q", e.Transport)
+}
+
+// libvirtTLSConfig authenticates to libvirtd with a client certificate and checks its
+// certificate against the CA in cfg.
+func libvirtTLSConfig(cfg config.LibvirtTLS, serverName string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading libvirt client certificate: %w", err)
+	}
+	ca, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading libvirt CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// libvirtSSHDialer logs in as the URI's user, or host.ssh_user, with the libvirt SSH
+// key if one is set and the host's credentials otherwise. Host keys are checked against
+// the known hosts file if one is set, and like any other host's otherwise.
+func libvirtSSHDialer(e config.LibvirtEndpoint, cfg config.LibvirtSSH, host config.Host, creds *hostcreds.Credentials) (dialFunc, error) {
+	user := e.User
+	if user == "" {
+		user = host.SSHUser
+	}
+
+	var signer ssh.Signer
+	if cfg.KeyPath != "" {
+		key, err := ioutil.ReadFile(cfg.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading libvirt SSH key: %w", err)
+		}
+		if signer, err = ssh.ParsePrivateKey(key); err != nil {
+			return nil, fmt.Errorf("loading libvirt SSH key: %w", err)
+		}
+	}
+
+	var knownHosts ssh.HostKeyCallback
+	if cfg.KnownHostsFile != "" {
+		cb, err := knownhosts.New(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading libvirt known hosts: %w", err)
+		}
+		knownHosts = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := cb(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+				return fmt.Errorf("host key mismatch for %s: it presented %s, which isn't the key in %s",
+					hostname, ssh.FingerprintSHA256(key), cfg.KnownHostsFile)
+			}
+			return err
+		}
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		sshConfig := &ssh.ClientConfig{User: user, HostKeyCallback: knownHosts}
+		if knownHosts == nil {
+			sshConfig.HostKeyCallback = creds.HostKeyCallback(ctx)
+		}
+		if signer != nil {
+			sshConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		} else {
+			auth, done, err := creds.Auth()
+			if err != nil {
+				return nil, err
+			}
+			// Authentication is over once the handshake is.
+			defer done()
+			sshConfig.Auth = []ssh.AuthMethod{auth}
+		}
+
+		client, err := dialSSH(ctx, e.Address, sshConfig)
+		if err != nil {
+			return nil, err
+		}
+		sock, err := client.Dial("unix", e.Socket)
+		if err != nil {
+			client.Close()
+			return nil, ctxErr(ctx, err)
+		}
+		return &sshSocket{Conn: sock, client: client}, nil
+	}, nil
+}
+
+// sshSocket is a unix socket tunneled over SSH. Closing it also logs out.
+type sshSocket struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (s *sshSocket) Close() error {
+	err := s.Conn.Close()
+	s.client.Close()
+	return err
+}
@@ -1,12 +1,15 @@
 package cloudkit
 
 import (
+	"context"
 	"encoding/xml"
-	"io/ioutil"
-	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
 	"github.com/digitalocean/go-libvirt"
 	"github.com/lithammer/shortuuid"
 	"github.com/sirupsen/logrus"
@@ -27,6 +30,7 @@ type VM struct {
 	DomainID   int                         `json:"domain_id,omitempty"`
 	Name       string                      `json:"name,omitempty"`
 	State      string                      `json:"state"`
+	Host       string                      `json:"host,omitempty"`
 	IP         string                      `json:"ip,omitempty"`
 	MAC        string                      `json:"mac,omitempty"`
 	Mem        int                         `json:"mem,omitempty"`
@@ -38,18 +42,45 @@ type VM struct {
 
 // VMController describes all the actions you can take on a VM.
 type VMController interface {
-	CreateVM(machineType string, memoryInGB int, vCPUs int) (VM, error)
-	GetRunningVMs() ([]VM, error)
-	GetRunningDomains() ([]libvirt.Domain, error)
-	DomainMemoryStats(domain libvirt.Domain, maxStats uint32, flags uint32) (rStats []libvirt.DomainMemoryStat, err error)
-	GetVMByDomainID(domainID int) (VM, error)
+	CreateVM(ctx context.Context, machineType string, memoryInGB int, vCPUs int) (VM, error)
+	GetDomains(ctx context.Context) ([]libvirt.Domain, error)
+	GetRunningDomains(ctx context.Context) ([]libvirt.Domain, error)
+	DescribeDomain(ctx context.Context, domain libvirt.Domain) (VM, error)
+	DomainMemoryStats(ctx context.Context, domain libvirt.Domain, maxStats uint32, flags uint32) (rStats []libvirt.DomainMemoryStat, err error)
+	GetVMByName(ctx context.Context, name string) (VM, error)
+	DestroyVM(ctx context.Context, name string) error
+	GetDomainStats(ctx context.Context, domains []libvirt.Domain) ([]DomainStats, error)
+	LifecycleEvents(ctx context.Context) (<-chan VMEvent, error)
+	DomainMemory(ctx context.Context, domain libvirt.Domain) (maxKiB uint64, currentKiB uint64, err error)
+	SetDomainMemory(ctx context.Context, domain libvirt.Domain, kib uint64) error
+	Connection() ConnectionStatus
+	WaitConnected(ctx context.Context) error
 }
 
 // VMManager imlements the VMController interface and handles
 // everything to do with managing VMs in the hardware pool.
 type VMManager struct {
-	libvirt *libvirt.Libvirt
-	logger  *logrus.Logger
+	address   string
+	dial      dialFunc
+	hostname  string
+	keepalive time.Duration
+	host      config.Host
+	creds     *hostcreds.Credentials
+	logger    *logrus.Logger
+	observer  RPCObserver
+
+	mu     sync.Mutex
+	conn   *connection
+	status ConnectionStatus
+	// ready is closed while connected and replaced when the connection is lost.
+	ready chan struct{}
+}
+
+// RPCObserver is told how long each libvirt call made by a VMManager took, and about
+// any lifecycle events it dropped because their subscriber fell behind.
+type RPCObserver interface {
+	ObserveLibvirtCall(procedure string, d time.Duration, err error)
+	ObserveDroppedEvent(eventType string)
 }
 
 // MemUsage is a snapshot of memory usage (% of total) at a point in time on a VM.
@@ -58,52 +89,213 @@ type MemUsage struct {
 	Usage float64 `json:"usage"`
 }
 
-// NewVMManager creates a tcp connection to libvirt on the host machines.
-func NewVMManager(hostLibvirtConnStr string, log *logrus.Logger) (*VMManager, error) {
-	protocol := "tcp"
-	c, err := net.DialTimeout(protocol, hostLibvirtConnStr, 2*time.Second)
+// CPUUsage is a snapshot of CPU usage (% of allocated vCPU time) at a point in time on a VM.
+type CPUUsage struct {
+	Time  string  `json:"time,omitempty"`
+	Usage float64 `json:"usage"`
+}
+
+// DiskUsage is a snapshot of throughput and IOPS on a single VM disk at a point in time.
+type DiskUsage struct {
+	Time         string  `json:"time,omitempty"`
+	Device       string  `json:"device"`
+	ReadBytesPS  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPS float64 `json:"write_bytes_per_sec"`
+	ReadIOPS     float64 `json:"read_iops"`
+	WriteIOPS    float64 `json:"write_iops"`
+}
+
+// NetUsage is a snapshot of traffic on a single VM network interface at a point in time.
+type NetUsage struct {
+	Time        string  `json:"time,omitempty"`
+	Interface   string  `json:"interface"`
+	RxBytesPS   float64 `json:"rx_bytes_per_sec"`
+	TxBytesPS   float64 `json:"tx_bytes_per_sec"`
+	RxPacketsPS float64 `json:"rx_packets_per_sec"`
+	TxPacketsPS float64 `json:"tx_packets_per_sec"`
+}
+
+// VMUsage groups the CPU, disk and network rates computed from one pair of DomainStats.
+type VMUsage struct {
+	CPU        CPUUsage    `json:"cpu"`
+	Disks      []DiskUsage `json:"disks"`
+	Interfaces []NetUsage  `json:"interfaces"`
+}
+
+// MemoryBounds limits how far the memory balancer may resize a VM, in MiB. Zero means
+// use the balancer's default for that bound.
+type MemoryBounds struct {
+	MinMiB int `json:"min_mib"`
+	MaxMiB int `json:"max_mib"`
+}
+
+// MetricsQuery describes a time range of a VM's metrics and the bucket width (Step) to
+// downsample it to.
+type MetricsQuery struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+// Aggregate summarizes every sample of a metric that fell into one Step wide bucket.
+type Aggregate struct {
+	Time string  `json:"time"`
+	Avg  float64 `json:"avg"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	P95  float64 `json:"p95"`
+}
+
+// Series is a downsampled metric for a VM, e.g. "cpu_usage", or "disk_read_iops" on
+// device "vda".
+type Series struct {
+	Metric string      `json:"metric"`
+	Device string      `json:"device,omitempty"`
+	Points []Aggregate `json:"points"`
+}
+
+// NewVMManager connects to libvirt on the host machine over the transport lv's URI
+// selects. host describes how to reach the host over SSH when preparing disks, and creds
+// how to authenticate to it and verify its host key. obs may be nil. Call Run to keep the
+// connection alive.
+func NewVMManager(lv config.Libvirt, host config.Host, creds *hostcreds.Credentials, log *logrus.Logger, obs RPCObserver) (*VMManager, error) {
+	endpoint, err := lv.Endpoint()
+	if err != nil {
+		return nil, err
+	}
+	dial, err := newDialer(endpoint, lv, host, creds)
 	if err != nil {
 		return nil, err
 	}
 
-	l := libvirt.New(c)
-	if err := l.Connect(); err != nil {
+	conn, err := connect(context.Background(), dial)
+	if err != nil {
 		return nil, err
 	}
 
-	v, err := l.Version()
+	version, err := conn.libvirt.Version()
 	if err != nil {
+		conn.close(err)
 		return nil, err
 	}
-	log.Infof("current libvirt version: %s\n\n", v)
+	log.Infof("current libvirt version: %s\n\n", version)
+
+	v := &VMManager{
+		address:   endpoint.Transport + "://" + endpoint.Address + endpoint.Socket,
+		dial:      dial,
+		hostname:  endpoint.Hostname(),
+		keepalive: lv.KeepaliveInterval.Duration,
+		host:      host,
+		creds:     creds,
+		logger:    log,
+		observer:  obs,
+		ready:     make(chan struct{}),
+	}
+	v.setConnection(conn, nil)
 
-	return &VMManager{libvirt: l, logger: log}, nil
+	return v, nil
 }
 
-// GetRunningVMs asks libvirt for current domains and returns them.
-func (v *VMManager) GetRunningVMs() ([]VM, error) {
-	dms, err := v.libvirt.Domains()
-	if err != nil {
-		return []VM{}, err
+// observe reports how long a libvirt call that began at start took.
+func (v *VMManager) observe(procedure string, start time.Time, err error) {
+	if v.observer != nil {
+		v.observer.ObserveLibvirtCall(procedure, time.Since(start), err)
 	}
+}
 
-	var runningVMs []VM
-	for i := range dms {
-		if dms[i].ID != -1 {
-			vm, err := v.ckVMFromDomain(dms[i], "default")
-			if err != nil {
-				return []VM{}, err
-			}
-			runningVMs = append(runningVMs, vm)
+// call runs the libvirt RPC procedure through fn on the current connection and reports
+// how long it took. It fails straight away with ErrDisconnected while libvirt is
+// unreachable. See callOn.
+func (v *VMManager) call(ctx context.Context, procedure string, fn func(l *libvirt.Libvirt) error) error {
+	return v.callOn(ctx, v.connection(), procedure, fn)
+}
+
+// callOn runs the libvirt RPC procedure through fn on conn, but stops waiting once ctx is
+// done or conn is lost. go-libvirt can't abandon an RPC in flight, so a call given up on
+// finishes in the background, when libvirt answers or at the latest when the keepalive
+// drops a connection that stopped answering, and whatever fn assigns must not be read
+// after an error. RPCs that change anything should use mutate instead. libvirt's "no
+// domain" errors are returned as apperr.NotFound.
+func (v *VMManager) callOn(ctx context.Context, conn *connection, procedure string, fn func(l *libvirt.Libvirt) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if conn == nil {
+		return ErrDisconnected
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn(conn.libvirt) }()
+
+	select {
+	case err := <-done:
+		select {
+		case <-conn.lost:
+			// Calls released by a lost connection return garbage rather than an error.
+			err = ErrDisconnected
+		default:
 		}
+		v.observe(procedure, start, err)
+		if libvirt.IsNotFound(err) {
+			return apperr.Wrap(apperr.NotFound, err, "domain not found")
+		}
+		return err
+	case <-conn.lost:
+		v.observe(procedure, start, ErrDisconnected)
+		return ErrDisconnected
+	case <-ctx.Done():
+		v.observe(procedure, start, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// mutate is call for RPCs that change libvirt's state. It doesn't stop waiting when ctx
+// is done, since an RPC given up on could still succeed and leave a change nobody knows
+// about. Instead it lets the RPC finish and, if it succeeded after ctx was done, runs undo
+// to reverse it and returns ctx's error. With no undo, the RPC's own result is returned.
+// A connection lost mid-RPC still returns ErrDisconnected straight away, leaving the
+// reconciler to find whatever the RPC did.
+func (v *VMManager) mutate(ctx context.Context, procedure string, fn func(l *libvirt.Libvirt) error, undo func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := v.callOn(context.Background(), v.connection(), procedure, fn); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil && undo != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// GetDomains asks libvirt for every domain, running or not. Domains that aren't running
+// have an ID of -1.
+func (v *VMManager) GetDomains(ctx context.Context) ([]libvirt.Domain, error) {
+	var dms []libvirt.Domain
+	err := v.call(ctx, "Domains", func(l *libvirt.Libvirt) (err error) {
+		dms, err = l.Domains()
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return dms, nil
+}
 
-	return runningVMs, nil
+// DescribeDomain returns a new VM hydrated with a domain's data.
+func (v *VMManager) DescribeDomain(ctx context.Context, domain libvirt.Domain) (VM, error) {
+	return v.ckVMFromDomain(ctx, domain, "default")
 }
 
 // GetRunningDomains asks libvirt for current domains and returns them.
-func (v *VMManager) GetRunningDomains() ([]libvirt.Domain, error) {
-	dms, err := v.libvirt.Domains()
+func (v *VMManager) GetRunningDomains(ctx context.Context) ([]libvirt.Domain, error) {
+	var dms []libvirt.Domain
+	err := v.call(ctx, "Domains", func(l *libvirt.Libvirt) (err error) {
+		dms, err = l.Domains()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -116,13 +308,19 @@ func (v *VMManager) GetRunningDomains() ([]libvirt.Domain, error) {
 	return rDomains, nil
 }
 
-// GetVMByDomainID takes a libvirt domain ID and returns a new VM hydrated with its data.
-func (v *VMManager) GetVMByDomainID(domainID int) (VM, error) {
-	domain, err := v.libvirt.DomainLookupByID(int32(domainID))
+// GetVMByName looks up a domain by name and returns a new VM hydrated with its data.
+// Unlike domain IDs, which libvirt hands out afresh each time a domain starts and sets to
+// -1 while it's off, names stay with a domain for its whole life.
+func (v *VMManager) GetVMByName(ctx context.Context, name string) (VM, error) {
+	var domain libvirt.Domain
+	err := v.call(ctx, "DomainLookupByName", func(l *libvirt.Libvirt) (err error) {
+		domain, err = l.DomainLookupByName(name)
+		return err
+	})
 	if err != nil {
 		return VM{}, err
 	}
-	vm, err := v.ckVMFromDomain(domain, "default")
+	vm, err := v.ckVMFromDomain(ctx, domain, "default")
 	if err != nil {
 		return VM{}, err
 	}
@@ -130,15 +328,10 @@ func (v *VMManager) GetVMByDomainID(domainID int) (VM, error) {
 }
 
 // CreateVM currently handles spinning up the default ubuntu bionic VM
-func (v *VMManager) CreateVM(machineType string, memoryInGB int, vCPUs int) (VM, error) {
+func (v *VMManager) CreateVM(ctx context.Context, machineType string, memoryInGB int, vCPUs int) (VM, error) {
 	id := shortuuid.New()
 
-	pk, err := aquirePubKeyAuth("/Users/bradford/.ssh/id_rsa")
-	if err != nil {
-		return VM{}, err
-	}
-
-	if err := prepareHostWithUbuntuDisks(pk, id); err != nil {
+	if err := prepareHostWithUbuntuDisks(ctx, v.host, v.creds, id); err != nil {
 		return VM{}, err
 	}
 
@@ -147,31 +340,139 @@ func (v *VMManager) CreateVM(machineType string, memoryInGB int, vCPUs int) (VM,
 		return VM{}, err
 	}
 
-	domain, err := v.libvirt.DomainCreateXML(string(b), 0)
+	var domain libvirt.Domain
+	err = v.mutate(ctx, "DomainCreateXML", func(l *libvirt.Libvirt) (err error) {
+		domain, err = l.DomainCreateXML(string(b), 0)
+		return err
+	}, func() { v.destroyCreated(domain) })
 	if err != nil {
 		return VM{}, err
 	}
 
-	v.libvirt.DomainSetMemoryStatsPeriod(domain, MemStatsPeriod, 0)
+	err = v.mutate(ctx, "DomainSetMemoryStatsPeriod", func(l *libvirt.Libvirt) error {
+		return l.DomainSetMemoryStatsPeriod(domain, MemStatsPeriod, 0)
+	}, nil)
 	if err != nil {
+		v.destroyCreated(domain)
 		return VM{}, err
 	}
 
-	vm, err := v.ckVMFromDomain(domain, "default")
+	vm, err := v.ckVMFromDomain(ctx, domain, "default")
 	if err != nil {
+		v.destroyCreated(domain)
 		return VM{}, err
 	}
 
 	return vm, nil
 }
 
+// cleanupTimeout bounds destroying a domain CreateVM couldn't finish setting up.
+const cleanupTimeout = 30 * time.Second
+
+// destroyCreated destroys a domain CreateVM started but couldn't finish setting up, so it
+// isn't left running with no VM to show for it. It runs on its own context, as the
+// caller's may be what failed.
+func (v *VMManager) destroyCreated(domain libvirt.Domain) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	err := v.mutate(ctx, "DomainDestroy", func(l *libvirt.Libvirt) error {
+		return l.DomainDestroy(domain)
+	}, nil)
+	if err != nil && !apperr.Is(err, apperr.NotFound) {
+		v.logger.Errorf("failed to destroy domain %s after creating it failed, err: %+v", domain.Name, err)
+	}
+}
+
+// DestroyVM powers off the named domain. cloudkit creates transient domains, so libvirt
+// forgets a domain once it's destroyed. A domain that's already gone isn't an error.
+func (v *VMManager) DestroyVM(ctx context.Context, name string) error {
+	var domain libvirt.Domain
+	err := v.call(ctx, "DomainLookupByName", func(l *libvirt.Libvirt) (err error) {
+		domain, err = l.DomainLookupByName(name)
+		return err
+	})
+	if apperr.Is(err, apperr.NotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = v.mutate(ctx, "DomainDestroy", func(l *libvirt.Libvirt) error {
+		return l.DomainDestroy(domain)
+	}, nil)
+	if apperr.Is(err, apperr.NotFound) {
+		return nil
+	}
+	return err
+}
+
 // DomainMemoryStats is current just a wrapper for libvirt's DomainMemoryStats func.
-func (v *VMManager) DomainMemoryStats(dom libvirt.Domain, maxStats uint32, flags uint32) (rStats []libvirt.DomainMemoryStat, err error) {
-	return v.libvirt.DomainMemoryStats(dom, maxStats, flags)
+func (v *VMManager) DomainMemoryStats(ctx context.Context, dom libvirt.Domain, maxStats uint32, flags uint32) ([]libvirt.DomainMemoryStat, error) {
+	var rStats []libvirt.DomainMemoryStat
+	err := v.call(ctx, "DomainMemoryStats", func(l *libvirt.Libvirt) (err error) {
+		rStats, err = l.DomainMemoryStats(dom, maxStats, flags)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rStats, nil
+}
+
+// DomainMemory returns a running domain's maximum and current (balloon) memory in KiB.
+func (v *VMManager) DomainMemory(ctx context.Context, domain libvirt.Domain) (uint64, uint64, error) {
+	var maxKiB, currentKiB uint64
+	err := v.call(ctx, "DomainGetInfo", func(l *libvirt.Libvirt) (err error) {
+		_, maxKiB, currentKiB, _, _, err = l.DomainGetInfo(domain)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return maxKiB, currentKiB, nil
+}
+
+// SetDomainMemory resizes a running domain's balloon to kib. It can't go above the
+// domain's maximum memory.
+func (v *VMManager) SetDomainMemory(ctx context.Context, domain libvirt.Domain, kib uint64) error {
+	return v.mutate(ctx, "DomainSetMemoryFlags", func(l *libvirt.Libvirt) error {
+		return l.DomainSetMemoryFlags(domain, kib, uint32(libvirt.DomainMemLive))
+	}, nil)
+}
+
+// GetDomainStats asks libvirt for CPU, vCPU, disk and interface counters on the given
+// domains in a single bulk call.
+func (v *VMManager) GetDomainStats(ctx context.Context, domains []libvirt.Domain) ([]DomainStats, error) {
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	var recs []libvirt.DomainStatsRecord
+	err := v.call(ctx, "ConnectGetAllDomainStats", func(l *libvirt.Libvirt) (err error) {
+		recs, err = l.ConnectGetAllDomainStats(domains, uint32(DomainStatsTypes), 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stats := make([]DomainStats, 0, len(recs))
+	for _, rec := range recs {
+		stats = append(stats, NewDomainStats(rec, now))
+	}
+
+	return stats, nil
 }
 
-func (v *VMManager) ckVMFromDomain(domain libvirt.Domain, network string) (VM, error) {
-	rXML, err := v.libvirt.DomainGetXMLDesc(domain, 0)
+func (v *VMManager) ckVMFromDomain(ctx context.Context, domain libvirt.Domain, network string) (VM, error) {
+	var rXML string
+	err := v.call(ctx, "DomainGetXMLDesc", func(l *libvirt.Libvirt) (err error) {
+		rXML, err = l.DomainGetXMLDesc(domain, 0)
+		return err
+	})
 	if err != nil {
 		return VM{}, err
 	}
@@ -181,12 +482,20 @@ func (v *VMManager) ckVMFromDomain(domain libvirt.Domain, network string) (VM, e
 		return VM{}, err
 	}
 
-	state, _, err := v.libvirt.DomainGetState(domain, 0)
+	var state int32
+	err = v.call(ctx, "DomainGetState", func(l *libvirt.Libvirt) (err error) {
+		state, _, err = l.DomainGetState(domain, 0)
+		return err
+	})
 	if err != nil {
 		return VM{}, err
 	}
 
-	net, err := v.libvirt.NetworkLookupByName(network)
+	var net libvirt.Network
+	err = v.call(ctx, "NetworkLookupByName", func(l *libvirt.Libvirt) (err error) {
+		net, err = l.NetworkLookupByName(network)
+		return err
+	})
 	if err != nil {
 		return VM{}, err
 	}
@@ -204,7 +513,11 @@ func (v *VMManager) ckVMFromDomain(domain libvirt.Domain, network string) (VM, e
 	ip := "pending"
 	if macAddr != "pending" {
 		m := libvirt.OptString{macAddr}
-		leases, _, err := v.libvirt.NetworkGetDhcpLeases(net, m, 1, 0)
+		var leases []libvirt.NetworkDhcpLease
+		err := v.call(ctx, "NetworkGetDhcpLeases", func(l *libvirt.Libvirt) (err error) {
+			leases, _, err = l.NetworkGetDhcpLeases(net, m, 1, 0)
+			return err
+		})
 		if err != nil {
 			return VM{}, err
 		}
@@ -221,6 +534,7 @@ func (v *VMManager) ckVMFromDomain(domain libvirt.Domain, network string) (VM, e
 		DomainID:   int(domain.ID),
 		Name:       domain.Name,
 		State:      domainState(state),
+		Host:       v.hostname,
 		IP:         ip,
 		MAC:        macAddr,
 		Mem:        int(domcfg.Memory.Value),
@@ -256,33 +570,25 @@ func domainState(state int32) string {
 	}
 }
 
-func aquirePubKeyAuth(privKeyPath string) (ssh.AuthMethod, error) {
-	key, err := ioutil.ReadFile(privKeyPath)
-	if err != nil {
-		return nil, err
-	}
-	signer, err := ssh.ParsePrivateKey(key)
+func prepareHostWithUbuntuDisks(ctx context.Context, host config.Host, creds *hostcreds.Credentials, id string) error {
+	auth, done, err := creds.Auth()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return ssh.PublicKeys(signer), nil
-}
+	defer done()
 
-func prepareHostWithUbuntuDisks(pk ssh.AuthMethod, id string) error {
-	user := "root"
-	remote := "157.245.225.232"
-	port := ":22"
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{pk},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	sshConfig := &ssh.ClientConfig{
+		User:            host.SSHUser,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: creds.HostKeyCallback(ctx),
 	}
-
-	conn, err := ssh.Dial("tcp", remote+port, config)
+	conn, err := dialSSH(ctx, host.SSHAddress, sshConfig)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	// Closing the connection is the only way to interrupt a command that's running.
+	defer closeOnDone(ctx, conn)()
 
 	sess, err := conn.NewSession()
 	if err != nil {
@@ -296,10 +602,15 @@ func prepareHostWithUbuntuDisks(pk ssh.AuthMethod, id string) error {
 		"cp /var/lib/libvirt/images/ubuntu-bionic.iso /var/lib/libvirt/images/ubuntu-bionic-" + id + ".iso",
 		"cloud-localds /var/lib/libvirt/images/ubuntu-bionic-" + id + ".iso cloud.txt",
 	}
+	if host.Sudo {
+		for i, cmd := range commands {
+			commands[i] = "sudo -n " + cmd
+		}
+	}
 	combined := strings.Join(commands, "; ")
 
 	if err := sess.Run(combined); err != nil {
-		return err
+		return ctxErr(ctx, err)
 	}
 
 	return nil
@@ -349,6 +660,16 @@ func buildDomainXML(id string, machineType string, memoryInGB int, numVCPUs int)
 	}
 }
 
+// DiskSizeGB is the size of the disk every VM gets, a copy of the base image which is
+// resized to 10G when the host is prepared.
+const DiskSizeGB = 10
+
+// RequestedResources returns the memory, in MiB, and vCPUs CreateVM actually gives a VM
+// for the given request, since unsupported sizes fall back to defaults.
+func RequestedResources(memoryInGB int, vCPUs int) (memoryMiB int, numVCPUs int) {
+	return int(gbToMiB(memoryInGB)), int(vCPUCount(vCPUs))
+}
+
 func gbToMiB(gb int) uint {
 	switch gb {
 	case 1:
@@ -0,0 +1,58 @@
+package cloudkit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestMutateWaitsAndUndoes(t *testing.T) {
+	v := &VMManager{conn: &connection{lost: make(chan struct{})}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	finish := make(chan struct{})
+	finished := false
+	undone := false
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		close(finish)
+	}()
+
+	err := v.mutate(ctx, "DomainCreateXML", func(l *libvirt.Libvirt) error {
+		<-finish
+		finished = true
+		return nil
+	}, func() {
+		if !finished {
+			t.Error("undo ran before the RPC finished")
+		}
+		undone = true
+	})
+
+	if err != context.Canceled {
+		t.Errorf("mutate() = %v, want %v", err, context.Canceled)
+	}
+	if !finished {
+		t.Error("mutate returned before the RPC finished")
+	}
+	if !undone {
+		t.Error("mutate didn't undo an RPC that finished after ctx was done")
+	}
+}
+
+func TestMutateWithoutUndo(t *testing.T) {
+	v := &VMManager{conn: &connection{lost: make(chan struct{})}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := v.mutate(ctx, "DomainDestroy", func(l *libvirt.Libvirt) error {
+		cancel()
+		return nil
+	}, nil)
+	if err != nil {
+		t.Errorf("mutate() = %v, want the RPC's own result", err)
+	}
+}
@@ -0,0 +1,492 @@
+// Package config loads cloudkit's settings from a YAML or TOML file, applies environment
+// variable overrides on top and validates the result before anything starts.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting cloudkit reads at startup.
+type Config struct {
+	Server     Server     `yaml:"server" toml:"server"`
+	Database   Database   `yaml:"database" toml:"database"`
+	Libvirt    Libvirt    `yaml:"libvirt" toml:"libvirt"`
+	Host       Host       `yaml:"host" toml:"host"`
+	Monitor    Monitor    `yaml:"monitor" toml:"monitor"`
+	Reconciler Reconciler `yaml:"reconciler" toml:"reconciler"`
+	Balancer   Balancer   `yaml:"memory_balancer" toml:"memory_balancer"`
+	Alerts     Alerts     `yaml:"alerts" toml:"alerts"`
+	Auth       Auth       `yaml:"auth" toml:"auth"`
+}
+
+// Server configures the HTTP API.
+type Server struct {
+	// Listen is the address the API listens on.
+	Listen string `yaml:"listen" toml:"listen"`
+	// BaseURL is the externally reachable URL of the API, used in links cloudkit hands out.
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+	// CORSOrigins lists the origins browsers may call the API from. "*" allows any origin.
+	// Empty disables CORS, so only same-origin requests work from a browser.
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+	// ShutdownTimeout bounds how long in flight requests get to finish on shutdown.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// RequestTimeout bounds how long an API request may take. Event streams aren't limited.
+	RequestTimeout Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// CreateVMTimeout bounds creating a VM, which prepares its disk on the host and can
+	// take several minutes, so happens in the background after the request is answered.
+	CreateVMTimeout Duration `yaml:"create_vm_timeout" toml:"create_vm_timeout"`
+	// TrustedProxies lists the addresses or CIDR ranges of reverse proxies in front of the
+	// API. X-Forwarded-For is only believed from them, so the client address the audit
+	// log records can't be forged by anyone else.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// Proxies parses TrustedProxies, taking a bare address as a range of one.
+func (s Server) Proxies() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range s.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("server.trusted_proxies %q is not an address or CIDR range", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("server.trusted_proxies %q is not an address or CIDR range", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Database configures the Postgres connection.
+type Database struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	Name     string `yaml:"name" toml:"name"`
+	SSLMode  string `yaml:"ssl_mode" toml:"ssl_mode"`
+	// AutoMigrate applies pending schema migrations at startup. When it's off, run
+	// "server migrate up" before starting a new version.
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate"`
+}
+
+// Libvirt configures the connection to the hypervisor host's libvirt daemon.
+type Libvirt struct {
+	// URI picks libvirtd and how to reach it: qemu+tls://host/system,
+	// qemu+ssh://user@host/system, qemu+tcp://host/system or qemu:///system for the local
+	// socket. A socket query parameter overrides the socket path for ssh and local URIs.
+	URI string `yaml:"uri" toml:"uri"`
+	// Address is the host:port libvirtd listens for unauthenticated TCP connections on.
+	// It's only used when URI is empty, as qemu+tcp://Address/system.
+	Address string `yaml:"address" toml:"address"`
+	// TLS holds the client certificate used with qemu+tls URIs.
+	TLS LibvirtTLS `yaml:"tls" toml:"tls"`
+	// SSH holds the credentials used with qemu+ssh URIs.
+	SSH LibvirtSSH `yaml:"ssh" toml:"ssh"`
+	// KeepaliveInterval is how often libvirt is pinged to check the connection is still
+	// alive. A ping that takes longer than this drops the connection and reconnects.
+	KeepaliveInterval Duration `yaml:"keepalive_interval" toml:"keepalive_interval"`
+}
+
+// LibvirtTLS locates the PEM files for a qemu+tls connection. The defaults are where
+// libvirt's own clients look for them.
+type LibvirtTLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	CAFile   string `yaml:"ca_file" toml:"ca_file"`
+}
+
+// LibvirtSSH configures a qemu+ssh connection, which tunnels to libvirtd's unix socket on
+// the remote host. The user comes from the URI, falling back to host.ssh_user.
+type LibvirtSSH struct {
+	// KeyPath is the private key used to authenticate. It defaults to the host section's
+	// key or ssh-agent.
+	KeyPath string `yaml:"key_path" toml:"key_path"`
+	// KnownHostsFile is an OpenSSH known_hosts file the host's key must be listed in. It
+	// defaults to the host keys cloudkit stores, as for host.ssh_address.
+	KnownHostsFile string `yaml:"known_hosts_file" toml:"known_hosts_file"`
+}
+
+// Host configures the SSH access cloudkit uses to prepare disks on the hypervisor host.
+type Host struct {
+	// SSHAddress is the host:port of the hypervisor's SSH server.
+	SSHAddress string `yaml:"ssh_address" toml:"ssh_address"`
+	// SSHUser should be an unprivileged user allowed to run commands with sudo.
+	SSHUser string `yaml:"ssh_user" toml:"ssh_user"`
+	// Sudo runs commands on the host through sudo -n, so SSHUser needs passwordless sudo.
+	Sudo bool `yaml:"sudo" toml:"sudo"`
+	// SSHKeyPath is the private key used to authenticate, typically a mounted secret.
+	SSHKeyPath string `yaml:"ssh_key_path" toml:"ssh_key_path"`
+	// SSHKeyPassphraseFile holds the passphrase SSHKeyPath is encrypted with, if it is.
+	SSHKeyPassphraseFile string `yaml:"ssh_key_passphrase_file" toml:"ssh_key_passphrase_file"`
+	// SSHAgent authenticates with the ssh-agent at SSH_AUTH_SOCK instead of SSHKeyPath.
+	SSHAgent bool `yaml:"ssh_agent" toml:"ssh_agent"`
+	// SSHHostKey pins the host key, in authorized_keys format, that the host must present.
+	// Without it keys are checked against those cloudkit has stored for the host.
+	SSHHostKey string `yaml:"ssh_host_key" toml:"ssh_host_key"`
+	// TrustOnFirstUse stores whatever key a host with no stored keys presents and accepts
+	// only that key from then on. When it's off, keys must be pinned before connecting.
+	TrustOnFirstUse bool `yaml:"trust_on_first_use" toml:"trust_on_first_use"`
+}
+
+// Monitor configures the VM monitor.
+type Monitor struct {
+	// Interval is the time between monitor passes.
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// Reconciler configures the VM reconciler.
+type Reconciler struct {
+	// Interval is the time between reconciliation passes.
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// Balancer configures the optional balloon memory balancer.
+type Balancer struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+}
+
+// Alerts configures alert notification sinks.
+type Alerts struct {
+	// SMTPAddr enables the email sink when set, relaying through host:port.
+	SMTPAddr  string   `yaml:"smtp_addr" toml:"smtp_addr"`
+	EmailFrom string   `yaml:"email_from" toml:"email_from"`
+	EmailTo   []string `yaml:"email_to" toml:"email_to"`
+}
+
+// Auth configures authentication.
+type Auth struct {
+	// AdminEmail is the email of the first user, created when there are no users yet.
+	AdminEmail string `yaml:"admin_email" toml:"admin_email"`
+	// AdminAPIKey, if set, is used as the first user's API key instead of generating one.
+	AdminAPIKey string `yaml:"admin_api_key" toml:"admin_api_key"`
+	// AdminKeyFile, if set, is where a generated first API key is written, readable only
+	// by its owner. Without it the key is printed once to stderr, if that is a terminal.
+	AdminKeyFile string `yaml:"admin_key_file" toml:"admin_key_file"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "5m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, which TOML decoding uses.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Default returns the settings used for anything the file and environment leave out.
+func Default() Config {
+	return Config{
+		Server: Server{
+			Listen:          ":4000",
+			ShutdownTimeout: Duration{5 * time.Second},
+			RequestTimeout:  Duration{30 * time.Second},
+			CreateVMTimeout: Duration{10 * time.Minute},
+		},
+		Database: Database{
+			Port:        5432,
+			SSLMode:     "disable",
+			AutoMigrate: true,
+		},
+		Libvirt: Libvirt{
+			TLS: LibvirtTLS{
+				CertFile: "/etc/pki/libvirt/clientcert.pem",
+				KeyFile:  "/etc/pki/libvirt/private/clientkey.pem",
+				CAFile:   "/etc/pki/CA/cacert.pem",
+			},
+			KeepaliveInterval: Duration{5 * time.Second},
+		},
+		Host: Host{
+			Sudo:            true,
+			TrustOnFirstUse: true,
+		},
+		Monitor: Monitor{
+			Interval: Duration{1 * time.Minute},
+		},
+		Reconciler: Reconciler{
+			Interval: Duration{1 * time.Minute},
+		},
+		Auth: Auth{
+			AdminEmail: "admin@localhost",
+		},
+	}
+}
+
+// Load reads the config file at path, if path isn't empty, over the defaults, then
+// applies environment overrides and validates the result. The file format is picked by
+// its extension: .yaml, .yml or .toml.
+func Load(path string) (Config, error) {
+	cfg, err := Read(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Read is Load without the validation, for commands that need only some settings. Check
+// those with ValidateDatabase.
+func Read(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("config: reading %s: %w", path, err)
+		}
+		switch ext := strings.ToLower(filepath.Ext(path)); ext {
+		case ".yaml", ".yml":
+			err = yaml.UnmarshalStrict(b, &cfg)
+		case ".toml":
+			var md toml.MetaData
+			md, err = toml.Decode(string(b), &cfg)
+			if err == nil && len(md.Undecoded()) > 0 {
+				err = fmt.Errorf("unknown keys %v", md.Undecoded())
+			}
+		default:
+			err = fmt.Errorf("unsupported file extension %q, use .yaml, .yml or .toml", ext)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("config: parsing %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// env lists the environment variables that override config file settings.
+func (c *Config) env() []struct {
+	name string
+	set  func(string) error
+} {
+	str := func(p *string) func(string) error {
+		return func(v string) error { *p = v; return nil }
+	}
+	list := func(p *[]string) func(string) error {
+		return func(v string) error { *p = splitList(v); return nil }
+	}
+	boolean := func(p *bool) func(string) error {
+		return func(v string) (err error) { *p, err = strconv.ParseBool(v); return err }
+	}
+	dur := func(p *Duration) func(string) error {
+		return func(v string) error { return p.UnmarshalText([]byte(v)) }
+	}
+	return []struct {
+		name string
+		set  func(string) error
+	}{
+		{"CLOUDKIT_LISTEN_ADDR", str(&c.Server.Listen)},
+		{"CLOUDKIT_BASE_URL", str(&c.Server.BaseURL)},
+		{"CLOUDKIT_CORS_ORIGINS", list(&c.Server.CORSOrigins)},
+		{"CLOUDKIT_SHUTDOWN_TIMEOUT", dur(&c.Server.ShutdownTimeout)},
+		{"CLOUDKIT_REQUEST_TIMEOUT", dur(&c.Server.RequestTimeout)},
+		{"CLOUDKIT_CREATE_VM_TIMEOUT", dur(&c.Server.CreateVMTimeout)},
+		{"CLOUDKIT_TRUSTED_PROXIES", list(&c.Server.TrustedProxies)},
+		{"CLOUDKIT_DB_HOST", str(&c.Database.Host)},
+		{"CLOUDKIT_DB_PORT", func(v string) (err error) { c.Database.Port, err = strconv.Atoi(v); return err }},
+		{"CLOUDKIT_DB_USER", str(&c.Database.User)},
+		{"CLOUDKIT_DB_PASSWORD", str(&c.Database.Password)},
+		{"CLOUDKIT_DB_NAME", str(&c.Database.Name)},
+		{"CLOUDKIT_SSL_MODE", str(&c.Database.SSLMode)},
+		{"CLOUDKIT_DB_AUTO_MIGRATE", boolean(&c.Database.AutoMigrate)},
+		{"CLOUDKIT_LIBVIRT_URI", str(&c.Libvirt.URI)},
+		{"CLOUDKIT_LIBVIRT_ADDR", str(&c.Libvirt.Address)},
+		{"CLOUDKIT_LIBVIRT_TLS_CERT", str(&c.Libvirt.TLS.CertFile)},
+		{"CLOUDKIT_LIBVIRT_TLS_KEY", str(&c.Libvirt.TLS.KeyFile)},
+		{"CLOUDKIT_LIBVIRT_TLS_CA", str(&c.Libvirt.TLS.CAFile)},
+		{"CLOUDKIT_LIBVIRT_SSH_KEY", str(&c.Libvirt.SSH.KeyPath)},
+		{"CLOUDKIT_LIBVIRT_KNOWN_HOSTS", str(&c.Libvirt.SSH.KnownHostsFile)},
+		{"CLOUDKIT_LIBVIRT_KEEPALIVE", dur(&c.Libvirt.KeepaliveInterval)},
+		{"CLOUDKIT_SSH_ADDR", str(&c.Host.SSHAddress)},
+		{"CLOUDKIT_SSH_USER", str(&c.Host.SSHUser)},
+		{"CLOUDKIT_SSH_SUDO", boolean(&c.Host.Sudo)},
+		{"CLOUDKIT_SSH_KEY", str(&c.Host.SSHKeyPath)},
+		{"CLOUDKIT_SSH_KEY_PASSPHRASE_FILE", str(&c.Host.SSHKeyPassphraseFile)},
+		{"CLOUDKIT_SSH_AGENT", boolean(&c.Host.SSHAgent)},
+		{"CLOUDKIT_SSH_HOST_KEY", str(&c.Host.SSHHostKey)},
+		{"CLOUDKIT_SSH_TRUST_ON_FIRST_USE", boolean(&c.Host.TrustOnFirstUse)},
+		{"CLOUDKIT_MONITOR_INTERVAL", dur(&c.Monitor.Interval)},
+		{"CLOUDKIT_RECONCILE_INTERVAL", dur(&c.Reconciler.Interval)},
+		{"CLOUDKIT_MEMORY_BALANCER", boolean(&c.Balancer.Enabled)},
+		{"CLOUDKIT_SMTP_ADDR", str(&c.Alerts.SMTPAddr)},
+		{"CLOUDKIT_ALERT_EMAIL_FROM", str(&c.Alerts.EmailFrom)},
+		{"CLOUDKIT_ALERT_EMAIL_TO", list(&c.Alerts.EmailTo)},
+		{"CLOUDKIT_ADMIN_EMAIL", str(&c.Auth.AdminEmail)},
+		{"CLOUDKIT_ADMIN_API_KEY", str(&c.Auth.AdminAPIKey)},
+		{"CLOUDKIT_ADMIN_KEY_FILE", str(&c.Auth.AdminKeyFile)},
+	}
+}
+
+// applyEnv overrides settings with any of the environment variables in env that are set.
+// A variable set to the empty string is set, so it clears a string or list setting
+// rather than being ignored.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var problems []string
+	for _, e := range c.env() {
+		v, ok := lookup(e.name)
+		if !ok {
+			continue
+		}
+		if err := e.set(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q: %v", e.name, v, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("config: invalid environment variables:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Validate checks that every required setting is present and the rest make sense,
+// reporting every problem at once.
+func (c Config) Validate() error {
+	var problems []string
+	require := func(v, key, env string) {
+		if v == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (or set %s)", key, env))
+		}
+	}
+
+	require(c.Server.Listen, "server.listen", "CLOUDKIT_LISTEN_ADDR")
+	problems = append(problems, c.Database.validate()...)
+	require(c.Host.SSHAddress, "host.ssh_address", "CLOUDKIT_SSH_ADDR")
+	require(c.Host.SSHUser, "host.ssh_user", "CLOUDKIT_SSH_USER")
+	if !c.Host.SSHAgent {
+		require(c.Host.SSHKeyPath, "host.ssh_key_path", "CLOUDKIT_SSH_KEY, or host.ssh_agent")
+	}
+	require(c.Auth.AdminEmail, "auth.admin_email", "CLOUDKIT_ADMIN_EMAIL")
+
+	if c.Host.SSHAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Host.SSHAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("host.ssh_address %q must be host:port", c.Host.SSHAddress))
+		}
+	}
+	problems = append(problems, c.Libvirt.validate()...)
+	if c.Libvirt.KeepaliveInterval.Duration <= 0 {
+		problems = append(problems, "libvirt.keepalive_interval must be positive")
+	}
+	if c.Monitor.Interval.Duration <= 0 {
+		problems = append(problems, "monitor.interval must be positive")
+	}
+	if c.Reconciler.Interval.Duration <= 0 {
+		problems = append(problems, "reconciler.interval must be positive")
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		problems = append(problems, "server.shutdown_timeout must be positive")
+	}
+	if c.Server.RequestTimeout.Duration <= 0 {
+		problems = append(problems, "server.request_timeout must be positive")
+	}
+	if c.Server.CreateVMTimeout.Duration <= 0 {
+		problems = append(problems, "server.create_vm_timeout must be positive")
+	}
+	if _, err := c.Server.Proxies(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Alerts.SMTPAddr != "" && (c.Alerts.EmailFrom == "" || len(c.Alerts.EmailTo) == 0) {
+		problems = append(problems, "alerts.email_from and alerts.email_to are required when alerts.smtp_addr is set")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config: invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ValidateDatabase is Validate for just the database settings, which is all migrations
+// need.
+func (c Config) ValidateDatabase() error {
+	if problems := c.Database.validate(); len(problems) > 0 {
+		return fmt.Errorf("config: invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validate checks the settings needed to connect to Postgres.
+func (d Database) validate() []string {
+	var problems []string
+	require := func(v, key, env string) {
+		if v == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (or set %s)", key, env))
+		}
+	}
+
+	require(d.Host, "database.host", "CLOUDKIT_DB_HOST")
+	require(d.User, "database.user", "CLOUDKIT_DB_USER")
+	require(d.Name, "database.name", "CLOUDKIT_DB_NAME")
+	if d.Port <= 0 || d.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("database.port %d is not a valid port", d.Port))
+	}
+	return problems
+}
+
+// validate checks the libvirt URI, or address, and the settings its transport needs.
+func (l Libvirt) validate() []string {
+	if l.URI == "" && l.Address == "" {
+		return []string{"libvirt.uri is required (or set CLOUDKIT_LIBVIRT_URI)"}
+	}
+	if l.URI == "" {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return []string{fmt.Sprintf("libvirt.address %q must be host:port", l.Address)}
+		}
+	}
+	e, err := l.Endpoint()
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if e.Transport == TransportTLS && (l.TLS.CertFile == "" || l.TLS.KeyFile == "" || l.TLS.CAFile == "") {
+		return []string{"libvirt.tls.cert_file, key_file and ca_file are required for qemu+tls"}
+	}
+	return nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
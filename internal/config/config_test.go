@@ -0,0 +1,56 @@
+package config
+
+import "testing"
+
+func TestApplyEnvEmptyValues(t *testing.T) {
+	env := map[string]string{
+		"CLOUDKIT_BASE_URL":     "",
+		"CLOUDKIT_CORS_ORIGINS": "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg := Default()
+	cfg.Server.BaseURL = "https://cloudkit.example.com"
+	cfg.Server.CORSOrigins = []string{"https://console.example.com"}
+	cfg.Server.Listen = ":4000"
+	if err := cfg.applyEnv(lookup); err != nil {
+		t.Fatalf("applyEnv() = %v", err)
+	}
+
+	if cfg.Server.BaseURL != "" {
+		t.Errorf("BaseURL = %q, want it cleared", cfg.Server.BaseURL)
+	}
+	if len(cfg.Server.CORSOrigins) != 0 {
+		t.Errorf("CORSOrigins = %q, want them cleared", cfg.Server.CORSOrigins)
+	}
+	if cfg.Server.Listen != ":4000" {
+		t.Errorf("Listen = %q, want unset variables to leave it alone", cfg.Server.Listen)
+	}
+
+	env["CLOUDKIT_DB_PORT"] = ""
+	if err := cfg.applyEnv(lookup); err == nil {
+		t.Error("applyEnv() with an empty port = nil, want an error")
+	}
+}
+
+func TestValidateDatabase(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Host = "localhost"
+	cfg.Database.User = "cloudkit"
+	cfg.Database.Name = "cloudkit"
+
+	if err := cfg.ValidateDatabase(); err != nil {
+		t.Errorf("ValidateDatabase() without libvirt or SSH settings = %v, want nil", err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() without libvirt or SSH settings = nil, want an error")
+	}
+
+	cfg.Database.Host = ""
+	if err := cfg.ValidateDatabase(); err == nil {
+		t.Error("ValidateDatabase() without a host = nil, want an error")
+	}
+}
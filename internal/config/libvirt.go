@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// Ways of reaching libvirtd.
+const (
+	TransportUnix = "unix"
+	TransportTCP  = "tcp"
+	TransportTLS  = "tls"
+	TransportSSH  = "ssh"
+)
+
+// DefaultLibvirtSocket is where libvirtd listens locally unless a URI says otherwise.
+const DefaultLibvirtSocket = "/var/run/libvirt/libvirt-sock"
+
+// defaultLibvirtPorts are the ports libvirt uses when a URI doesn't give one.
+var defaultLibvirtPorts = map[string]string{
+	TransportTCP: "16509",
+	TransportTLS: "16514",
+	TransportSSH: "22",
+}
+
+// LibvirtEndpoint is a parsed libvirt URI.
+type LibvirtEndpoint struct {
+	Transport string
+	// Address is the host:port to dial. It's empty for TransportUnix.
+	Address string
+	// User is the SSH user from the URI, if it gave one.
+	User string
+	// Socket is libvirtd's unix socket, locally for TransportUnix or on the remote host
+	// for TransportSSH.
+	Socket string
+}
+
+// Endpoint parses URI, or if it's empty treats Address as qemu+tcp://Address/system.
+// Only the qemu driver's system instance is supported, e.g. qemu+tls://host/system.
+func (l Libvirt) Endpoint() (LibvirtEndpoint, error) {
+	raw := l.URI
+	if raw == "" {
+		raw = "qemu+tcp://" + l.Address + "/system"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return LibvirtEndpoint{}, err
+	}
+	if u.Path != "/system" {
+		return LibvirtEndpoint{}, fmt.Errorf("libvirt URI %q must use the /system path", raw)
+	}
+
+	e := LibvirtEndpoint{Socket: u.Query().Get("socket")}
+	switch u.Scheme {
+	case "qemu":
+		// Like libvirt, a URI with a host but no transport means TLS.
+		e.Transport = TransportUnix
+		if u.Host != "" {
+			e.Transport = TransportTLS
+		}
+	case "qemu+unix":
+		e.Transport = TransportUnix
+	case "qemu+tcp":
+		e.Transport = TransportTCP
+	case "qemu+tls":
+		e.Transport = TransportTLS
+	case "qemu+ssh":
+		e.Transport = TransportSSH
+	default:
+		return LibvirtEndpoint{}, fmt.Errorf("libvirt URI %q has unsupported scheme %q", raw, u.Scheme)
+	}
+
+	if e.Transport == TransportUnix {
+		if u.Host != "" {
+			return LibvirtEndpoint{}, fmt.Errorf("libvirt URI %q can't have a host for a local socket", raw)
+		}
+	} else {
+		if u.Hostname() == "" {
+			return LibvirtEndpoint{}, fmt.Errorf("libvirt URI %q needs a host", raw)
+		}
+		port := u.Port()
+		if port == "" {
+			port = defaultLibvirtPorts[e.Transport]
+		}
+		e.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if e.Transport == TransportSSH && u.User != nil {
+		e.User = u.User.Username()
+	}
+	if e.Socket == "" && (e.Transport == TransportUnix || e.Transport == TransportSSH) {
+		e.Socket = DefaultLibvirtSocket
+	}
+
+	return e, nil
+}
+
+// Hostname is the name of the hypervisor host the endpoint reaches, which is this
+// machine for a local socket.
+func (e LibvirtEndpoint) Hostname() string {
+	if e.Transport == TransportUnix {
+		if name, err := os.Hostname(); err == nil {
+			return name
+		}
+		return "localhost"
+	}
+	host, _, _ := net.SplitHostPort(e.Address)
+	return host
+}
@@ -0,0 +1,200 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published alongside the cloudkit.EventVM* lifecycle types.
+const (
+	TypeOperationProgress = "operation.progress"
+	TypeMetricsSample     = "metrics.sample"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind before it is dropped.
+// Dropped subscribers can reconnect and resume from the last ID they saw.
+const subscriberBuffer = 64
+
+// Event is a single message on the broker. IDs increase monotonically, across restarts
+// too, so clients can resume a stream from the last one they received. ProjectID is set
+// on events that belong to a project but may not be about a VM, such as the progress of
+// an operation that hasn't created its VM yet.
+type Event struct {
+	ID        uint64      `json:"id"`
+	Type      string      `json:"type"`
+	VMName    string      `json:"vm_name,omitempty"`
+	ProjectID int         `json:"project_id,omitempty"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data"`
+}
+
+// Filter narrows a subscription. Empty fields match everything. Types may end in ".*"
+// to match a whole family, e.g. "vm.*".
+type Filter struct {
+	VMs   []string
+	Types []string
+}
+
+// Match reports whether ev passes the filter.
+func (f Filter) Match(ev Event) bool {
+	if len(f.VMs) > 0 && !contains(f.VMs, ev.VMName) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == ev.Type || strings.HasSuffix(t, ".*") && strings.HasPrefix(ev.Type, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives every published event that matches its filter on C. C is closed
+// when the subscription is closed or falls too far behind.
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	filter Filter
+	broker *Broker
+}
+
+// Close stops the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker fans published events out to subscribers and keeps a bounded history of recent
+// events for replay. Metric samples are published for every VM on every monitor pass, so
+// they're remembered separately to keep them from pushing everything else out.
+type Broker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	samples []Event
+	size    int
+	subs    map[*Subscription]struct{}
+}
+
+// NewBroker creates a Broker that remembers the last historySize metric samples and the
+// last historySize other events. IDs start from the current time in microseconds, so
+// they carry on increasing after a restart and a client resuming from an ID handed out
+// before it isn't replayed events that aren't newer.
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		nextID: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		size:   historySize,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the next ID to an event and delivers it to every matching subscriber.
+func (b *Broker) Publish(typ, vmName string, data interface{}) Event {
+	return b.PublishProject(0, typ, vmName, data)
+}
+
+// PublishProject is Publish for an event that belongs to projectID.
+func (b *Broker) PublishProject(projectID int, typ, vmName string, data interface{}) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ev := Event{ID: b.nextID, Type: typ, VMName: vmName, ProjectID: projectID, Time: time.Now(), Data: data}
+	b.nextID++
+
+	if typ == TypeMetricsSample {
+		b.samples = remember(b.samples, ev, b.size)
+	} else {
+		b.history = remember(b.history, ev, b.size)
+	}
+
+	for s := range b.subs {
+		if !s.filter.Match(ev) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			delete(b.subs, s)
+			close(s.c)
+		}
+	}
+
+	return ev
+}
+
+// Subscribe registers a new subscription. Any remembered events after lastID that match
+// the filter are returned for the caller to send before reading from the subscription,
+// so nothing published in between is missed. A lastID of 0 skips replay.
+func (b *Broker) Subscribe(f Filter, lastID uint64) ([]Event, *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if lastID > 0 {
+		replay = merge(after(b.history, lastID, f), after(b.samples, lastID, f))
+	}
+
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, filter: f, broker: b}
+	b.subs[s] = struct{}{}
+
+	return replay, s
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// remember appends ev to history, dropping the oldest events beyond size.
+func remember(history []Event, ev Event, size int) []Event {
+	history = append(history, ev)
+	if len(history) > size {
+		history = history[len(history)-size:]
+	}
+	return history
+}
+
+// after returns the events in history after lastID that match f.
+func after(history []Event, lastID uint64, f Filter) []Event {
+	var evs []Event
+	for _, ev := range history {
+		if ev.ID > lastID && f.Match(ev) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// merge interleaves two lists of events, each in ID order, into one.
+func merge(a, b []Event) []Event {
+	if len(b) == 0 {
+		return a
+	}
+	merged := make([]Event, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0].ID < b[0].ID {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+)
+
+// ownersRefresh is how long which project owns each VM is cached for.
+const ownersRefresh = 5 * time.Second
+
+// Owners tells which project events belong to, so that event streams and webhooks only
+// carry a project's own events. Which project owns each VM is cached, and reloaded on the
+// next lookup once it's older than ownersRefresh, so a VM whose name was reused or that
+// was imported into another project moves with it. Events the API publishes for a VM,
+// such as vm.created, vm.imported and vm.deleted, move it straight away. VMs stay known
+// once deleted so their last events still reach their project.
+type Owners struct {
+	storage storage.Datastore
+
+	mu        sync.Mutex
+	projects  map[string]int
+	refreshed time.Time
+}
+
+// NewOwners creates an Owners that looks VMs up in db.
+func NewOwners(db storage.Datastore) *Owners {
+	return &Owners{storage: db, projects: make(map[string]int)}
+}
+
+// Project returns the project ev belongs to, going by its project if it has one and
+// otherwise by its VM. It returns 0 for events that belong to no project, such as those
+// about domains no project owns, or when the owner can't be looked up.
+func (o *Owners) Project(ctx context.Context, ev Event) int {
+	if ev.VMName == "" {
+		return ev.ProjectID
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if ev.ProjectID != 0 {
+		o.projects[ev.VMName] = ev.ProjectID
+		return ev.ProjectID
+	}
+	if time.Since(o.refreshed) < ownersRefresh {
+		return o.projects[ev.VMName]
+	}
+
+	projects, err := o.storage.ListVMProjects(ctx)
+	o.refreshed = time.Now()
+	if err != nil {
+		return o.projects[ev.VMName]
+	}
+	for name, id := range projects {
+		o.projects[name] = id
+	}
+	return o.projects[ev.VMName]
+}
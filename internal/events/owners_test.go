@@ -0,0 +1,81 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+)
+
+// vmProjects serves ListVMProjects from a map, counting calls. Any other Datastore method
+// panics through the nil embedded interface.
+type vmProjects struct {
+	storage.Datastore
+	projects map[string]int
+	calls    int
+}
+
+func (v *vmProjects) ListVMProjects(ctx context.Context) (map[string]int, error) {
+	v.calls++
+	out := make(map[string]int, len(v.projects))
+	for name, id := range v.projects {
+		out[name] = id
+	}
+	return out, nil
+}
+
+func TestOwnersProject(t *testing.T) {
+	db := &vmProjects{projects: map[string]int{"ck-web": 1, "ck-db": 2}}
+	owners := NewOwners(db)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		ev   Event
+		want int
+	}{
+		{"VM", Event{VMName: "ck-web"}, 1},
+		{"other VM", Event{VMName: "ck-db"}, 2},
+		{"operation without a VM", Event{ProjectID: 1}, 1},
+		{"project set on the event wins", Event{ProjectID: 2, VMName: "ck-web"}, 2},
+		{"unowned domain", Event{VMName: "ck-unmanaged"}, 0},
+		{"no project or VM", Event{}, 0},
+	}
+	for _, tt := range tests {
+		if got := owners.Project(ctx, tt.ev); got != tt.want {
+			t.Errorf("%s: Project = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if db.calls != 1 {
+		t.Errorf("ListVMProjects called %d times, want 1", db.calls)
+	}
+
+	// A deleted VM's last events still belong to its project.
+	delete(db.projects, "ck-db")
+	if got := owners.Project(ctx, Event{VMName: "ck-db"}); got != 2 {
+		t.Errorf("deleted VM: Project = %d, want 2", got)
+	}
+}
+
+func TestOwnersProjectMoves(t *testing.T) {
+	db := &vmProjects{projects: map[string]int{"ck-web": 1}}
+	owners := NewOwners(db)
+	ctx := context.Background()
+
+	if got := owners.Project(ctx, Event{VMName: "ck-web"}); got != 1 {
+		t.Fatalf("Project = %d, want 1", got)
+	}
+
+	// An event the API publishes moves the VM to its project straight away.
+	owners.Project(ctx, Event{ProjectID: 2, VMName: "ck-web"})
+	if got := owners.Project(ctx, Event{VMName: "ck-web"}); got != 2 {
+		t.Errorf("after an event for project 2: Project = %d, want 2", got)
+	}
+
+	// Otherwise it moves once the cache is reloaded.
+	db.projects["ck-web"] = 3
+	owners.refreshed = owners.refreshed.Add(-ownersRefresh)
+	if got := owners.Project(ctx, Event{VMName: "ck-web"}); got != 3 {
+		t.Errorf("after a reload: Project = %d, want 3", got)
+	}
+}
@@ -0,0 +1,89 @@
+// Package events keeps stored VM state in step with libvirt's lifecycle notifications and
+// fans cloudkit events out to anyone streaming them.
+package events
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	minResubscribeDelay = 1 * time.Second
+	maxResubscribeDelay = 1 * time.Minute
+)
+
+// Watcher subscribes to VM lifecycle events and keeps each VM's stored state and state
+// history current as soon as libvirt reports a change, rather than waiting for a poll.
+type Watcher struct {
+	manager cloudkit.VMController
+	storage storage.Datastore
+	broker  *Broker
+	logger  *logrus.Logger
+}
+
+// NewWatcher creates a Watcher. Call Run to start it.
+func NewWatcher(ckm cloudkit.VMController, db storage.Datastore, b *Broker, log *logrus.Logger) *Watcher {
+	return &Watcher{manager: ckm, storage: db, broker: b, logger: log}
+}
+
+// Run handles events until ctx is cancelled. If the subscription fails or the event
+// stream closes it subscribes again, backing off up to maxResubscribeDelay, or as soon
+// as libvirt is reconnected if the connection was lost.
+func (w *Watcher) Run(ctx context.Context) {
+	delay := minResubscribeDelay
+	for {
+		events, err := w.manager.LifecycleEvents(ctx)
+		if errors.Is(err, cloudkit.ErrDisconnected) {
+			// Subscribe again as soon as libvirt is back rather than after backing off.
+			w.logger.Warn("libvirt is disconnected, waiting to resubscribe to VM lifecycle events")
+			if w.manager.WaitConnected(ctx) != nil {
+				return
+			}
+			delay = minResubscribeDelay
+			continue
+		}
+		if err != nil {
+			w.logger.Errorf("failed to subscribe to VM lifecycle events, retrying in %s, err: %+v", delay, err)
+		} else {
+			delay = minResubscribeDelay
+			if done := w.consume(ctx, events); done {
+				return
+			}
+			w.logger.Warn("VM lifecycle event stream closed, resubscribing")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxResubscribeDelay {
+			delay = maxResubscribeDelay
+		}
+	}
+}
+
+// consume handles events until the stream closes or ctx is cancelled, returning true
+// in the latter case.
+func (w *Watcher) consume(ctx context.Context, events <-chan cloudkit.VMEvent) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case ev, ok := <-events:
+			if !ok {
+				return false
+			}
+			w.logger.Infof("VM %s: %s (%s), now %s", ev.VMName, ev.Type, ev.Reason, ev.State)
+			if err := w.storage.RecordVMEvent(ctx, ev); err != nil {
+				w.logger.Errorf("failed to record VM event, err: %+v", err)
+			}
+			w.broker.Publish(ev.Type, ev.VMName, ev)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Package hostcreds holds what cloudkit needs to SSH into hypervisor hosts safely: the
+// key it authenticates with, from a secrets file or an ssh-agent, and the host keys it
+// expects each host to present, trusted on first use or pinned by an admin.
+package hostcreds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// storeTimeout bounds looking up or recording a host key during a handshake.
+const storeTimeout = 10 * time.Second
+
+// Key is a host key cloudkit accepts from a host.
+type Key struct {
+	// Host is the host:port the key was presented on.
+	Host string `json:"host"`
+	Type string `json:"type"`
+	// PublicKey is the key in authorized_keys format.
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+	// Pinned is true when an admin set the key, rather than it being trusted on first use.
+	Pinned  bool      `json:"pinned"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// NewKey describes pub as a key for host.
+func NewKey(host string, pub ssh.PublicKey, pinned bool) Key {
+	return Key{
+		Host:        knownhosts.Normalize(host),
+		Type:        pub.Type(),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Pinned:      pinned,
+	}
+}
+
+// Store keeps the host keys cloudkit has trusted.
+type Store interface {
+	// ListHostKeys returns the keys known for host, or for every host if host is empty.
+	ListHostKeys(ctx context.Context, host string) ([]Key, error)
+	// TrustHostKey stores key only if its host has no keys yet, reporting whether it did.
+	TrustHostKey(ctx context.Context, key Key) (bool, error)
+}
+
+// MismatchError is returned when a host presents a key other than the ones cloudkit
+// knows for it, which means it was reinstalled or someone is intercepting the connection.
+type MismatchError struct {
+	Host        string
+	Fingerprint string
+	Known       []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: it presented %s but cloudkit expects %s; "+
+		"if the host was reinstalled, pin its new key with PUT /api/v1/host-keys/%s",
+		e.Host, e.Fingerprint, strings.Join(e.Known, " or "), e.Host)
+}
+
+// ErrUnknownHost is returned for a host with no known keys when trust on first use is off.
+var ErrUnknownHost = errors.New("no host key is known for this host and trust on first use is disabled")
+
+// Credentials authenticates cloudkit to hosts and verifies their host keys.
+type Credentials struct {
+	store  Store
+	logger *logrus.Logger
+
+	signer    ssh.Signer
+	agentSock string
+	pinned    ssh.PublicKey
+	tofu      bool
+}
+
+// New loads the private key, or locates the ssh-agent, that cfg names. Host keys are
+// checked against cfg's pinned key if it has one and against store otherwise.
+func New(cfg config.Host, store Store, log *logrus.Logger) (*Credentials, error) {
+	c := &Credentials{store: store, logger: log, tofu: cfg.TrustOnFirstUse}
+
+	if cfg.SSHAgent {
+		c.agentSock = os.Getenv("SSH_AUTH_SOCK")
+		if c.agentSock == "" {
+			return nil, errors.New("hostcreds: host.ssh_agent is set but SSH_AUTH_SOCK isn't")
+		}
+	} else {
+		signer, err := loadSigner(cfg.SSHKeyPath, cfg.SSHKeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("hostcreds: %w", err)
+		}
+		c.signer = signer
+	}
+
+	if cfg.SSHHostKey != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.SSHHostKey))
+		if err != nil {
+			return nil, fmt.Errorf("hostcreds: parsing host.ssh_host_key: %w", err)
+		}
+		c.pinned = pub
+	}
+
+	return c, nil
+}
+
+// loadSigner reads a private key from path, decrypting it with the passphrase in
+// passphrasePath if that's set.
+func loadSigner(path, passphrasePath string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if passphrasePath == "" {
+		return ssh.ParsePrivateKey(key)
+	}
+	passphrase, err := ioutil.ReadFile(passphrasePath)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, []byte(strings.TrimRight(string(passphrase), "\r\n")))
+}
+
+// Auth returns how to authenticate for one connection. Call done once the connection is
+// closed.
+func (c *Credentials) Auth() (method ssh.AuthMethod, done func(), err error) {
+	if c.signer != nil {
+		return ssh.PublicKeys(c.signer), func() {}, nil
+	}
+	conn, err := net.Dial("unix", c.agentSock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("hostcreds: connecting to ssh-agent: %w", err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), func() { conn.Close() }, nil
+}
+
+// HostKeyCallback verifies host keys for handshakes made on behalf of ctx.
+func (c *Credentials) HostKeyCallback(ctx context.Context) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, pub ssh.PublicKey) error {
+		host := knownhosts.Normalize(hostname)
+		got := ssh.FingerprintSHA256(pub)
+
+		if c.pinned != nil {
+			if got != ssh.FingerprintSHA256(c.pinned) {
+				return &MismatchError{Host: host, Fingerprint: got, Known: []string{ssh.FingerprintSHA256(c.pinned)}}
+			}
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+		defer cancel()
+
+		known, err := c.store.ListHostKeys(ctx, host)
+		if err != nil {
+			return fmt.Errorf("hostcreds: looking up host keys for %s: %w", host, err)
+		}
+		if len(known) == 0 {
+			if !c.tofu {
+				return fmt.Errorf("%s: %w", host, ErrUnknownHost)
+			}
+			trusted, err := c.store.TrustHostKey(ctx, NewKey(host, pub, false))
+			if err != nil {
+				return fmt.Errorf("hostcreds: storing host key for %s: %w", host, err)
+			}
+			if trusted {
+				c.logger.Warnf("trusting %s host key %s for %s on first use", pub.Type(), got, host)
+				return nil
+			}
+			// Another connection trusted a key first; check against that one.
+			if known, err = c.store.ListHostKeys(ctx, host); err != nil {
+				return fmt.Errorf("hostcreds: looking up host keys for %s: %w", host, err)
+			}
+		}
+
+		fingerprints := make([]string, 0, len(known))
+		for _, k := range known {
+			if k.Fingerprint == got {
+				return nil
+			}
+			fingerprints = append(fingerprints, k.Fingerprint)
+		}
+		return &MismatchError{Host: host, Fingerprint: got, Known: fingerprints}
+	}
+}
@@ -0,0 +1,258 @@
+// Package metrics exposes cloudkit's per-VM stats and its own process metrics in the
+// Prometheus exposition format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloudkit"
+
+// vmStates are every state a VM can report. cloudkit_vm_state is exported as one series
+// per state with the current one set to 1, which keeps it easy to alert on.
+var vmStates = []string{
+	"unknown", "running", "blocked", "paused", "shutting down", "off", "crashed", "pm suspended",
+}
+
+var (
+	vmMemUsage       = vmDesc("memory_usage_percent", "Percentage of usable guest memory in use.")
+	vmMemActual      = vmDesc("memory_actual_balloon_bytes", "Current balloon size.")
+	vmMemSwapIn      = vmDesc("memory_swap_in_bytes_total", "Memory swapped in by the guest.")
+	vmMemSwapOut     = vmDesc("memory_swap_out_bytes_total", "Memory swapped out by the guest.")
+	vmMemMajorFaults = vmDesc("memory_major_faults_total", "Page faults that required disk IO.")
+	vmMemMinorFaults = vmDesc("memory_minor_faults_total", "Page faults served from memory.")
+	vmCPUTime        = vmDesc("cpu_time_seconds_total", "CPU time consumed across all vCPUs.")
+	vmVCPUs          = vmDesc("vcpus", "Number of online vCPUs.")
+	vmState          = vmDesc("state", "Current VM state.", "state")
+	vmDiskRdBytes    = vmDesc("disk_read_bytes_total", "Bytes read from a disk.", "device")
+	vmDiskWrBytes    = vmDesc("disk_write_bytes_total", "Bytes written to a disk.", "device")
+	vmDiskRdReqs     = vmDesc("disk_read_requests_total", "Read requests issued to a disk.", "device")
+	vmDiskWrReqs     = vmDesc("disk_write_requests_total", "Write requests issued to a disk.", "device")
+	vmNetRxBytes     = vmDesc("network_receive_bytes_total", "Bytes received on an interface.", "interface")
+	vmNetTxBytes     = vmDesc("network_transmit_bytes_total", "Bytes transmitted on an interface.", "interface")
+	vmNetRxPackets   = vmDesc("network_receive_packets_total", "Packets received on an interface.", "interface")
+	vmNetTxPackets   = vmDesc("network_transmit_packets_total", "Packets transmitted on an interface.", "interface")
+)
+
+func vmDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "vm", name),
+		help,
+		append([]string{"vm", "host"}, labels...),
+		nil,
+	)
+}
+
+// vmSample is the latest data the monitor has seen for a VM.
+type vmSample struct {
+	mem      *cloudkit.MemStats
+	memUsage float64
+	stats    *cloudkit.DomainStats
+}
+
+// Collector keeps the latest sample of every VM for Prometheus to scrape and records
+// latency histograms for the API, libvirt and the VM monitor.
+type Collector struct {
+	host     string
+	registry *prometheus.Registry
+
+	apiLatency     *prometheus.HistogramVec
+	libvirtLatency *prometheus.HistogramVec
+	monitorCycle   prometheus.Histogram
+	droppedEvents  *prometheus.CounterVec
+
+	mu  sync.Mutex
+	vms map[string]*vmSample
+}
+
+// New creates a Collector for VMs running on host and registers it, along with the Go
+// runtime and process collectors, on its own registry.
+func New(host string) *Collector {
+	c := &Collector{
+		host:     host,
+		registry: prometheus.NewRegistry(),
+		vms:      make(map[string]*vmSample),
+		apiLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "Latency of API requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		libvirtLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "libvirt_rpc_duration_seconds",
+			Help:      "Latency of libvirt RPC calls by procedure.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"procedure", "result"}),
+		monitorCycle: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "monitor_cycle_duration_seconds",
+			Help:      "Time taken by one pass of the VM monitor.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		droppedEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "libvirt_events_dropped_total",
+			Help:      "Lifecycle events dropped because their subscriber fell behind, by type.",
+		}, []string{"type"}),
+	}
+
+	c.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		c.apiLatency,
+		c.libvirtLatency,
+		c.monitorCycle,
+		c.droppedEvents,
+		c,
+	)
+
+	return c
+}
+
+// Handler serves everything registered on the collector's registry.
+func (c *Collector) Handler() http.Handler {
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveAPIRequest records how long an API request took.
+func (c *Collector) ObserveAPIRequest(route, method string, code int, d time.Duration) {
+	c.apiLatency.WithLabelValues(route, method, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// ObserveLibvirtCall records how long a libvirt RPC took. It satisfies cloudkit.RPCObserver.
+func (c *Collector) ObserveLibvirtCall(procedure string, d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	c.libvirtLatency.WithLabelValues(procedure, result).Observe(d.Seconds())
+}
+
+// ObserveDroppedEvent counts a lifecycle event dropped because its subscriber fell
+// behind. It satisfies cloudkit.RPCObserver.
+func (c *Collector) ObserveDroppedEvent(eventType string) {
+	c.droppedEvents.WithLabelValues(eventType).Inc()
+}
+
+// ObserveMonitorCycle records how long one pass of the VM monitor took.
+func (c *Collector) ObserveMonitorCycle(d time.Duration) {
+	c.monitorCycle.Observe(d.Seconds())
+}
+
+// SetVMMemory stores the latest memory stats for a VM.
+func (c *Collector) SetVMMemory(name string, ms cloudkit.MemStats, usage float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.sample(name)
+	s.mem = &ms
+	s.memUsage = usage
+}
+
+// SetVMStats stores the latest CPU, disk and network counters for a VM.
+func (c *Collector) SetVMStats(ds cloudkit.DomainStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sample(ds.Name).stats = &ds
+}
+
+// RetainVMs forgets every VM not in names so that deleted VMs stop being exported.
+func (c *Collector) RetainVMs(names map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.vms {
+		if !names[name] {
+			delete(c.vms, name)
+		}
+	}
+}
+
+func (c *Collector) sample(name string) *vmSample {
+	s, ok := c.vms[name]
+	if !ok {
+		s = &vmSample{}
+		c.vms[name] = s
+	}
+	return s
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		vmMemUsage, vmMemActual, vmMemSwapIn, vmMemSwapOut, vmMemMajorFaults, vmMemMinorFaults,
+		vmCPUTime, vmVCPUs, vmState, vmDiskRdBytes, vmDiskWrBytes, vmDiskRdReqs, vmDiskWrReqs,
+		vmNetRxBytes, vmNetTxBytes, vmNetRxPackets, vmNetTxPackets,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector by emitting the latest sample of every VM.
+// libvirt reports memory in KiB, which is converted to bytes here.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, labels...)
+	}
+
+	for name, s := range c.vms {
+		if ms := s.mem; ms != nil {
+			gauge(vmMemUsage, s.memUsage, name, c.host)
+			if ms.Has(libvirt.DomainMemoryStatActualBalloon) {
+				gauge(vmMemActual, float64(ms.Actual)*1024, name, c.host)
+			}
+			if ms.Has(libvirt.DomainMemoryStatSwapIn) {
+				counter(vmMemSwapIn, float64(ms.SwapIn)*1024, name, c.host)
+			}
+			if ms.Has(libvirt.DomainMemoryStatSwapOut) {
+				counter(vmMemSwapOut, float64(ms.SwapOut)*1024, name, c.host)
+			}
+			if ms.Has(libvirt.DomainMemoryStatMajorFault) {
+				counter(vmMemMajorFaults, float64(ms.MajorFault), name, c.host)
+			}
+			if ms.Has(libvirt.DomainMemoryStatMinorFault) {
+				counter(vmMemMinorFaults, float64(ms.MinorFault), name, c.host)
+			}
+		}
+
+		ds := s.stats
+		if ds == nil {
+			continue
+		}
+
+		counter(vmCPUTime, float64(ds.CPUTime)/float64(time.Second), name, c.host)
+		gauge(vmVCPUs, float64(ds.VCPUs), name, c.host)
+		for _, state := range vmStates {
+			v := 0.0
+			if state == ds.State {
+				v = 1
+			}
+			gauge(vmState, v, name, c.host, state)
+		}
+		for _, d := range ds.Disks {
+			counter(vmDiskRdBytes, float64(d.RdBytes), name, c.host, d.Name)
+			counter(vmDiskWrBytes, float64(d.WrBytes), name, c.host, d.Name)
+			counter(vmDiskRdReqs, float64(d.RdReqs), name, c.host, d.Name)
+			counter(vmDiskWrReqs, float64(d.WrReqs), name, c.host, d.Name)
+		}
+		for _, n := range ds.Interfaces {
+			counter(vmNetRxBytes, float64(n.RxBytes), name, c.host, n.Name)
+			counter(vmNetTxBytes, float64(n.TxBytes), name, c.host, n.Name)
+			counter(vmNetRxPackets, float64(n.RxPackets), name, c.host, n.Name)
+			counter(vmNetTxPackets, float64(n.TxPackets), name, c.host, n.Name)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+// Package monitor periodically scrapes resource usage from every running VM and persists
+// it to storage.
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/metrics"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/sirupsen/logrus"
+)
+
+// Config controls how often and how aggressively the monitor polls VMs.
+type Config struct {
+	// Interval is the time between monitor passes.
+	Interval time.Duration
+	// Workers caps how many VMs are polled at once.
+	Workers int
+	// VMTimeout bounds the time spent polling a single VM, retries included.
+	VMTimeout time.Duration
+	// Attempts is how many times a failing libvirt call is tried before giving up.
+	Attempts int
+	// Backoff is the delay before the first retry. It doubles on every retry after that.
+	Backoff time.Duration
+	// RollupInterval is the time between measurement rollups.
+	RollupInterval time.Duration
+}
+
+// DefaultConfig polls once a minute with a handful of workers.
+func DefaultConfig() Config {
+	return Config{
+		Interval:       1 * time.Minute,
+		Workers:        8,
+		VMTimeout:      15 * time.Second,
+		Attempts:       3,
+		Backoff:        250 * time.Millisecond,
+		RollupInterval: 1 * time.Hour,
+	}
+}
+
+// Health values reported in Status.
+const (
+	HealthPending  = "pending"
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFailing  = "failing"
+)
+
+// Status describes the most recent monitor pass.
+type Status struct {
+	Health    string    `json:"health"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastEnd   time.Time `json:"last_end,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+	VMsPolled int       `json:"vms_polled"`
+	VMsFailed int       `json:"vms_failed"`
+	// VMsUnmanaged counts domains cloudkit doesn't manage. They're exported to Prometheus
+	// but nothing is stored for them, and they don't affect Health.
+	VMsUnmanaged int       `json:"vms_unmanaged"`
+	Errors       []string  `json:"errors,omitempty"`
+	Interval     string    `json:"interval"`
+	StaleAfter   time.Time `json:"stale_after,omitempty"`
+
+	// hostErrors are the errors that aren't about a single VM and vms the outcome of
+	// polling each VM, nil on success or errUnmanaged, so the status can be narrowed with
+	// ForVMs.
+	hostErrors []string
+	vms        map[string]error
+}
+
+// ForVMs narrows the status to the VMs keep reports true for, leaving out the counts and
+// errors of every other VM. Errors that aren't about a single VM are kept. Health is
+// graded again from what's left, unless the pass is pending or failed before reaching any
+// VM, which is the same for every VM.
+func (s Status) ForVMs(keep func(name string) bool) Status {
+	names := make([]string, 0, len(s.vms))
+	for name := range s.vms {
+		if keep(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := s
+	out.VMsPolled, out.VMsFailed, out.VMsUnmanaged = 0, 0, 0
+	out.Errors = append([]string(nil), s.hostErrors...)
+	for _, name := range names {
+		switch err := s.vms[name]; {
+		case err == errUnmanaged:
+			out.VMsUnmanaged++
+		case err != nil:
+			out.VMsFailed++
+			out.Errors = append(out.Errors, fmt.Sprintf("%s: %v", name, err))
+		default:
+			out.VMsPolled++
+		}
+	}
+	if s.Health == HealthPending || (s.Health == HealthFailing && len(s.vms) == 0) {
+		return out
+	}
+	switch {
+	case out.VMsFailed > 0 && out.VMsPolled == 0:
+		out.Health = HealthFailing
+	case len(out.Errors) > 0:
+		out.Health = HealthDegraded
+	default:
+		out.Health = HealthOK
+	}
+	return out
+}
+
+// Healthy reports whether the last pass succeeded for at least some VMs and finished
+// recently enough that the monitor can be assumed to still be running.
+func (s Status) Healthy(now time.Time) bool {
+	if s.Health == HealthPending {
+		return true
+	}
+	return s.Health != HealthFailing && now.Before(s.StaleAfter)
+}
+
+// errUnmanaged is pollVM's result for a domain with no stored VM.
+var errUnmanaged = errors.New("domain isn't managed by cloudkit")
+
+// Sample is the data published to event subscribers for a VM after each poll. Either
+// field is nil when it couldn't be computed on this pass.
+type Sample struct {
+	Time   time.Time          `json:"time"`
+	Memory *cloudkit.MemUsage `json:"memory,omitempty"`
+	Usage  *cloudkit.VMUsage  `json:"usage,omitempty"`
+}
+
+// values flattens a sample into the metric names alert rules are written against. Disk
+// and network rates are summed across devices.
+func (s Sample) values() map[string]float64 {
+	v := make(map[string]float64)
+	if s.Memory != nil {
+		v["memory_usage"] = s.Memory.Usage
+	}
+	if u := s.Usage; u != nil {
+		v["cpu_usage"] = u.CPU.Usage
+		for _, d := range u.Disks {
+			v["disk_read_bytes_per_sec"] += d.ReadBytesPS
+			v["disk_write_bytes_per_sec"] += d.WriteBytesPS
+			v["disk_read_iops"] += d.ReadIOPS
+			v["disk_write_iops"] += d.WriteIOPS
+		}
+		for _, n := range u.Interfaces {
+			v["net_rx_bytes_per_sec"] += n.RxBytesPS
+			v["net_tx_bytes_per_sec"] += n.TxBytesPS
+			v["net_rx_packets_per_sec"] += n.RxPacketsPS
+			v["net_tx_packets_per_sec"] += n.TxPacketsPS
+		}
+	}
+	return v
+}
+
+// AlertEvaluator is handed the latest metric values for every VM, keyed by VM name then
+// metric name, at the end of each pass.
+type AlertEvaluator interface {
+	Evaluate(ctx context.Context, values map[string]map[string]float64, now time.Time)
+}
+
+// Monitor polls VMs for memory, CPU, disk and network stats.
+type Monitor struct {
+	manager cloudkit.VMController
+	storage storage.Datastore
+	metrics *metrics.Collector
+	events  *events.Broker
+	alerts  AlertEvaluator
+	logger  *logrus.Logger
+	cfg     Config
+
+	// lastStats holds the previous DomainStats sample for each running domain, by name, so
+	// that libvirt's cumulative counters can be turned into rates.
+	statsMu   sync.Mutex
+	lastStats map[string]cloudkit.DomainStats
+
+	statusMu sync.RWMutex
+	status   Status
+}
+
+// New creates a Monitor. Call Run to start it. ae may be nil to skip alert evaluation.
+func New(ckm cloudkit.VMController, db storage.Datastore, m *metrics.Collector, b *events.Broker, ae AlertEvaluator, cfg Config, log *logrus.Logger) *Monitor {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.Attempts < 1 {
+		cfg.Attempts = 1
+	}
+	return &Monitor{
+		manager:   ckm,
+		storage:   db,
+		metrics:   m,
+		events:    b,
+		alerts:    ae,
+		logger:    log,
+		cfg:       cfg,
+		lastStats: make(map[string]cloudkit.DomainStats),
+		status:    Status{Health: HealthPending, Interval: cfg.Interval.String()},
+	}
+}
+
+// Run polls every VM once per interval until ctx is cancelled. It blocks, so callers
+// usually start it in its own goroutine.
+func (m *Monitor) Run(ctx context.Context) {
+	pollTicker := time.NewTicker(m.cfg.Interval)
+	defer pollTicker.Stop()
+	rollupTicker := time.NewTicker(m.cfg.RollupInterval)
+	defer rollupTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.logger.Info("VM monitor stopped")
+			return
+		case <-pollTicker.C:
+			m.runOnce(ctx)
+		case now := <-rollupTicker.C:
+			if err := m.storage.RollupMeasurements(ctx, now); err != nil {
+				m.logger.Errorf("failed to roll up measurements, err: %+v", err)
+			}
+		}
+	}
+}
+
+// Status returns the outcome of the most recent pass.
+func (m *Monitor) Status() Status {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	return m.status
+}
+
+// runOnce polls every running VM using a bounded pool of workers and records the
+// outcome in the monitor's Status.
+func (m *Monitor) runOnce(ctx context.Context) {
+	start := time.Now()
+	st := Status{LastStart: start, Interval: m.cfg.Interval.String(), vms: make(map[string]error)}
+	defer func() {
+		st.LastEnd = time.Now()
+		st.Duration = st.LastEnd.Sub(start).String()
+		st.StaleAfter = st.LastEnd.Add(2 * m.cfg.Interval)
+		m.metrics.ObserveMonitorCycle(st.LastEnd.Sub(start))
+
+		m.statusMu.Lock()
+		m.status = st
+		m.statusMu.Unlock()
+	}()
+
+	var domains []libvirt.Domain
+	err := m.retry(ctx, func() (err error) {
+		domains, err = m.manager.GetRunningDomains(ctx)
+		return err
+	})
+	if err != nil {
+		m.logger.Errorf("failed to get running domains, err: %+v", err)
+		st.Health = HealthFailing
+		st.hostErrors = []string{err.Error()}
+		st.Errors = st.hostErrors
+		return
+	}
+
+	// CPU, disk and network counters for every domain come back from one bulk call. If it
+	// fails we still poll memory per VM rather than skipping the whole pass.
+	stats := make(map[int]cloudkit.DomainStats, len(domains))
+	var bulk []cloudkit.DomainStats
+	err = m.retry(ctx, func() (err error) {
+		bulk, err = m.manager.GetDomainStats(ctx, domains)
+		return err
+	})
+	if err != nil {
+		m.logger.Errorf("failed to acquire domain stats, err: %+v", err)
+		st.hostErrors = append(st.hostErrors, err.Error())
+	}
+	for _, ds := range bulk {
+		stats[ds.DomainID] = ds
+	}
+
+	jobs := make(chan libvirt.Domain)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		samples = make(map[string]map[string]float64, len(domains))
+	)
+	for i := 0; i < m.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				ds, ok := stats[int(domain.ID)]
+				sample, err := m.pollVM(ctx, domain, ds, ok)
+				mu.Lock()
+				if err != nil && err != errUnmanaged {
+					m.logger.Errorf("failed to poll VM %s, err: %+v", domain.Name, err)
+				}
+				st.vms[domain.Name] = err
+				if v := sample.values(); len(v) > 0 {
+					samples[domain.Name] = v
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, domain := range domains {
+		select {
+		case jobs <- domain:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	m.forgetMissing(domains)
+
+	if m.alerts != nil {
+		m.alerts.Evaluate(ctx, samples, time.Now())
+	}
+
+	// Domains never handed to a worker because ctx was cancelled count as neither.
+	all := st.ForVMs(func(string) bool { return true })
+	st.Health, st.VMsPolled, st.VMsFailed, st.VMsUnmanaged, st.Errors = all.Health, all.VMsPolled, all.VMsFailed, all.VMsUnmanaged, all.Errors
+}
+
+// pollVM records memory usage for a single VM and, when a bulk stats sample is available,
+// its CPU, disk and network rates, returning what it recorded. Measurements are stored
+// against the VM with the domain's name rather than its domain ID, which libvirt reuses.
+// Domains without a stored VM are only exported to Prometheus, returning errUnmanaged.
+// It gives up once cfg.VMTimeout has elapsed.
+func (m *Monitor) pollVM(ctx context.Context, domain libvirt.Domain, ds cloudkit.DomainStats, hasStats bool) (sample Sample, err error) {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.VMTimeout)
+	defer cancel()
+
+	vmID, err := m.storage.GetVMIDByName(ctx, domain.Name)
+	unmanaged := err == storage.ErrNotFound
+	if err != nil && !unmanaged {
+		return sample, fmt.Errorf("looking up VM: %w", err)
+	}
+
+	var rStats []libvirt.DomainMemoryStat
+	err = m.retry(ctx, func() (err error) {
+		rStats, err = m.manager.DomainMemoryStats(ctx, domain, cloudkit.MaxStats, 0)
+		return err
+	})
+	if err != nil {
+		return sample, fmt.Errorf("acquiring memory stats: %w", err)
+	}
+
+	ms, err := cloudkit.NewMemStats(rStats)
+	if err != nil {
+		return sample, fmt.Errorf("unmarshalling memory stats: %w", err)
+	}
+
+	sample = Sample{Time: time.Now()}
+	if usage, ok := ms.Usage(); ok {
+		sample.Memory = &cloudkit.MemUsage{Time: sample.Time.Format(time.RFC3339), Usage: usage}
+		m.metrics.SetVMMemory(domain.Name, ms, usage)
+	} else {
+		m.logger.Warnf("domain %s reported no usable memory stats, skipping", domain.Name)
+	}
+	if hasStats {
+		m.metrics.SetVMStats(ds)
+	}
+	if unmanaged {
+		return Sample{}, errUnmanaged
+	}
+
+	if sample.Memory != nil {
+		if err := m.storage.RecordVMMemory(ctx, vmID, sample.Memory.Usage); err != nil {
+			return sample, fmt.Errorf("recording memory: %w", err)
+		}
+	}
+	defer func() { m.events.Publish(events.TypeMetricsSample, domain.Name, sample) }()
+
+	if !hasStats {
+		return sample, nil
+	}
+
+	m.statsMu.Lock()
+	prev, seen := m.lastStats[domain.Name]
+	m.lastStats[domain.Name] = ds
+	m.statsMu.Unlock()
+
+	// The first sample for a domain only primes the rate calculation.
+	if !seen {
+		return sample, nil
+	}
+	usage, ok := ds.Usage(prev)
+	if !ok {
+		return sample, nil
+	}
+	sample.Usage = &usage
+	if err := m.storage.RecordVMUsage(ctx, vmID, usage); err != nil {
+		return sample, fmt.Errorf("recording usage: %w", err)
+	}
+
+	return sample, nil
+}
+
+// forgetMissing drops state for domains that went away, so a reused name starts fresh and
+// deleted VMs stop being exported to Prometheus.
+func (m *Monitor) forgetMissing(domains []libvirt.Domain) {
+	names := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		names[d.Name] = true
+	}
+
+	m.statsMu.Lock()
+	for name := range m.lastStats {
+		if !names[name] {
+			delete(m.lastStats, name)
+		}
+	}
+	m.statsMu.Unlock()
+
+	m.metrics.RetainVMs(names)
+}
+
+// retry calls fn up to cfg.Attempts times, doubling the wait between attempts, and
+// stops early if ctx is done.
+func (m *Monitor) retry(ctx context.Context, fn func() error) error {
+	var err error
+	delay := m.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= m.cfg.Attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/metrics"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeLibvirt runs domains that all report half their memory used. Any other
+// VMController method panics through the nil embedded interface.
+type fakeLibvirt struct {
+	cloudkit.VMController
+	domains []libvirt.Domain
+}
+
+func (f *fakeLibvirt) GetRunningDomains(ctx context.Context) ([]libvirt.Domain, error) {
+	return f.domains, nil
+}
+
+func (f *fakeLibvirt) GetDomainStats(ctx context.Context, domains []libvirt.Domain) ([]cloudkit.DomainStats, error) {
+	return nil, nil
+}
+
+func (f *fakeLibvirt) DomainMemoryStats(ctx context.Context, d libvirt.Domain, maxStats, flags uint32) ([]libvirt.DomainMemoryStat, error) {
+	return []libvirt.DomainMemoryStat{
+		{Tag: int32(libvirt.DomainMemoryStatAvailable), Val: 1024},
+		{Tag: int32(libvirt.DomainMemoryStatUsable), Val: 512},
+	}, nil
+}
+
+// fakeStore knows VMs by name and records which of them memory was stored for.
+type fakeStore struct {
+	storage.Datastore
+	ids    map[string]int
+	memory map[int]float64
+}
+
+func (f *fakeStore) GetVMIDByName(ctx context.Context, name string) (int, error) {
+	id, ok := f.ids[name]
+	if !ok {
+		return 0, storage.ErrNotFound
+	}
+	return id, nil
+}
+
+func (f *fakeStore) RecordVMMemory(ctx context.Context, vmID int, usage float64) error {
+	f.memory[vmID] = usage
+	return nil
+}
+
+func TestRunOnceUnmanagedDomains(t *testing.T) {
+	// The managed VM's domain ID is one its stored row doesn't have; measurements follow
+	// the name.
+	lv := &fakeLibvirt{domains: []libvirt.Domain{{Name: "web", ID: 12}, {Name: "stray", ID: 3}}}
+	db := &fakeStore{ids: map[string]int{"web": 7}, memory: map[int]float64{}}
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	m := New(lv, db, metrics.New("test"), events.NewBroker(16), nil, DefaultConfig(), log)
+
+	m.runOnce(context.Background())
+
+	st := m.Status()
+	if st.Health != HealthOK || st.VMsPolled != 1 || st.VMsFailed != 0 || st.VMsUnmanaged != 1 || len(st.Errors) != 0 {
+		t.Errorf("Status() = %+v, want ok with one VM polled and one unmanaged", st)
+	}
+	if len(db.memory) != 1 || db.memory[7] != 50 {
+		t.Errorf("stored memory %v, want only VM 7 at 50%%", db.memory)
+	}
+}
+
+func TestForVMsHealth(t *testing.T) {
+	st := Status{
+		Health: HealthDegraded,
+		vms: map[string]error{
+			"mine":   nil,
+			"theirs": errors.New("connection reset"),
+			"stray":  errUnmanaged,
+		},
+	}
+
+	mine := st.ForVMs(func(name string) bool { return name == "mine" })
+	if mine.Health != HealthOK || mine.VMsPolled != 1 || len(mine.Errors) != 0 {
+		t.Errorf("ForVMs(mine) = %+v, want ok without errors", mine)
+	}
+	theirs := st.ForVMs(func(name string) bool { return name == "theirs" })
+	if theirs.Health != HealthFailing || theirs.VMsFailed != 1 {
+		t.Errorf("ForVMs(theirs) = %+v, want failing", theirs)
+	}
+
+	// A pass that couldn't list domains failed for everyone.
+	down := Status{Health: HealthFailing, hostErrors: []string{"libvirt is down"}, vms: map[string]error{}}
+	if got := down.ForVMs(func(string) bool { return true }); got.Health != HealthFailing {
+		t.Errorf("ForVMs() of a pass that listed no domains = %+v, want failing", got)
+	}
+}
@@ -0,0 +1,211 @@
+// Package reconciler periodically compares libvirt's domains, running or not, with the VMs
+// cloudkit has stored, repairing drift that lifecycle events alone can miss: VMs whose
+// domains disappeared while cloudkit wasn't listening, and domains nobody manages.
+package reconciler
+
+import (
+	"context"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// pageSize is how many stored VMs are loaded per query during a pass.
+const pageSize = 500
+
+// Config controls how often the reconciler runs.
+type Config struct {
+	// Interval is the time between reconciliation passes.
+	Interval time.Duration
+}
+
+// DefaultConfig reconciles once a minute.
+func DefaultConfig() Config {
+	return Config{Interval: 1 * time.Minute}
+}
+
+// Reconciler keeps the vms table in step with libvirt.
+type Reconciler struct {
+	manager cloudkit.VMController
+	storage storage.Datastore
+	broker  *events.Broker
+	logger  *logrus.Logger
+	cfg     Config
+}
+
+// NewReconciler creates a Reconciler. Call Run to start it.
+func NewReconciler(ckm cloudkit.VMController, db storage.Datastore, b *events.Broker, cfg Config, log *logrus.Logger) *Reconciler {
+	return &Reconciler{manager: ckm, storage: db, broker: b, logger: log, cfg: cfg}
+}
+
+// Run reconciles once straight away and then every Interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce makes a single reconciliation pass.
+func (r *Reconciler) runOnce(ctx context.Context) {
+	// Load stored VMs before asking libvirt for domains. A VM created in between is then
+	// briefly seen as unmanaged, which the next pass corrects, rather than marked lost.
+	records, err := r.storedVMs(ctx)
+	if err != nil {
+		r.logger.Errorf("reconciler failed to load stored VMs, err: %+v", err)
+		return
+	}
+
+	domains, err := r.manager.GetDomains(ctx)
+	if err != nil {
+		r.logger.Errorf("reconciler failed to list domains, err: %+v", err)
+		return
+	}
+	// Domains that can't be described are still known to exist, so they're neither marked
+	// lost nor synced this pass.
+	listed := make(map[string]bool, len(domains))
+	live := make(map[string]cloudkit.VM, len(domains))
+	for _, d := range domains {
+		listed[d.Name] = true
+		vm, err := r.manager.DescribeDomain(ctx, d)
+		if err != nil {
+			r.logger.Errorf("reconciler failed to describe domain %s, skipping it, err: %+v", d.Name, err)
+			continue
+		}
+		live[d.Name] = vm
+	}
+
+	managed := make(map[string]bool, len(records))
+	for _, rec := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		managed[rec.Name] = true
+
+		if vm, ok := live[rec.Name]; ok {
+			r.sync(ctx, rec, vm)
+			continue
+		}
+		if listed[rec.Name] || rec.State == cloudkit.StateLost {
+			continue
+		}
+		r.checkMissing(ctx, rec)
+	}
+
+	var unmanaged []storage.UnmanagedDomain
+	for _, d := range domains {
+		if managed[d.Name] {
+			continue
+		}
+		u := storage.UnmanagedDomain{Name: d.Name, DomainID: int(d.ID), State: "unknown"}
+		if vm, ok := live[d.Name]; ok {
+			u.Host, u.State = vm.Host, vm.State
+		}
+		unmanaged = append(unmanaged, u)
+	}
+	added, err := r.storage.SyncUnmanagedDomains(ctx, unmanaged)
+	if err != nil {
+		r.logger.Errorf("reconciler failed to store unmanaged domains, err: %+v", err)
+		return
+	}
+	for _, d := range added {
+		r.logger.Warnf("domain %s on %s isn't managed by cloudkit; import it into a project to manage it", d.Name, d.Host)
+		r.broker.Publish(cloudkit.EventVMUnmanaged, d.Name, d)
+	}
+}
+
+// checkMissing looks up a stored VM libvirt didn't list by name, marking it lost only if
+// libvirt says there's no such domain. Any other failure leaves it for the next pass.
+func (r *Reconciler) checkMissing(ctx context.Context, rec storage.VMRecord) {
+	vm, err := r.manager.GetVMByName(ctx, rec.Name)
+	switch {
+	case apperr.Is(err, apperr.NotFound):
+		r.markLost(ctx, rec)
+	case err != nil:
+		r.logger.Errorf("reconciler failed to look up domain %s, err: %+v", rec.Name, err)
+	default:
+		r.sync(ctx, rec, vm)
+	}
+}
+
+// storedVMs pages through every VM that hasn't been deleted.
+func (r *Reconciler) storedVMs(ctx context.Context) ([]storage.VMRecord, error) {
+	var (
+		all   []storage.VMRecord
+		after int
+	)
+	for {
+		page, err := r.storage.ListVMs(ctx, storage.VMFilter{AfterID: after, Limit: pageSize})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < pageSize {
+			return all, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// markLost records that a stored VM's domain is gone from libvirt.
+func (r *Reconciler) markLost(ctx context.Context, rec storage.VMRecord) {
+	ev := cloudkit.VMEvent{
+		Type:     cloudkit.EventVMLost,
+		VMName:   rec.Name,
+		DomainID: -1,
+		State:    cloudkit.StateLost,
+		Reason:   "domain not found in libvirt",
+		Time:     time.Now(),
+	}
+	r.logger.Warnf("VM %s: domain not found in libvirt, marking it lost", rec.Name)
+	r.record(ctx, ev)
+}
+
+// sync brings a stored VM's state, domain ID, host and IP in line with libvirt.
+func (r *Reconciler) sync(ctx context.Context, rec storage.VMRecord, vm cloudkit.VM) {
+	if rec.State != vm.State || rec.DomainID != vm.DomainID {
+		ev := cloudkit.VMEvent{
+			Type:     cloudkit.EventVMReconciled,
+			VMName:   rec.Name,
+			DomainID: vm.DomainID,
+			State:    vm.State,
+			Reason:   "stored state was " + rec.State,
+			Time:     time.Now(),
+		}
+		r.logger.Infof("VM %s: stored state %s doesn't match libvirt's %s, updating it", rec.Name, rec.State, vm.State)
+		r.record(ctx, ev)
+	}
+
+	var u storage.VMUpdate
+	if vm.Host != "" && vm.Host != rec.Host {
+		u.Host = &vm.Host
+	}
+	if vm.IP != "pending" && vm.IP != rec.IP {
+		u.IP = &vm.IP
+	}
+	if u.Host == nil && u.IP == nil {
+		return
+	}
+	if err := r.storage.UpdateVM(ctx, rec.ID, u); err != nil && err != storage.ErrNotFound {
+		r.logger.Errorf("reconciler failed to update VM %s, err: %+v", rec.Name, err)
+	}
+}
+
+func (r *Reconciler) record(ctx context.Context, ev cloudkit.VMEvent) {
+	if err := r.storage.RecordVMEvent(ctx, ev); err != nil {
+		r.logger.Errorf("reconciler failed to record VM event, err: %+v", err)
+		return
+	}
+	r.broker.Publish(ev.Type, ev.VMName, ev)
+}
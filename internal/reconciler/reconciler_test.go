@@ -0,0 +1,106 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeLibvirt lists domains, failing to describe or look up the ones in broken. Any
+// other VMController method panics through the nil embedded interface.
+type fakeLibvirt struct {
+	cloudkit.VMController
+	domains []libvirt.Domain
+	broken  map[string]bool
+	// hidden domains exist but aren't listed, as if created after the listing.
+	hidden map[string]bool
+}
+
+func (f *fakeLibvirt) GetDomains(ctx context.Context) ([]libvirt.Domain, error) {
+	return f.domains, nil
+}
+
+func (f *fakeLibvirt) DescribeDomain(ctx context.Context, d libvirt.Domain) (cloudkit.VM, error) {
+	if f.broken[d.Name] {
+		return cloudkit.VM{}, errors.New("connection reset")
+	}
+	state := "running"
+	if d.ID == -1 {
+		state = "off"
+	}
+	return cloudkit.VM{Name: d.Name, DomainID: int(d.ID), State: state, IP: "pending"}, nil
+}
+
+func (f *fakeLibvirt) GetVMByName(ctx context.Context, name string) (cloudkit.VM, error) {
+	if f.broken[name] {
+		return cloudkit.VM{}, errors.New("connection reset")
+	}
+	if f.hidden[name] {
+		return cloudkit.VM{Name: name, DomainID: 9, State: "running", IP: "pending"}, nil
+	}
+	return cloudkit.VM{}, apperr.New(apperr.NotFound, "domain not found")
+}
+
+// fakeStore holds VMs and records the events and unmanaged domains the reconciler stores.
+type fakeStore struct {
+	storage.Datastore
+	vms       []storage.VMRecord
+	events    []cloudkit.VMEvent
+	unmanaged []storage.UnmanagedDomain
+}
+
+func (f *fakeStore) ListVMs(ctx context.Context, filter storage.VMFilter) ([]storage.VMRecord, error) {
+	return f.vms, nil
+}
+
+func (f *fakeStore) RecordVMEvent(ctx context.Context, ev cloudkit.VMEvent) error {
+	f.events = append(f.events, ev)
+	return nil
+}
+
+func (f *fakeStore) SyncUnmanagedDomains(ctx context.Context, found []storage.UnmanagedDomain) ([]storage.UnmanagedDomain, error) {
+	f.unmanaged = found
+	return nil, nil
+}
+
+func TestRunOnce(t *testing.T) {
+	lv := &fakeLibvirt{
+		domains: []libvirt.Domain{
+			{Name: "running", ID: 3},
+			{Name: "off", ID: -1},
+			{Name: "flaky", ID: 4},
+			{Name: "stray", ID: -1},
+		},
+		broken: map[string]bool{"flaky": true, "unreachable": true},
+		hidden: map[string]bool{"new": true},
+	}
+	db := &fakeStore{vms: []storage.VMRecord{
+		{ID: 1, Name: "running", DomainID: 3, State: "running"},
+		{ID: 2, Name: "off", DomainID: -1, State: "off"},
+		{ID: 3, Name: "flaky", DomainID: 4, State: "running"},
+		{ID: 4, Name: "gone", DomainID: 5, State: "running"},
+		{ID: 5, Name: "unreachable", DomainID: 6, State: "running"},
+		{ID: 6, Name: "new", DomainID: 9, State: "running"},
+	}}
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	NewReconciler(lv, db, events.NewBroker(16), DefaultConfig(), log).runOnce(context.Background())
+
+	// Only the VM libvirt says doesn't exist is lost. Inactive domains, ones that couldn't
+	// be described and ones that couldn't be looked up are left alone.
+	if len(db.events) != 1 || db.events[0].VMName != "gone" || db.events[0].Type != cloudkit.EventVMLost {
+		t.Errorf("recorded events %+v, want only gone marked lost", db.events)
+	}
+	if len(db.unmanaged) != 1 || db.unmanaged[0].Name != "stray" || db.unmanaged[0].DomainID != -1 {
+		t.Errorf("unmanaged domains %+v, want only the inactive stray domain", db.unmanaged)
+	}
+}
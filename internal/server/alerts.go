@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// alertsLimit caps how many alerts listAlerts returns.
+const alertsLimit = 200
+
+// ListAlertsReq describes the optional filters for listing alerts.
+type ListAlertsReq struct {
+	// Status is "firing" or "resolved". Empty lists both.
+	Status string `form:"status" binding:"omitempty,oneof=firing resolved"`
+}
+
+// CreateAlertRuleReq describes the request needed to create an alert rule, e.g.
+// {"name": "high memory", "metric": "memory_usage", "comparison": ">", "threshold": 90, "duration": "5m"}.
+type CreateAlertRuleReq struct {
+	Name       string  `json:"name" binding:"required"`
+	Metric     string  `json:"metric" binding:"required"`
+	Comparison string  `json:"comparison" binding:"required"`
+	Threshold  float64 `json:"threshold"`
+	// Duration is how long the condition must hold before firing, as a Go duration.
+	Duration string `json:"duration"`
+	// VMName optionally limits the rule to one of the project's VMs.
+	VMName string `json:"vm_name"`
+	// Notify optionally limits which sinks are notified: "log", "webhook" or "email".
+	Notify []string `json:"notify"`
+}
+
+// AlertRuleReq describes the URI params needed to address an alert rule.
+type AlertRuleReq struct {
+	ID int `uri:"id" binding:"required"`
+}
+
+func (a *App) listAlerts(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req ListAlertsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	list, err := a.storage.ListAlerts(ctx, currentProject(c), req.Status, alertsLimit)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"alerts": list}})
+}
+
+func (a *App) listAlertRules(c *gin.Context) {
+	ctx := c.Request.Context()
+	rules, err := a.storage.ListAlertRules(ctx, currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"rules": rules}})
+}
+
+func (a *App) createAlertRule(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req CreateAlertRuleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil {
+			fail(c, apperr.New(apperr.InvalidArgument, "invalid duration: "+err.Error()))
+			return
+		}
+	}
+	if req.Notify == nil {
+		req.Notify = []string{}
+	}
+
+	rule := storage.AlertRule{
+		ProjectID:       currentProject(c),
+		Name:            req.Name,
+		Metric:          req.Metric,
+		Comparison:      req.Comparison,
+		Threshold:       req.Threshold,
+		DurationSeconds: int(d / time.Second),
+		VMName:          req.VMName,
+		Notify:          req.Notify,
+	}
+	if err := a.alerts.Validate(rule); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if rule.VMName != "" {
+		names, err := a.storage.ListProjectVMNames(ctx, rule.ProjectID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		if !hasName(names, rule.VMName) {
+			fail(c, apperr.New(apperr.NotFound, "vm not found"))
+			return
+		}
+	}
+
+	rule, err := a.storage.CreateAlertRule(ctx, rule)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"rule": rule}})
+}
+
+func (a *App) deleteAlertRule(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req AlertRuleReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.DeleteAlertRule(ctx, currentProject(c), req.ID); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "alert rule not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// hasName reports whether names includes name.
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
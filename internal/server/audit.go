@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAuditPayload caps how much of a request body is kept in the audit trail.
+const maxAuditPayload = 64 << 10
+
+// Audit log page sizes.
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// auditWriteTimeout bounds recording an audit event. Events are written with their own
+// context so requests that timed out or were cancelled are still recorded.
+const auditWriteTimeout = 5 * time.Second
+
+// redacted replaces secret values in audited payloads.
+const redacted = "[REDACTED]"
+
+// secretFields are JSON keys whose values never reach the audit trail. Keys are matched
+// case insensitively and by suffix, so "webhook_secret" is caught too.
+var secretFields = []string{"secret", "password", "token", "api_key", "private_key", "passphrase"}
+
+// audit records every mutating request, whether or not it succeeded, once it has been
+// handled. It runs before authentication so rejected credentials are recorded as well.
+func (a *App) audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		// Only peek at as much of the body as we'd keep, then hand the handler the whole
+		// thing again.
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(c.Request.Body, maxAuditPayload+1))
+			if err != nil {
+				fail(c, invalid(err))
+				return
+			}
+			c.Request.Body = readCloser{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+		}
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		user := currentUser(c)
+		status := responseStatus(c)
+
+		ev := storage.AuditEvent{
+			Time:       time.Now(),
+			ActorID:    user.ID,
+			ActorEmail: user.Email,
+			ProjectID:  currentProject(c),
+			Action:     c.Request.Method + " " + route,
+			Target:     c.Request.URL.Path,
+			Payload:    redactPayload(body),
+			Status:     status,
+			Result:     auditResult(status),
+			SourceIP:   a.clientIP(c),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		defer cancel()
+		if err := a.storage.RecordAuditEvent(ctx, ev); err != nil {
+			a.logger.Errorf("failed to record audit event for %s, err: %+v", ev.Action, err)
+		}
+	}
+}
+
+// clientIP returns the address a request came from. X-Forwarded-For is followed only
+// through trusted proxies, reading it from the right since each proxy appends the peer it
+// saw, so the first untrusted hop is what's returned and clients can't forge it.
+func (a *App) clientIP(c *gin.Context) string {
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		ip = c.Request.RemoteAddr
+	}
+
+	hops := strings.Split(strings.Join(c.Request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && a.trustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is one of the configured trusted proxies.
+func (a *App) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range a.proxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCloser pairs a reader over the replayed body with the original body's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return storage.AuditDenied
+	case status >= 200 && status < 400:
+		return storage.AuditSuccess
+	default:
+		return storage.AuditFailure
+	}
+}
+
+// redactPayload returns body with secret fields masked. Bodies that aren't JSON, or are
+// too big to keep, are dropped rather than risk storing secrets in the clear.
+func redactPayload(body []byte) json.RawMessage {
+	if len(body) == 0 || len(body) > maxAuditPayload {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(redact(v))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if isSecretField(k) {
+				t[k] = redacted
+			} else {
+				t[k] = redact(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = redact(val)
+		}
+	}
+	return v
+}
+
+func isSecretField(key string) bool {
+	key = strings.ToLower(key)
+	for _, f := range secretFields {
+		if strings.HasSuffix(key, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAuditEventsReq describes the optional filters and paging for the audit trail.
+type ListAuditEventsReq struct {
+	ActorID   int `form:"actor_id"`
+	ProjectID int `form:"project_id"`
+	// Action matches actions starting with it, e.g. "DELETE" or "POST /api/v1/vms".
+	Action string    `form:"action"`
+	Result string    `form:"result" binding:"omitempty,oneof=success failure denied"`
+	Since  time.Time `form:"since"`
+	Until  time.Time `form:"until"`
+	// Before is the next_before value from the previous page.
+	Before int64 `form:"before"`
+	Limit  int   `form:"limit" binding:"omitempty,min=1"`
+}
+
+func (a *App) listAuditEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req ListAuditEventsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultAuditLimit
+	}
+	if req.Limit > maxAuditLimit {
+		req.Limit = maxAuditLimit
+	}
+
+	evs, err := a.storage.ListAuditEvents(ctx, storage.AuditFilter{
+		ActorID:   req.ActorID,
+		ProjectID: req.ProjectID,
+		Action:    req.Action,
+		Result:    req.Result,
+		Since:     req.Since,
+		Until:     req.Until,
+		BeforeID:  req.Before,
+		Limit:     req.Limit,
+	})
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	data := gin.H{"events": evs}
+	if len(evs) == req.Limit {
+		data["next_before"] = evs[len(evs)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
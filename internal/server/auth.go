@@ -0,0 +1,195 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/auth"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// userKey is the gin context key the authenticated user is stored under.
+const userKey = "cloudkit.user"
+
+// authenticate rejects requests without a valid API key and stores the key's user in the
+// context for handlers to use.
+func (a *App) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="cloudkit"`)
+			fail(c, apperr.New(apperr.Unauthenticated, "missing bearer token"))
+			return
+		}
+		if !auth.ValidFormat(token) {
+			fail(c, apperr.New(apperr.Unauthenticated, "invalid bearer token"))
+			return
+		}
+
+		user, _, err := a.storage.AuthenticateAPIKey(c.Request.Context(), auth.HashToken(token))
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.Unauthenticated, "invalid bearer token"))
+			return
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// bearerToken reads the token from the Authorization header. Browsers can't set headers
+// on EventSource or WebSocket connections, so event streams may pass it as the
+// access_token query param instead.
+func bearerToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); h != "" {
+		if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+			return strings.TrimSpace(h[7:])
+		}
+		return ""
+	}
+	if c.IsWebsocket() || strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		return c.Query("access_token")
+	}
+	return ""
+}
+
+// currentUser returns the user authenticate stored in the context.
+func currentUser(c *gin.Context) storage.User {
+	u, _ := c.Get(userKey)
+	user, _ := u.(storage.User)
+	return user
+}
+
+// CreateUserReq describes the request needed to create a user.
+type CreateUserReq struct {
+	Email string `json:"email" binding:"required,email"`
+	Name  string `json:"name"`
+	// Admin makes the user a system admin.
+	Admin bool `json:"admin"`
+}
+
+// UserReq describes the URI params needed to address a user.
+type UserReq struct {
+	ID int `uri:"id" binding:"required"`
+}
+
+// CreateAPIKeyReq describes the request needed to create an API key.
+type CreateAPIKeyReq struct {
+	// Name is a label to remember what the key is used for.
+	Name string `json:"name"`
+}
+
+// APIKeyReq describes the URI params needed to address an API key.
+type APIKeyReq struct {
+	ID int `uri:"id" binding:"required"`
+}
+
+func (a *App) getCurrentUser(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"user": currentUser(c)}})
+}
+
+func (a *App) listUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+	users, err := a.storage.ListUsers(ctx)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"users": users}})
+}
+
+func (a *App) createUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req CreateUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	user, err := a.storage.CreateUser(ctx, storage.User{Email: strings.ToLower(req.Email), Name: req.Name, Admin: req.Admin})
+	if err == storage.ErrConflict {
+		fail(c, apperr.New(apperr.Conflict, "a user with that email already exists"))
+		return
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"user": user}})
+}
+
+// createUserAPIKey issues a key for another user, e.g. to hand a new user their first.
+func (a *App) createUserAPIKey(c *gin.Context) {
+	var uriReq UserReq
+	if err := c.ShouldBindUri(&uriReq); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	a.issueAPIKey(c, uriReq.ID)
+}
+
+func (a *App) listAPIKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	keys, err := a.storage.ListAPIKeys(ctx, currentUser(c).ID)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"api_keys": keys}})
+}
+
+func (a *App) createAPIKey(c *gin.Context) {
+	a.issueAPIKey(c, currentUser(c).ID)
+}
+
+func (a *App) issueAPIKey(c *gin.Context, userID int) {
+	// The body is optional since a key doesn't need a name.
+	var req CreateAPIKeyReq
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		fail(c, invalid(err))
+		return
+	}
+
+	key, err := auth.IssueKey(c.Request.Context(), a.storage, userID, req.Name)
+	if err == storage.ErrNotFound {
+		fail(c, apperr.New(apperr.NotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	// The token is only ever returned here.
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"api_key": key}})
+}
+
+func (a *App) revokeAPIKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req APIKeyReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.RevokeAPIKey(ctx, currentUser(c).ID, req.ID); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "api key not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader carries a request's ID. Clients may set it to correlate their own logs;
+// it's echoed back on every response and included in errors.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key the request's ID is stored under.
+const requestIDKey = "cloudkit.request_id"
+
+// validRequestID matches client supplied request IDs worth keeping. Anything else is
+// replaced so it can't be used to forge log lines.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// ErrorBody is the "error" member of every failed API response.
+type ErrorBody struct {
+	Code    apperr.Code `json:"code"`
+	Message string      `json:"message"`
+	// Details adds structured information for some codes, e.g. the invalid fields of an
+	// invalid_argument error or the exceeded limit of a quota_exceeded one.
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// FieldError describes one field of a request that failed validation.
+type FieldError struct {
+	Field string `json:"field"`
+	// Rule is the validation rule the field broke, e.g. "required" or "min".
+	Rule string `json:"rule"`
+}
+
+// requestID assigns each request an ID, keeping the client's if it sent a sane one.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// currentRequestID returns the ID requestID assigned the request.
+func currentRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// renderErrors answers requests that failed with fail, turning the last error into the
+// standard error envelope with the status its code maps to. Server side errors are logged
+// with their cause, which clients never see.
+func (a *App) renderErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		e := apperr.As(c.Errors.Last().Err)
+		status := apperr.HTTPStatus(e.Code)
+
+		if status >= 500 {
+			a.logger.WithFields(logrus.Fields{
+				"request_id": currentRequestID(c),
+				"code":       e.Code,
+				"method":     c.Request.Method,
+				"route":      c.FullPath(),
+			}).Errorf("request failed, err: %+v", e)
+		}
+		if e.Code == apperr.Unavailable {
+			c.Header("Retry-After", "5")
+		}
+
+		c.JSON(status, gin.H{"error": ErrorBody{
+			Code:      e.Code,
+			Message:   e.Message,
+			Details:   e.Details,
+			RequestID: currentRequestID(c),
+		}})
+	}
+}
+
+// responseStatus is the status c is answered with, including when renderErrors is yet to
+// respond.
+func responseStatus(c *gin.Context) int {
+	if len(c.Errors) > 0 && !c.Writer.Written() {
+		return apperr.HTTPStatus(apperr.CodeOf(c.Errors.Last().Err))
+	}
+	return c.Writer.Status()
+}
+
+// fail aborts the request with err, which renderErrors responds with.
+func fail(c *gin.Context, err error) {
+	c.Error(err)
+	c.Abort()
+}
+
+// invalid classifies a request that couldn't be bound or failed validation, listing the
+// offending fields for validation failures.
+func invalid(err error) error {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		fields := make([]FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			fields = append(fields, FieldError{Field: fe.Field(), Rule: fe.Tag()})
+		}
+		return &apperr.Error{Code: apperr.InvalidArgument, Message: "request failed validation", Details: fields, Err: err}
+	}
+	return apperr.Wrap(apperr.InvalidArgument, err, err.Error())
+}
+
+// nameFieldsByTag makes validation errors name fields as clients send them, by their json,
+// form or uri tag, rather than by their Go names.
+func nameFieldsByTag() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		for _, tag := range []string{"json", "form", "uri"} {
+			if name := strings.Split(f.Tag.Get(tag), ",")[0]; name != "" && name != "-" {
+				return name
+			}
+		}
+		return f.Name
+	})
+}
+
+// noRoute answers requests for routes that don't exist.
+func noRoute(c *gin.Context) {
+	fail(c, apperr.New(apperr.NotFound, "no such route"))
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"time"
 
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
 	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
 	"github.com/gin-gonic/gin"
 )
 
@@ -11,49 +15,313 @@ func (a *App) ping(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "pong"})
 }
 
+// healthz reports whether cloudkit can reach libvirt, responding with a 503 while it
+// can't so load balancers and orchestrators can tell.
+func (a *App) healthz(c *gin.Context) {
+	conn := a.manager.Connection()
+	if !conn.Connected {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "libvirt": conn})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "libvirt": conn})
+}
+
+// requireLibvirt fails requests that need libvirt straight away with a 503 while it's
+// unreachable, rather than letting them start work they can't finish.
+func (a *App) requireLibvirt() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.manager.Connection().Connected {
+			fail(c, cloudkit.ErrDisconnected)
+			return
+		}
+		c.Next()
+	}
+}
+
+// VM list page sizes.
+const (
+	defaultVMLimit = 100
+	maxVMLimit     = 500
+)
+
+// ListVMsReq describes the optional filters and paging for a project's VMs.
+type ListVMsReq struct {
+	State string `form:"state"`
+	// After is the next_after value from the previous page.
+	After int `form:"after"`
+	Limit int `form:"limit" binding:"omitempty,min=1"`
+}
+
+// getVMs lists the VMs the project owns as cloudkit has them stored. Domains cloudkit
+// doesn't manage are left out until they are imported into a project. Stored state, host
+// and IP can lag libvirt by up to the reconciler's interval, and MAC addresses and current
+// memory aren't stored at all, so getVM is the place for what libvirt reports now.
 func (a *App) getVMs(c *gin.Context) {
-	domains, err := a.manager.GetRunningVMs()
+	ctx := c.Request.Context()
+	var req ListVMsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultVMLimit
+	}
+	if req.Limit > maxVMLimit {
+		req.Limit = maxVMLimit
+	}
+
+	vms, err := a.storage.ListVMs(ctx, storage.VMFilter{
+		ProjectID: currentProject(c),
+		State:     req.State,
+		AfterID:   req.After,
+		Limit:     req.Limit,
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		fail(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"data": gin.H{"vms": domains}})
+	if vms == nil {
+		vms = []storage.VMRecord{}
+	}
+
+	data := gin.H{"vms": vms}
+	if len(vms) == req.Limit {
+		data["next_after"] = vms[len(vms)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
 }
 
-// GetVMByDomainIDReq describes request needed to get VM by its ID.
-type GetVMByDomainIDReq struct {
-	// DomainID is the only requirement for fetching a VM.
-	DomainID int `uri:"domain_id" binding:"required"`
+// VMReq describes the URI params needed to address a VM. VMs are addressed by their
+// cloudkit ID rather than their libvirt domain ID, which changes each time a domain
+// starts and is -1 while it's off.
+type VMReq struct {
+	ID int `uri:"id" binding:"required,min=1"`
 }
 
-func (a *App) getVMByDomainID(c *gin.Context) {
-	var req GetVMByDomainIDReq
+// getVM describes a VM as libvirt has it now, along with its recent memory usage.
+func (a *App) getVM(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req VMReq
 	if err := c.ShouldBindUri(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		fail(c, invalid(err))
 		return
 	}
 
-	vm, err := a.manager.GetVMByDomainID(req.DomainID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	rec, ok := a.projectVM(c, req.ID)
+	if !ok {
 		return
 	}
 
-	id, err := a.storage.GetVMIDFromDomainID(vm.DomainID)
+	vm, err := a.manager.GetVMByName(ctx, rec.Name)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		fail(c, err)
 		return
 	}
+	vm.ID = rec.ID
 
-	usages, err := a.storage.GetLast15MinVMMemUsage(id)
+	usages, err := a.storage.GetLast15MinVMMemUsage(ctx, rec.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		fail(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"data": gin.H{"vm": vm, "memory_usage": usages}})
 }
 
+// projectVM looks up a VM in the caller's project, responding with a 404 if it belongs
+// to another project or doesn't exist.
+func (a *App) projectVM(c *gin.Context, id int) (storage.VMRecord, bool) {
+	vm, err := a.storage.GetProjectVM(c.Request.Context(), currentProject(c), id)
+	if err == storage.ErrNotFound {
+		fail(c, apperr.New(apperr.NotFound, "vm not found"))
+		return storage.VMRecord{}, false
+	}
+	if err != nil {
+		fail(c, err)
+		return storage.VMRecord{}, false
+	}
+	return vm, true
+}
+
+// ImportVMReq describes the request needed to bring a libvirt domain cloudkit didn't
+// create under a project's management. Domains are named rather than given by ID, which
+// every domain that's off shares.
+type ImportVMReq struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func (a *App) importVM(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req ImportVMReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	vm, err := a.manager.GetVMByName(ctx, req.Name)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	// libvirt reports memory in KiB. The disk of a domain cloudkit didn't create could be
+	// anything, so it isn't counted.
+	res := storage.Resources{VCPUs: vm.VCPUs, MemoryMiB: vm.Mem / 1024}
+	id, err := a.storage.ImportVM(ctx, currentProject(c), vm, res)
+	if err != nil {
+		if err == storage.ErrConflict {
+			fail(c, apperr.New(apperr.Conflict, "vm is already managed by cloudkit"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+	vm.ID = id
+
+	a.events.PublishProject(currentProject(c), cloudkit.EventVMImported, vm.Name, cloudkit.VMEvent{
+		Type:     cloudkit.EventVMImported,
+		VMName:   vm.Name,
+		DomainID: vm.DomainID,
+		State:    vm.State,
+		Reason:   "imported through the API",
+		Time:     time.Now(),
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"vm": vm}})
+}
+
+// vmStateHistoryLimit caps how many state changes getVMStateHistory returns.
+const vmStateHistoryLimit = 100
+
+func (a *App) getVMStateHistory(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req VMReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	vm, ok := a.projectVM(c, req.ID)
+	if !ok {
+		return
+	}
+
+	history, err := a.storage.GetVMStateHistory(ctx, vm.ID, vmStateHistoryLimit)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"history": history}})
+}
+
+// SetVMMemoryBoundsReq sets how far the memory balancer may resize a VM. Zero clears a
+// bound back to the balancer's default.
+type SetVMMemoryBoundsReq struct {
+	MinMiB int `json:"min_mib" binding:"min=0"`
+	MaxMiB int `json:"max_mib" binding:"min=0"`
+}
+
+func (a *App) setVMMemoryBounds(c *gin.Context) {
+	ctx := c.Request.Context()
+	var uriReq VMReq
+	if err := c.ShouldBindUri(&uriReq); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	var req SetVMMemoryBoundsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if req.MaxMiB > 0 && req.MinMiB > req.MaxMiB {
+		fail(c, apperr.New(apperr.InvalidArgument, "min_mib must not be greater than max_mib"))
+		return
+	}
+
+	vm, ok := a.projectVM(c, uriReq.ID)
+	if !ok {
+		return
+	}
+
+	bounds := cloudkit.MemoryBounds{MinMiB: req.MinMiB, MaxMiB: req.MaxMiB}
+	if err := a.storage.SetVMMemoryBounds(ctx, vm.ID, bounds); err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"memory_bounds": bounds}})
+}
+
+// GetVMMetricsReq describes the optional time range and resolution for a VM's metrics.
+type GetVMMetricsReq struct {
+	// Start defaults to 15 minutes before End (RFC3339).
+	Start time.Time `form:"start"`
+	// End defaults to now (RFC3339).
+	End time.Time `form:"end"`
+	// Step is the bucket width as a Go duration, e.g. "1m" or "1h". Defaults to 1m.
+	Step time.Duration `form:"step"`
+}
+
+// maxMetricBuckets caps how many points a single series can return.
+const maxMetricBuckets = 1440
+
+func (a *App) getVMMetrics(c *gin.Context) {
+	ctx := c.Request.Context()
+	var uriReq VMReq
+	if err := c.ShouldBindUri(&uriReq); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	var req GetVMMetricsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if req.End.IsZero() {
+		req.End = time.Now()
+	}
+	if req.Start.IsZero() {
+		req.Start = req.End.Add(-15 * time.Minute)
+	}
+	if req.Step == 0 {
+		req.Step = time.Minute
+	}
+
+	switch {
+	case !req.Start.Before(req.End):
+		fail(c, apperr.New(apperr.InvalidArgument, "start must be before end"))
+		return
+	case req.Step < time.Second:
+		fail(c, apperr.New(apperr.InvalidArgument, "step must be at least 1s"))
+		return
+	case req.End.Sub(req.Start)/req.Step > maxMetricBuckets:
+		fail(c, apperr.New(apperr.InvalidArgument, "too many buckets, increase step or shorten the range"))
+		return
+	}
+
+	vm, ok := a.projectVM(c, uriReq.ID)
+	if !ok {
+		return
+	}
+
+	q := cloudkit.MetricsQuery{Start: req.Start, End: req.End, Step: req.Step}
+	series, err := a.storage.GetVMMetricSeries(ctx, vm.ID, q)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"start":   req.Start,
+		"end":     req.End,
+		"step":    req.Step.String(),
+		"metrics": series,
+	}})
+}
+
 // CreateVMReq defines the shape of the JSON request needed from the front end to create a VM.
 type CreateVMReq struct {
 	// MachineType currently is a placeholder until we have more images than ubuntu-18.04
@@ -64,51 +332,165 @@ type CreateVMReq struct {
 	VCPUs int `json:"vcpus" binding:"required"`
 }
 
+// createVM reserves the VM's quota and answers 202 Accepted with the ID of the operation
+// that goes on to create it in the background, which can take several minutes. Its
+// progress is published as operation.progress events.
 func (a *App) createVM(c *gin.Context) {
+	ctx := c.Request.Context()
 	var vmReq CreateVMReq
 	if err := c.ShouldBindJSON(&vmReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		fail(c, invalid(err))
 		return
 	}
 
-	vm, err := a.manager.CreateVM(vmReq.MachineType, vmReq.Memory, vmReq.VCPUs)
+	memoryMiB, vcpus := cloudkit.RequestedResources(vmReq.Memory, vmReq.VCPUs)
+	res := storage.Resources{VMs: 1, VCPUs: vcpus, MemoryMiB: memoryMiB, DiskGB: cloudkit.DiskSizeGB}
+	reservation, err := a.storage.ReserveQuota(ctx, currentProject(c), res)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		fail(c, err)
 		return
 	}
 
-	if _, err := a.storage.CreateVM(vm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	op := newOperation(a.events, currentProject(c), "create_vm")
+	op.progress(operationRunning, "")
+
+	a.creates.Add(1)
+	go func() {
+		defer a.creates.Done()
+		a.runCreateVM(op, vmReq, reservation)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "accepted", "operation_id": op.ID})
+}
+
+// runCreateVM creates the VM createVM accepted, on its own context bounded by the create
+// VM timeout, as the request is long gone. A VM that fails to be created is cleaned up
+// before the operation reports it.
+func (a *App) runCreateVM(op *operation, vmReq CreateVMReq, reservation int) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeouts.createVM)
+	defer cancel()
+
+	vm, err := a.manager.CreateVM(ctx, vmReq.MachineType, vmReq.Memory, vmReq.VCPUs)
+	if err != nil {
+		a.logger.Errorf("failed to create VM for operation %s, err: %+v", op.ID, err)
+		a.releaseQuota(reservation)
+		op.fail(err)
 		return
 	}
+	op.vmName = vm.Name
 
-	c.JSON(http.StatusOK, gin.H{"message": "success"})
+	if _, err := a.storage.CreateVM(ctx, op.projectID, vm, reservation); err != nil {
+		a.logger.Errorf("failed to store VM %s for operation %s, err: %+v", vm.Name, op.ID, err)
+		a.undoCreateVM(vm.Name, reservation)
+		op.fail(err)
+		return
+	}
+
+	op.progress(operationSucceeded, "")
+	a.events.PublishProject(op.projectID, cloudkit.EventVMCreated, vm.Name, cloudkit.VMEvent{
+		Type:     cloudkit.EventVMCreated,
+		VMName:   vm.Name,
+		DomainID: vm.DomainID,
+		State:    vm.State,
+		Time:     time.Now(),
+	})
 }
 
-// takeMemorySnapshots gets the currently used percentage of total memory for each VM and
-// persists the measurements to storage (postgres).
-func (a *App) takeMemorySnapshots() {
-	vms, err := a.manager.GetRunningDomains()
-	if err != nil {
-		a.logger.Errorf("failed to get running vms, err: %+v", err)
+// undoCreateTimeout bounds cleaning up after a VM that failed to be created.
+const undoCreateTimeout = 30 * time.Second
+
+// undoCreateVM destroys the domain created for a VM that couldn't be stored, so it isn't
+// left running unmanaged, and releases the VM's quota reservation. It runs on its own
+// context, as the create's may be what failed.
+func (a *App) undoCreateVM(name string, reservation int) {
+	ctx, cancel := context.WithTimeout(context.Background(), undoCreateTimeout)
+	defer cancel()
+
+	if err := a.manager.DestroyVM(ctx, name); err != nil {
+		a.logger.Errorf("failed to destroy domain %s of a VM that couldn't be created, err: %+v", name, err)
 	}
+	a.releaseQuota(reservation)
+}
 
-	for _, domain := range vms {
-		rStats, err := a.manager.DomainMemoryStats(domain, cloudkit.MaxStats, 0)
-		if err != nil {
-			a.logger.Errorf("failed to aqcuire domain memory stats, err: %+v", err)
-		}
+// releaseQuota drops the reservation of a VM that failed to be created, on its own
+// context like undoCreateVM.
+func (a *App) releaseQuota(reservation int) {
+	ctx, cancel := context.WithTimeout(context.Background(), undoCreateTimeout)
+	defer cancel()
 
-		ms, err := cloudkit.NewMemStats(rStats)
-		if err != nil {
-			a.logger.Errorf("failed to unmarshal memory stats, err: %+v", err)
-		}
+	if err := a.storage.ReleaseQuota(ctx, reservation); err != nil {
+		a.logger.Errorf("failed to release quota reservation %d, err: %+v", reservation, err)
+	}
+}
 
-		usage := (float64(ms.Available-ms.Usable) / float64(ms.Available)) * 100
+// deleteVM destroys a VM's domain and soft deletes it, freeing its share of the project's
+// quota. VMs whose domain is already gone can be deleted too.
+func (a *App) deleteVM(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req VMReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
 
-		err = a.storage.RecordVMMemory(int(domain.ID), usage)
-		if err != nil {
-			a.logger.Errorf("failed to record VM memory, err: %+v", err)
+	vm, ok := a.projectVM(c, req.ID)
+	if !ok {
+		return
+	}
+
+	if vm.State != cloudkit.StateLost {
+		if err := a.manager.DestroyVM(ctx, vm.Name); err != nil {
+			fail(c, err)
+			return
 		}
 	}
+	if err := a.storage.DeleteVM(ctx, vm.ID); err != nil {
+		fail(c, err)
+		return
+	}
+
+	a.events.PublishProject(currentProject(c), cloudkit.EventVMDeleted, vm.Name, cloudkit.VMEvent{
+		Type:     cloudkit.EventVMDeleted,
+		VMName:   vm.Name,
+		DomainID: vm.DomainID,
+		State:    vm.State,
+		Reason:   "deleted through the API",
+		Time:     time.Now(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (a *App) listUnmanagedDomains(c *gin.Context) {
+	ctx := c.Request.Context()
+	domains, err := a.storage.ListUnmanagedDomains(ctx)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	if domains == nil {
+		domains = []storage.UnmanagedDomain{}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"domains": domains}})
+}
+
+// getMonitorHealth reports how the last monitor pass went for the project's VMs, answering
+// with a 503 while that's unhealthy. Other projects' VMs don't affect it.
+func (a *App) getMonitorHealth(c *gin.Context) {
+	names, err := a.storage.ListProjectVMNames(c.Request.Context(), currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	owned := make(map[string]bool, len(names))
+	for _, n := range names {
+		owned[n] = true
+	}
+
+	st := a.monitor.Status().ForVMs(func(name string) bool { return owned[name] })
+	code := http.StatusOK
+	if !st.Healthy(time.Now()) {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"data": gin.H{"monitor": st}})
 }
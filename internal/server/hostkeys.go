@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeysReq describes the URI param needed to address a host's keys. Host is written
+// as OpenSSH's known_hosts does: the bare host for port 22, [host]:port otherwise.
+type HostKeysReq struct {
+	Host string `uri:"host" binding:"required"`
+}
+
+// PinHostKeyReq describes the request needed to pin a host's key.
+type PinHostKeyReq struct {
+	// PublicKey is in authorized_keys format, e.g. the contents of the host's
+	// /etc/ssh/ssh_host_ed25519_key.pub.
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+// ListHostKeysReq optionally narrows the listed keys to one host.
+type ListHostKeysReq struct {
+	Host string `form:"host"`
+}
+
+func (a *App) listHostKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req ListHostKeysReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if req.Host != "" {
+		req.Host = knownhosts.Normalize(req.Host)
+	}
+	keys, err := a.storage.ListHostKeys(ctx, req.Host)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	if keys == nil {
+		keys = []hostcreds.Key{}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"host_keys": keys}})
+}
+
+// pinHostKey makes the given key the only one accepted from a host, for instance after it
+// was reinstalled, or before cloudkit first connects when trust on first use is off.
+func (a *App) pinHostKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	var uri HostKeysReq
+	if err := c.ShouldBindUri(&uri); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	var req PinHostKeyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		fail(c, apperr.New(apperr.InvalidArgument, "public_key must be in authorized_keys format"))
+		return
+	}
+
+	key, err := a.storage.PinHostKey(ctx, hostcreds.NewKey(uri.Host, pub, true))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"host_key": key}})
+}
+
+// deleteHostKeys forgets a host's keys, so the next connection trusts whatever key it
+// presents if trust on first use is on.
+func (a *App) deleteHostKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	var uri HostKeysReq
+	if err := c.ShouldBindUri(&uri); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.DeleteHostKeys(ctx, knownhosts.Normalize(uri.Host)); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "no keys known for host"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	// embed is needed for the go:embed directive below.
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes every route. New warns at startup about any route that's missing
+// from it, or that it describes but isn't registered, so keep it in step with
+// initializeRoutes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders the spec with ReDoc. The spec is referenced relatively so the page
+// works behind proxies that mount the API under another path.
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>cloudkit API</title>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+  <redoc spec-url="openapi.json"></redoc>
+  <script src="https://cdn.jsdelivr.net/npm/redoc@2/bundles/redoc.standalone.js"></script>
+</body>
+</html>
+`
+
+func (a *App) getOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPISpec)
+}
+
+func (a *App) getAPIDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
+
+// specMismatches compares the registered routes with the spec's operations, describing
+// each one found in only one of them.
+func specMismatches(routes gin.RoutesInfo) ([]string, error) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, fmt.Errorf("parsing openapi.json: %w", err)
+	}
+
+	documented := map[string]bool{}
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	var problems []string
+	for _, r := range routes {
+		op := r.Method + " " + specPath(r.Path)
+		if !documented[op] {
+			problems = append(problems, op+" is registered but not in openapi.json")
+		}
+		delete(documented, op)
+	}
+	for op := range documented {
+		problems = append(problems, op+" is in openapi.json but not registered")
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// specPath turns a gin route like /vms/:id into its OpenAPI form, /vms/{id}.
+func specPath(route string) string {
+	parts := strings.Split(route, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,15 @@
+package server
+
+import "testing"
+
+func TestSpecMatchesRoutes(t *testing.T) {
+	app, _, _ := newTestApp(t, &fakeStore{})
+
+	problems, err := specMismatches(app.Router().Routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Error(p)
+	}
+}
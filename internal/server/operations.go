@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/lithammer/shortuuid"
+)
+
+// Operation statuses published as operation.progress events.
+const (
+	operationRunning   = "running"
+	operationSucceeded = "succeeded"
+	operationFailed    = "failed"
+)
+
+// operation tracks a long running request so that streaming clients can follow it.
+type operation struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	projectID int
+	vmName    string
+	broker    *events.Broker
+}
+
+func newOperation(b *events.Broker, projectID int, action string) *operation {
+	return &operation{ID: shortuuid.New(), Action: action, projectID: projectID, broker: b}
+}
+
+// progress publishes the operation's new status to the project it runs in. Until the
+// operation knows its VM, the project is all that tells who may see it.
+func (o *operation) progress(status, detail string) {
+	o.Status, o.Detail = status, detail
+	o.broker.PublishProject(o.projectID, events.TypeOperationProgress, o.vmName, *o)
+}
+
+// fail publishes that the operation failed with err, detailed by the same message the
+// request's error response gives.
+func (o *operation) fail(err error) {
+	o.progress(operationFailed, apperr.As(err).Message)
+}
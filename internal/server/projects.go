@@ -0,0 +1,234 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ProjectHeader selects which project a request acts on. It can be left off by users who
+// belong to a single project.
+const ProjectHeader = "X-Cloudkit-Project"
+
+// projectKey is the gin context key the selected project ID is stored under.
+const projectKey = "cloudkit.project"
+
+// requireProject resolves the project a request acts on from ProjectHeader, or the
+// project_id query param, and stores it along with the caller's role in it. It must run
+// after authenticate.
+func (a *App) requireProject() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.GetHeader(ProjectHeader)
+		if h == "" {
+			h = c.Query("project_id")
+		}
+		if h == "" {
+			projects, err := a.storage.ListProjects(c.Request.Context(), currentUser(c).ID)
+			if err != nil {
+				fail(c, err)
+				return
+			}
+			if len(projects) != 1 {
+				fail(c, apperr.New(apperr.InvalidArgument, "select a project with the "+ProjectHeader+" header"))
+				return
+			}
+			c.Set(projectKey, projects[0].ID)
+			c.Set(roleKey, projects[0].Role)
+			c.Next()
+			return
+		}
+
+		id, err := strconv.Atoi(h)
+		if err != nil {
+			fail(c, apperr.New(apperr.InvalidArgument, "invalid "+ProjectHeader+" header"))
+			return
+		}
+		if a.selectProject(c, id) {
+			c.Next()
+		}
+	}
+}
+
+// projectFromURI is requireProject for routes that address a project by its :id param.
+func (a *App) projectFromURI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ProjectReq
+		if err := c.ShouldBindUri(&req); err != nil {
+			fail(c, invalid(err))
+			return
+		}
+		if a.selectProject(c, req.ID) {
+			c.Next()
+		}
+	}
+}
+
+// selectProject stores id and the caller's role in it in the context. System admins act
+// as project admins everywhere. Anyone else who isn't a member gets a 404, so the
+// existence of other tenants' projects isn't revealed.
+func (a *App) selectProject(c *gin.Context, id int) bool {
+	user := currentUser(c)
+
+	role, err := a.storage.GetProjectRole(c.Request.Context(), id, user.ID)
+	switch {
+	case err == storage.ErrNotFound && user.Admin:
+		role = storage.RoleAdmin
+	case err == storage.ErrNotFound:
+		fail(c, apperr.New(apperr.NotFound, "project not found"))
+		return false
+	case err != nil:
+		fail(c, err)
+		return false
+	}
+
+	c.Set(projectKey, id)
+	c.Set(roleKey, role)
+	return true
+}
+
+// currentProject returns the project ID requireProject stored in the context.
+func currentProject(c *gin.Context) int {
+	return c.GetInt(projectKey)
+}
+
+// CreateProjectReq describes the request needed to create a project.
+type CreateProjectReq struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// ProjectReq describes the URI params needed to address a project.
+type ProjectReq struct {
+	ID int `uri:"id" binding:"required"`
+}
+
+// ProjectMemberReq describes the URI params needed to address a project member.
+type ProjectMemberReq struct {
+	ID     int `uri:"id" binding:"required"`
+	UserID int `uri:"user_id" binding:"required"`
+}
+
+// AddProjectMemberReq describes the request needed to add a user to a project.
+type AddProjectMemberReq struct {
+	UserID int `json:"user_id" binding:"required"`
+	// Role defaults to viewer.
+	Role string `json:"role" binding:"omitempty,oneof=viewer operator admin"`
+}
+
+// SetProjectMemberRoleReq describes the request needed to change a member's role.
+type SetProjectMemberRoleReq struct {
+	Role string `json:"role" binding:"required,oneof=viewer operator admin"`
+}
+
+func (a *App) listProjects(c *gin.Context) {
+	ctx := c.Request.Context()
+	projects, err := a.storage.ListProjects(ctx, currentUser(c).ID)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"projects": projects}})
+}
+
+func (a *App) createProject(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req CreateProjectReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	project, err := a.storage.CreateProject(ctx, storage.Project{Name: req.Name}, currentUser(c).ID)
+	if err == storage.ErrConflict {
+		fail(c, apperr.New(apperr.Conflict, "a project with that name already exists"))
+		return
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"project": project}})
+}
+
+func (a *App) listProjectMembers(c *gin.Context) {
+	ctx := c.Request.Context()
+	members, err := a.storage.ListProjectMembers(ctx, currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"members": members}})
+}
+
+func (a *App) addProjectMember(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req AddProjectMemberReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	if req.Role == "" {
+		req.Role = storage.RoleViewer
+	}
+
+	switch err := a.storage.AddProjectMember(ctx, currentProject(c), req.UserID, req.Role); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "success"})
+	case storage.ErrConflict:
+		fail(c, apperr.New(apperr.Conflict, "user is already a member"))
+	case storage.ErrNotFound:
+		fail(c, apperr.New(apperr.NotFound, "user not found"))
+	default:
+		fail(c, err)
+	}
+}
+
+func (a *App) setProjectMemberRole(c *gin.Context) {
+	ctx := c.Request.Context()
+	var uriReq ProjectMemberReq
+	if err := c.ShouldBindUri(&uriReq); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+	var req SetProjectMemberRoleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.SetProjectMemberRole(ctx, uriReq.ID, uriReq.UserID, req.Role); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "member not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (a *App) removeProjectMember(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req ProjectMemberReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.RemoveProjectMember(ctx, req.ID, req.UserID); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "member not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// SetProjectQuotaReq describes a project's new limits. -1 lifts a limit.
+type SetProjectQuotaReq struct {
+	VMs       int `json:"vms" binding:"min=-1"`
+	VCPUs     int `json:"vcpus" binding:"min=-1"`
+	MemoryMiB int `json:"memory_mib" binding:"min=-1"`
+	DiskGB    int `json:"disk_gb" binding:"min=-1"`
+	Snapshots int `json:"snapshots" binding:"min=-1"`
+}
+
+func (a *App) getProjectQuota(c *gin.Context) {
+	ctx := c.Request.Context()
+	limits, err := a.storage.GetProjectQuota(ctx, currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	usage, err := a.storage.GetProjectUsage(ctx, currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"quotas": gin.H{"limits": limits, "usage": usage}}})
+}
+
+func (a *App) setProjectQuota(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req SetProjectQuotaReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	limits := storage.Resources(req)
+	if err := a.storage.SetProjectQuota(ctx, currentProject(c), limits); err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"quotas": gin.H{"limits": limits}}})
+}
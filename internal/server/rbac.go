@@ -0,0 +1,90 @@
+package server
+
+import (
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Permissions checked against the caller's role in the project a request acts on.
+const (
+	permVMsRead      = "vms:read"
+	permVMsWrite     = "vms:write"
+	permVMsDelete    = "vms:delete"
+	permEventsRead   = "events:read"
+	permMembersRead  = "members:read"
+	permMembersWrite = "members:write"
+	permQuotasRead   = "quotas:read"
+	permAlertsRead   = "alerts:read"
+	permAlertsWrite  = "alerts:write"
+	permHooksRead    = "webhooks:read"
+	permHooksWrite   = "webhooks:write"
+)
+
+// rolePermissions maps each project role to what it may do. Each role can do everything
+// the role before it can.
+var rolePermissions = map[string][]string{
+	storage.RoleViewer: {permVMsRead, permEventsRead, permMembersRead, permQuotasRead, permAlertsRead},
+	storage.RoleOperator: {permVMsRead, permEventsRead, permMembersRead, permQuotasRead, permAlertsRead,
+		permVMsWrite, permVMsDelete, permAlertsWrite, permHooksRead},
+	storage.RoleAdmin: {permVMsRead, permEventsRead, permMembersRead, permQuotasRead, permAlertsRead,
+		permVMsWrite, permVMsDelete, permAlertsWrite, permHooksRead, permMembersWrite, permHooksWrite},
+}
+
+// roleKey is the gin context key the caller's role in the selected project is stored under.
+const roleKey = "cloudkit.role"
+
+// can reports whether role grants perm.
+func can(role, perm string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize rejects requests whose caller's role in the selected project doesn't grant
+// perm. It must run after requireProject or projectFromURI.
+func (a *App) authorize(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString(roleKey)
+		if !can(role, perm) {
+			a.forbid(c, perm, role)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin rejects requests from anyone but system admins. It guards everything that
+// spans projects or affects the host itself.
+func (a *App) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).Admin {
+			a.forbid(c, "admin", "")
+			return
+		}
+		c.Next()
+	}
+}
+
+// forbid logs a denied request and fails it with a 403 naming the missing permission.
+func (a *App) forbid(c *gin.Context, perm, role string) {
+	user := currentUser(c)
+	a.logger.WithFields(logrus.Fields{
+		"user_id":    user.ID,
+		"project_id": currentProject(c),
+		"role":       role,
+		"permission": perm,
+		"method":     c.Request.Method,
+		"route":      c.FullPath(),
+	}).Warn("permission denied")
+
+	fail(c, &apperr.Error{
+		Code:    apperr.PermissionDenied,
+		Message: "you don't have permission to do that",
+		Details: gin.H{"permission": perm},
+	})
+}
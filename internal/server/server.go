@@ -1,10 +1,17 @@
 package server
 
 import (
-	"os"
+	"context"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/bradford-hamilton/cloudkit-core/internal/alerts"
 	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/metrics"
+	"github.com/bradford-hamilton/cloudkit-core/internal/monitor"
 	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -15,40 +22,161 @@ import (
 // App descirbes our main struct which holds all of the important dependencies and is
 // used to handle requests and execute actions.
 type App struct {
-	router  *gin.Engine
-	manager cloudkit.VMController
-	storage storage.Datastore
-	logger  *logrus.Logger
-	baseURL string
+	router   *gin.Engine
+	manager  cloudkit.VMController
+	storage  storage.Datastore
+	logger   *logrus.Logger
+	metrics  *metrics.Collector
+	monitor  *monitor.Monitor
+	events   *events.Broker
+	owners   *events.Owners
+	alerts   *alerts.Evaluator
+	baseURL  string
+	timeouts timeouts
+	proxies  []*net.IPNet
+	// creates tracks the VMs being created in the background.
+	creates sync.WaitGroup
+}
+
+// timeouts are the request deadlines applied per route.
+type timeouts struct {
+	request  time.Duration
+	createVM time.Duration
 }
 
 // New spins up a new gin router, initializes all the application routes, and returns
 // a new App struct with the gin router attached.
-func New(ckm cloudkit.VMController, db storage.Datastore, log *logrus.Logger) *App {
+func New(ckm cloudkit.VMController, db storage.Datastore, mon *monitor.Monitor, b *events.Broker, ae *alerts.Evaluator, m *metrics.Collector, cfg config.Server, log *logrus.Logger) *App {
+	nameFieldsByTag()
+
 	r := gin.New()
-	r.Use(gin.Recovery(), cors.Default(), ginlogrus.Logger(log))
+	// gin believes X-Forwarded-For from anyone. clientIP follows it through trusted proxies
+	// only, so everything else sees the peer's address.
+	r.ForwardedByClientIP = false
+	r.Use(requestID(), gin.Recovery())
+	if len(cfg.CORSOrigins) > 0 {
+		r.Use(cors.New(corsConfig(cfg.CORSOrigins)))
+	}
+	r.Use(ginlogrus.Logger(log), instrument(m))
+
+	proxies, err := cfg.Proxies()
+	if err != nil {
+		log.Errorf("ignoring trusted proxies, err: %+v", err)
+	}
 
 	app := App{
 		router:  r,
 		storage: db,
 		manager: ckm,
 		logger:  log,
-		baseURL: os.Getenv("CLOUDKIT_BASE_URL"),
+		metrics: m,
+		monitor: mon,
+		events:  b,
+		owners:  events.NewOwners(db),
+		alerts:  ae,
+		baseURL: cfg.BaseURL,
+		timeouts: timeouts{
+			request:  cfg.RequestTimeout.Duration,
+			createVM: cfg.CreateVMTimeout.Duration,
+		},
+		proxies: proxies,
 	}
+	// Errors are rendered before the logger and metrics see the response, but after the
+	// audit log has recorded it.
+	r.Use(app.renderErrors(), app.audit())
+	r.NoRoute(noRoute)
 	app.initializeRoutes()
-	app.runVMMonitor()
+
+	problems, err := specMismatches(r.Routes())
+	if err != nil {
+		log.Errorf("failed to check routes against the OpenAPI spec, err: %+v", err)
+	}
+	for _, p := range problems {
+		log.Warnf("OpenAPI spec is out of date: %s", p)
+	}
 
 	return &app
 }
 
 func (a *App) initializeRoutes() {
 	a.router.GET("/ping", a.ping)
+	a.router.GET("/healthz", a.healthz)
+	a.router.GET("/metrics", gin.WrapH(a.metrics.Handler()))
+	a.router.GET("/api/v1/openapi.json", a.getOpenAPISpec)
+	a.router.GET("/api/v1/docs", a.getAPIDocs)
+
+	// Routes in v1 act only on the caller's own user and keys. Everything else is
+	// guarded by either requireAdmin or a project permission.
+	v1 := a.router.Group("/api/v1", a.authenticate())
+	// Streams live as long as their client does, so they're registered before the
+	// request timeout is added to the group.
+	streams := v1.Group("", a.requireProject(), a.authorize(permEventsRead))
+	{
+		streams.GET("/events", a.streamEventsSSE)
+		streams.GET("/events/ws", a.streamEventsWS)
+	}
+	v1.Use(timeout(a.timeouts.request))
+	{
+		v1.GET("/users/me", a.getCurrentUser)
+		v1.GET("/keys", a.listAPIKeys)
+		v1.POST("/keys", a.createAPIKey)
+		v1.DELETE("/keys/:id", a.revokeAPIKey)
+		v1.GET("/projects", a.listProjects)
+		v1.POST("/projects", a.createProject)
+	}
+
+	// System wide and host management, limited to system admins.
+	admin := v1.Group("", a.requireAdmin())
+	{
+		admin.GET("/audit", a.listAuditEvents)
+		admin.GET("/domains/unmanaged", a.listUnmanagedDomains)
+		admin.GET("/host-keys", a.listHostKeys)
+		admin.PUT("/host-keys/:host", a.pinHostKey)
+		admin.DELETE("/host-keys/:host", a.deleteHostKeys)
+
+		admin.GET("/users", a.listUsers)
+		admin.POST("/users", a.createUser)
+		admin.POST("/users/:id/keys", a.createUserAPIKey)
+	}
+
+	project := v1.Group("/projects/:id", a.projectFromURI())
+	{
+		project.GET("/members", a.authorize(permMembersRead), a.listProjectMembers)
+		project.POST("/members", a.authorize(permMembersWrite), a.addProjectMember)
+		project.PUT("/members/:user_id", a.authorize(permMembersWrite), a.setProjectMemberRole)
+		project.DELETE("/members/:user_id", a.authorize(permMembersWrite), a.removeProjectMember)
+		project.GET("/quotas", a.authorize(permQuotasRead), a.getProjectQuota)
+		// Project admins mustn't be able to lift their own limits.
+		project.PUT("/quotas", a.requireAdmin(), a.setProjectQuota)
+	}
 
-	v1 := a.router.Group("/api/v1")
+	// Everything under scoped acts on a single project's VMs, or the webhooks and alerts
+	// that watch them.
+	scoped := v1.Group("", a.requireProject())
 	{
-		v1.GET("/vms", a.getVMs)
-		v1.POST("/vms", a.createVM)
-		v1.GET("/vms/:domain_id", a.getVMByDomainID)
+		scoped.GET("/vms", a.authorize(permVMsRead), a.getVMs)
+		scoped.POST("/vms", a.authorize(permVMsWrite), a.requireLibvirt(), a.createVM)
+		scoped.POST("/vms/import", a.authorize(permVMsWrite), a.requireLibvirt(), a.importVM)
+		scoped.GET("/vms/:id", a.authorize(permVMsRead), a.requireLibvirt(), a.getVM)
+		scoped.DELETE("/vms/:id", a.authorize(permVMsDelete), a.deleteVM)
+		scoped.GET("/vms/:id/metrics", a.authorize(permVMsRead), a.getVMMetrics)
+		scoped.GET("/vms/:id/history", a.authorize(permVMsRead), a.getVMStateHistory)
+		// Memory bounds shape how the host's memory is shared out, so they are host
+		// management rather than something a project decides for itself.
+		scoped.PUT("/vms/:id/memory-bounds", a.requireAdmin(), a.setVMMemoryBounds)
+
+		scoped.GET("/monitor/health", a.authorize(permVMsRead), a.getMonitorHealth)
+
+		scoped.GET("/webhooks", a.authorize(permHooksRead), a.listWebhooks)
+		scoped.POST("/webhooks", a.authorize(permHooksWrite), a.createWebhook)
+		scoped.DELETE("/webhooks/:id", a.authorize(permHooksWrite), a.deleteWebhook)
+		scoped.GET("/webhooks/:id/deliveries", a.authorize(permHooksRead), a.listWebhookDeliveries)
+		scoped.POST("/webhooks/:id/deliveries/:delivery_id/replay", a.authorize(permHooksWrite), a.replayWebhookDelivery)
+
+		scoped.GET("/alerts", a.authorize(permAlertsRead), a.listAlerts)
+		scoped.GET("/alerts/rules", a.authorize(permAlertsRead), a.listAlertRules)
+		scoped.POST("/alerts/rules", a.authorize(permAlertsWrite), a.createAlertRule)
+		scoped.DELETE("/alerts/rules/:id", a.authorize(permAlertsWrite), a.deleteAlertRule)
 	}
 }
 
@@ -57,16 +185,69 @@ func (a *App) Router() *gin.Engine {
 	return a.router
 }
 
-// runVMMonitor spins off a go routine that scrapes memory metrics from all active VMs.
-// TODO: orchestrate retry logic, better error handling, graceful things, etc.
-func (a *App) runVMMonitor() {
+// WaitForCreates waits for the VMs being created in the background to finish, returning
+// ctx's error if it's done first.
+func (a *App) WaitForCreates(ctx context.Context) error {
+	done := make(chan struct{})
 	go func() {
-		uptimeTicker := time.NewTicker(1 * time.Minute)
-		for {
-			select {
-			case <-uptimeTicker.C:
-				a.takeMemorySnapshots()
-			}
-		}
+		a.creates.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// corsConfig allows the given origins to call the API with bearer tokens.
+func corsConfig(origins []string) cors.Config {
+	cfg := cors.DefaultConfig()
+	cfg.AddAllowHeaders("Authorization")
+	for _, o := range origins {
+		if o == "*" {
+			cfg.AllowAllOrigins = true
+			return cfg
+		}
+	}
+	cfg.AllowOrigins = origins
+	return cfg
+}
+
+// untimedContextKey holds the request's context from before any timeout was applied.
+const untimedContextKey = "untimed_context"
+
+// timeout gives the request's context a deadline d from now. Handlers see it through
+// c.Request.Context() and pass it on to storage and libvirt, which give up once it passes.
+// A route's own timeout replaces its group's, even if it's longer, so it's derived from
+// the context as it was before the group's timeout.
+func timeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		base := c.Request.Context()
+		if v, ok := c.Get(untimedContextKey); ok {
+			base = v.(context.Context)
+		} else {
+			c.Set(untimedContextKey, base)
+		}
+		ctx, cancel := context.WithTimeout(base, d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// instrument records the latency of every request by its route template rather than the
+// raw path, so /vms/1 and /vms/2 share a series. Unmatched routes are grouped together.
+func instrument(m *metrics.Collector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.ObserveAPIRequest(route, c.Request.Method, c.Writer.Status(), time.Since(start))
+	}
 }
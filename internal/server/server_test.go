@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/auth"
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/metrics"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeStore authenticates a fixed set of tokens and records audit events. Any other
+// Datastore method panics through the nil embedded interface, so tests that reach one
+// must override it.
+type fakeStore struct {
+	storage.Datastore
+
+	mu     sync.Mutex
+	users  map[string]storage.User
+	audits []storage.AuditEvent
+}
+
+func (f *fakeStore) AuthenticateAPIKey(ctx context.Context, tokenHash string) (storage.User, storage.APIKey, error) {
+	u, ok := f.users[tokenHash]
+	if !ok {
+		return storage.User{}, storage.APIKey{}, storage.ErrNotFound
+	}
+	return u, storage.APIKey{UserID: u.ID}, nil
+}
+
+func (f *fakeStore) RecordAuditEvent(ctx context.Context, e storage.AuditEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audits = append(f.audits, e)
+	return nil
+}
+
+// testToken returns a well formed token unique to n.
+func testToken(n byte) string {
+	return auth.TokenPrefix + strings.Repeat(string("0123456789abcdef"[n%16]), 64)
+}
+
+// newTestApp returns an App backed by db with no libvirt connection, and tokens for an
+// admin and a regular user.
+func newTestApp(t *testing.T, db *fakeStore) (app *App, adminToken, userToken string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	adminToken, userToken = testToken(1), testToken(2)
+	db.users = map[string]storage.User{
+		auth.HashToken(adminToken): {ID: 1, Email: "admin@example.com", Admin: true},
+		auth.HashToken(userToken):  {ID: 2, Email: "user@example.com"},
+	}
+	cfg := config.Server{
+		RequestTimeout:  config.Duration{Duration: time.Minute},
+		CreateVMTimeout: config.Duration{Duration: time.Minute},
+	}
+	return New(nil, db, nil, nil, nil, metrics.New("test"), cfg, log), adminToken, userToken
+}
+
+// do sends a request to app as the holder of token.
+func do(app *App, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.Router().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminOnlyRoutes(t *testing.T) {
+	app, _, userToken := newTestApp(t, &fakeStore{})
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/v1/users", ""},
+		{http.MethodPost, "/api/v1/users", `{"email": "eve@example.com", "admin": true}`},
+		{http.MethodPost, "/api/v1/users/1/keys", `{"name": "mine now"}`},
+		{http.MethodGet, "/api/v1/audit", ""},
+		{http.MethodPut, "/api/v1/host-keys/example.com", `{"public_key": "ssh-ed25519 AAAA"}`},
+	}
+	for _, r := range routes {
+		if w := do(app, r.method, r.path, userToken, r.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s as a regular user = %d, want %d: %s", r.method, r.path, w.Code, http.StatusForbidden, w.Body)
+		}
+		if w := do(app, r.method, r.path, "", r.body); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a key = %d, want %d", r.method, r.path, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+// memberStore keeps one project's members in memory, refusing changes that leave it
+// without an admin as the database does.
+type memberStore struct {
+	fakeStore
+	roles map[int]string
+}
+
+func (m *memberStore) GetProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	role, ok := m.roles[userID]
+	if !ok || projectID != 1 {
+		return "", storage.ErrNotFound
+	}
+	return role, nil
+}
+
+func (m *memberStore) SetProjectMemberRole(ctx context.Context, projectID, userID int, role string) error {
+	return m.change(userID, role)
+}
+
+func (m *memberStore) RemoveProjectMember(ctx context.Context, projectID, userID int) error {
+	return m.change(userID, "")
+}
+
+func (m *memberStore) change(userID int, role string) error {
+	old, ok := m.roles[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	m.roles[userID] = role
+	for _, r := range m.roles {
+		if r == storage.RoleAdmin {
+			if role == "" {
+				delete(m.roles, userID)
+			}
+			return nil
+		}
+	}
+	m.roles[userID] = old
+	return storage.ErrLastAdmin
+}
+
+func TestLastProjectAdmin(t *testing.T) {
+	db := &memberStore{roles: map[int]string{2: storage.RoleAdmin, 3: storage.RoleViewer}}
+	app, _, userToken := newTestApp(t, &db.fakeStore)
+	app.storage = db
+
+	if w := do(app, http.MethodPut, "/api/v1/projects/1/members/2", userToken, `{"role": "viewer"}`); w.Code != http.StatusConflict {
+		t.Errorf("demoting the last admin = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	if w := do(app, http.MethodDelete, "/api/v1/projects/1/members/2", userToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("removing the last admin = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	if db.roles[2] != storage.RoleAdmin {
+		t.Fatalf("last admin's role = %q, want it unchanged", db.roles[2])
+	}
+
+	if w := do(app, http.MethodPut, "/api/v1/projects/1/members/3", userToken, `{"role": "admin"}`); w.Code != http.StatusOK {
+		t.Fatalf("promoting a viewer = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := do(app, http.MethodDelete, "/api/v1/projects/1/members/2", userToken, ""); w.Code != http.StatusOK {
+		t.Errorf("removing an admin with another left = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+// fakeVMs is a connected libvirt whose VMs are kept in memory. Like fakeStore, any other
+// VMController method panics.
+type fakeVMs struct {
+	cloudkit.VMController
+	domains map[string]bool
+	// release, if set, holds CreateVM back until it's closed.
+	release chan struct{}
+}
+
+func (f *fakeVMs) Connection() cloudkit.ConnectionStatus {
+	return cloudkit.ConnectionStatus{Connected: true}
+}
+
+func (f *fakeVMs) CreateVM(ctx context.Context, machineType string, memoryInGB int, vCPUs int) (cloudkit.VM, error) {
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return cloudkit.VM{}, ctx.Err()
+		}
+	}
+	name := fmt.Sprintf("vm-%d", len(f.domains)+1)
+	f.domains[name] = true
+	return cloudkit.VM{Name: name, DomainID: len(f.domains)}, nil
+}
+
+func (f *fakeVMs) DestroyVM(ctx context.Context, name string) error {
+	delete(f.domains, name)
+	return nil
+}
+
+// quotaStore reserves quota for an operator of project 1 and stores VMs unless broken.
+type quotaStore struct {
+	fakeStore
+	reservations map[int]bool
+	stored       []cloudkit.VM
+	broken       bool
+}
+
+func (q *quotaStore) GetProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	return storage.RoleOperator, nil
+}
+
+func (q *quotaStore) ReserveQuota(ctx context.Context, projectID int, req storage.Resources) (int, error) {
+	id := len(q.reservations) + 1
+	q.reservations[id] = true
+	return id, nil
+}
+
+func (q *quotaStore) ReleaseQuota(ctx context.Context, reservationID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	delete(q.reservations, reservationID)
+	return nil
+}
+
+func (q *quotaStore) CreateVM(ctx context.Context, projectID int, vm cloudkit.VM, reservationID int) (int, error) {
+	if q.broken {
+		return 0, errors.New("database is down")
+	}
+	q.stored = append(q.stored, vm)
+	delete(q.reservations, reservationID)
+	return len(q.stored), nil
+}
+
+// createVM asks app to create a VM on ctx, returning the response and a subscription to
+// operation progress opened beforehand.
+func createVM(t *testing.T, ctx context.Context, app *App, token string) (*httptest.ResponseRecorder, *events.Subscription) {
+	t.Helper()
+	_, sub := app.events.Subscribe(events.Filter{Types: []string{events.TypeOperationProgress}}, 0)
+	t.Cleanup(sub.Close)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vms", strings.NewReader(`{"machineType": "ubuntu", "memory": 1, "vcpus": 1}`))
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(ProjectHeader, "1")
+	w := httptest.NewRecorder()
+	app.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("creating a VM = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	return w, sub
+}
+
+// finished waits for an operation to succeed or fail.
+func finished(t *testing.T, sub *events.Subscription) operation {
+	t.Helper()
+	for {
+		select {
+		case ev := <-sub.C:
+			if op := ev.Data.(operation); op.Status != operationRunning {
+				return op
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the operation didn't finish")
+		}
+	}
+}
+
+func TestCreateVMOutlivesRequest(t *testing.T) {
+	db := &quotaStore{reservations: map[int]bool{}}
+	app, _, userToken := newTestApp(t, &db.fakeStore)
+	app.storage = db
+	vms := &fakeVMs{domains: map[string]bool{}, release: make(chan struct{})}
+	app.manager = vms
+	app.events = events.NewBroker(16)
+
+	// The client goes away as soon as it's answered, long before the VM is ready.
+	ctx, cancel := context.WithCancel(context.Background())
+	_, sub := createVM(t, ctx, app, userToken)
+	cancel()
+	close(vms.release)
+
+	if op := finished(t, sub); op.Status != operationSucceeded || op.vmName != "vm-1" {
+		t.Errorf("operation = %+v, want vm-1 created", op)
+	}
+	if len(db.stored) != 1 || len(db.reservations) != 0 {
+		t.Errorf("stored %v with reservations %v left, want vm-1 stored against its reservation", db.stored, db.reservations)
+	}
+}
+
+func TestCreateVMCleansUpWhenStoringFails(t *testing.T) {
+	db := &quotaStore{reservations: map[int]bool{}, broken: true}
+	app, _, userToken := newTestApp(t, &db.fakeStore)
+	app.storage = db
+	vms := &fakeVMs{domains: map[string]bool{}}
+	app.manager = vms
+	app.events = events.NewBroker(16)
+
+	_, sub := createVM(t, context.Background(), app, userToken)
+
+	if op := finished(t, sub); op.Status != operationFailed || op.Detail != "internal error" {
+		t.Errorf("operation = %+v, want failed with the error's message", op)
+	}
+	if len(vms.domains) != 0 {
+		t.Errorf("domains left behind = %v, want none", vms.domains)
+	}
+	if len(db.reservations) != 0 {
+		t.Errorf("quota reservations left behind = %v, want none", db.reservations)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	app, _, _ := newTestApp(t, &fakeStore{})
+	app.proxies, _ = config.Server{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}}.Proxies()
+
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// Only trusted proxies are believed.
+		{"203.0.113.9:1234", "198.51.100.7", "203.0.113.9"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		// Addresses a client prepended itself are skipped over.
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7, 192.0.2.1", "198.51.100.7"},
+		// Junk stops the walk at the last proxy that can be believed.
+		{"10.1.2.3:1234", "not an ip", "10.1.2.3"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			c.Request.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := app.clientIP(c); got != tt.want {
+			t.Errorf("clientIP from %s forwarding %q = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+// vmStore holds a single VM, 7, in project 1 for an admin of every project.
+type vmStore struct {
+	fakeStore
+	deleted []int
+}
+
+func (v *vmStore) GetProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	return storage.RoleAdmin, nil
+}
+
+func (v *vmStore) GetProjectVM(ctx context.Context, projectID, id int) (storage.VMRecord, error) {
+	if projectID != 1 || id != 7 {
+		return storage.VMRecord{}, storage.ErrNotFound
+	}
+	return storage.VMRecord{ID: 7, ProjectID: 1, DomainID: -1, Name: "vm-7", State: cloudkit.StateLost}, nil
+}
+
+func (v *vmStore) DeleteVM(ctx context.Context, id int) error {
+	v.deleted = append(v.deleted, id)
+	return nil
+}
+
+func TestDeleteVMByID(t *testing.T) {
+	db := &vmStore{}
+	app, _, userToken := newTestApp(t, &db.fakeStore)
+	app.storage = db
+	app.events = events.NewBroker(16)
+
+	del := func(path, project string) int {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		req.Header.Set(ProjectHeader, project)
+		w := httptest.NewRecorder()
+		app.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// -1 is the domain ID of every domain that's off, so it mustn't address a VM.
+	if code := del("/api/v1/vms/-1", "1"); code != http.StatusBadRequest {
+		t.Errorf("DELETE /vms/-1 = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := del("/api/v1/vms/7", "2"); code != http.StatusNotFound {
+		t.Errorf("deleting another project's VM = %d, want %d", code, http.StatusNotFound)
+	}
+	if len(db.deleted) != 0 {
+		t.Fatalf("deleted %v, want nothing deleted yet", db.deleted)
+	}
+	if code := del("/api/v1/vms/7", "1"); code != http.StatusOK {
+		t.Errorf("DELETE /vms/7 = %d, want %d", code, http.StatusOK)
+	}
+	if len(db.deleted) != 1 || db.deleted[0] != 7 {
+		t.Errorf("deleted %v, want [7]", db.deleted)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// streamKeepAlive is how often an idle stream gets a heartbeat so proxies don't close it.
+const streamKeepAlive = 15 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// CORS is handled by the router, so any origin that got this far is allowed.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// StreamEventsReq describes the optional filters for an event stream. Both filters accept
+// repeated params or comma separated values, e.g. ?type=vm.started,vm.crashed&vm=web-1.
+type StreamEventsReq struct {
+	VMs   []string `form:"vm"`
+	Types []string `form:"type"`
+	// LastEventID resumes the stream after the given event. The Last-Event-ID header that
+	// browsers send when reconnecting an EventSource is used when this is empty.
+	LastEventID uint64 `form:"last_event_id"`
+}
+
+// subscribe binds the stream filters from the request and subscribes to the broker,
+// returning any events from the caller's project to replay first.
+func (a *App) subscribe(c *gin.Context) ([]events.Event, *events.Subscription, bool) {
+	var req StreamEventsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, invalid(err))
+		return nil, nil, false
+	}
+
+	if req.LastEventID == 0 {
+		if h := c.GetHeader("Last-Event-ID"); h != "" {
+			id, err := strconv.ParseUint(h, 10, 64)
+			if err != nil {
+				fail(c, apperr.New(apperr.InvalidArgument, "invalid Last-Event-ID header"))
+				return nil, nil, false
+			}
+			req.LastEventID = id
+		}
+	}
+
+	f := events.Filter{VMs: splitParams(req.VMs), Types: splitParams(req.Types)}
+	replay, sub := a.events.Subscribe(f, req.LastEventID)
+
+	visible := replay[:0]
+	for _, ev := range replay {
+		if a.visible(c, ev) {
+			visible = append(visible, ev)
+		}
+	}
+	return visible, sub, true
+}
+
+// visible reports whether ev belongs to the caller's project. Events that belong to no
+// project are never streamed.
+func (a *App) visible(c *gin.Context, ev events.Event) bool {
+	return a.owners.Project(c.Request.Context(), ev) == currentProject(c)
+}
+
+// streamEventsSSE streams events as Server-Sent Events.
+func (a *App) streamEventsSSE(c *gin.Context) {
+	replay, sub, ok := a.subscribe(c)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	heartbeat := time.NewTicker(streamKeepAlive)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		if len(replay) > 0 {
+			for _, ev := range replay {
+				c.Render(-1, sseEvent(ev))
+			}
+			replay = nil
+			return true
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case ev, open := <-sub.C:
+			if !open {
+				return false
+			}
+			if a.visible(c, ev) {
+				c.Render(-1, sseEvent(ev))
+			}
+		case <-heartbeat.C:
+			io.WriteString(w, ": keepalive\n\n")
+		}
+		return true
+	})
+}
+
+func sseEvent(ev events.Event) sse.Event {
+	return sse.Event{Id: strconv.FormatUint(ev.ID, 10), Event: ev.Type, Data: ev}
+}
+
+// streamEventsWS streams events as JSON text messages over a WebSocket.
+func (a *App) streamEventsWS(c *gin.Context) {
+	replay, sub, ok := a.subscribe(c)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response.
+		a.logger.Warnf("failed to upgrade event stream to websocket, err: %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	// We never expect messages from the client, but reading is how close frames and
+	// disconnects are noticed.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, ev := range replay {
+		if err := conn.WriteJSON(ev); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamKeepAlive)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev, open := <-sub.C:
+			if !open {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				return
+			}
+			if !a.visible(c, ev) {
+				continue
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// splitParams flattens repeated and comma separated query params into one list.
+func splitParams(params []string) []string {
+	var out []string
+	for _, p := range params {
+		for _, v := range strings.Split(p, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/bradford-hamilton/cloudkit-core/internal/webhooks"
+	"github.com/gin-gonic/gin"
+)
+
+// webhookDeliveriesLimit caps how many deliveries listWebhookDeliveries returns.
+const webhookDeliveriesLimit = 100
+
+// CreateWebhookReq describes the request needed to register a webhook.
+type CreateWebhookReq struct {
+	// URL must be an absolute http or https URL with a public address. Loopback, private
+	// and link-local addresses are refused, including ones a host name resolves to when a
+	// delivery is sent.
+	URL string `json:"url" binding:"required"`
+	// Events optionally filters deliveries, e.g. ["vm.crashed", "alert.*"].
+	Events []string `json:"events"`
+	// Secret signs deliveries. One is generated when left empty.
+	Secret string `json:"secret"`
+}
+
+// WebhookReq describes the URI params needed to address a webhook.
+type WebhookReq struct {
+	ID int `uri:"id" binding:"required"`
+}
+
+// WebhookDeliveryReq describes the URI params needed to address a single delivery.
+type WebhookDeliveryReq struct {
+	ID         int `uri:"id" binding:"required"`
+	DeliveryID int `uri:"delivery_id" binding:"required"`
+}
+
+func (a *App) createWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req CreateWebhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail(c, apperr.New(apperr.InvalidArgument, "url must be an absolute http or https URL"))
+		return
+	}
+	if err := webhooks.CheckURL(u); err != nil {
+		fail(c, apperr.New(apperr.InvalidArgument, err.Error()))
+		return
+	}
+	for _, ev := range req.Events {
+		if !strings.HasPrefix(ev, "vm.") && !strings.HasPrefix(ev, "alert.") {
+			fail(c, apperr.New(apperr.InvalidArgument, "unsupported event type "+ev))
+			return
+		}
+	}
+	if req.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			fail(c, err)
+			return
+		}
+		req.Secret = hex.EncodeToString(b)
+	}
+	if req.Events == nil {
+		req.Events = []string{}
+	}
+
+	w, err := a.storage.CreateWebhook(ctx, storage.Webhook{ProjectID: currentProject(c), URL: req.URL, Events: req.Events, Secret: req.Secret})
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{"webhook": w}})
+}
+
+func (a *App) listWebhooks(c *gin.Context) {
+	ctx := c.Request.Context()
+	hooks, err := a.storage.ListWebhooks(ctx, currentProject(c))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"webhooks": hooks}})
+}
+
+func (a *App) deleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req WebhookReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.DeleteWebhook(ctx, currentProject(c), req.ID); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "webhook not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (a *App) listWebhookDeliveries(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req WebhookReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	deliveries, err := a.storage.ListWebhookDeliveries(ctx, currentProject(c), req.ID, webhookDeliveriesLimit)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"deliveries": deliveries}})
+}
+
+func (a *App) replayWebhookDelivery(c *gin.Context) {
+	ctx := c.Request.Context()
+	var req WebhookDeliveryReq
+	if err := c.ShouldBindUri(&req); err != nil {
+		fail(c, invalid(err))
+		return
+	}
+
+	if err := a.storage.ReplayWebhookDelivery(ctx, currentProject(c), req.ID, req.DeliveryID); err != nil {
+		if err == storage.ErrNotFound {
+			fail(c, apperr.New(apperr.NotFound, "delivery not found"))
+			return
+		}
+		fail(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "delivery queued"})
+}
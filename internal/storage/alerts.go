@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Alert statuses.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule fires an alert for a VM when Metric compared to Threshold has held for at
+// least DurationSeconds, e.g. memory_usage > 90 for 300 seconds.
+type AlertRule struct {
+	ID              int     `json:"id"`
+	ProjectID       int     `json:"project_id"`
+	Name            string  `json:"name"`
+	Metric          string  `json:"metric"`
+	Comparison      string  `json:"comparison"`
+	Threshold       float64 `json:"threshold"`
+	DurationSeconds int     `json:"duration_seconds"`
+	// VMName limits the rule to one of the project's VMs. Empty applies it to all of them.
+	VMName string `json:"vm_name,omitempty"`
+	// Notify lists the sinks to notify, e.g. "log" or "email". Empty notifies all of them.
+	Notify    []string  `json:"notify"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Alert is a single firing of an AlertRule against a VM.
+type Alert struct {
+	ID         int        `json:"id"`
+	ProjectID  int        `json:"project_id"`
+	RuleID     int        `json:"rule_id"`
+	RuleName   string     `json:"rule_name"`
+	VMName     string     `json:"vm_name"`
+	Metric     string     `json:"metric"`
+	Comparison string     `json:"comparison"`
+	Threshold  float64    `json:"threshold"`
+	Value      float64    `json:"value"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// CreateAlertRule inserts an alert rule and returns it with its ID and creation time set.
+func (db *Database) CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error) {
+	query := `INSERT INTO alert_rules (project_id, name, metric, comparison, threshold, duration_seconds, vm_name, notify)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at;`
+
+	row := db.QueryRowContext(ctx, query, r.ProjectID, r.Name, r.Metric, r.Comparison, r.Threshold, r.DurationSeconds, r.VMName, pq.Array(r.Notify))
+	if err := row.Scan(&r.ID, &r.CreatedAt); err != nil {
+		return AlertRule{}, err
+	}
+
+	return r, nil
+}
+
+// ListAlertRules retrieves a project's alert rules, or every rule if projectID is 0,
+// oldest first.
+func (db *Database) ListAlertRules(ctx context.Context, projectID int) ([]AlertRule, error) {
+	query := `SELECT id, project_id, name, metric, comparison, threshold, duration_seconds, vm_name, notify, created_at
+		FROM alert_rules WHERE $1 = 0 OR project_id = $1 ORDER BY id ASC;`
+
+	rows, err := db.QueryContext(ctx, query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		var r AlertRule
+		err := rows.Scan(&r.ID, &r.ProjectID, &r.Name, &r.Metric, &r.Comparison, &r.Threshold, &r.DurationSeconds,
+			&r.VMName, pq.Array(&r.Notify), &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// DeleteAlertRule removes a project's alert rule and, by cascade, its alerts.
+func (db *Database) DeleteAlertRule(ctx context.Context, projectID, id int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM alert_rules WHERE id = $1 AND project_id = $2;", id, projectID)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// CreateAlert inserts a firing alert and returns it with its ID set.
+func (db *Database) CreateAlert(ctx context.Context, a Alert) (Alert, error) {
+	query := `INSERT INTO alerts (project_id, rule_id, vm_name, status, value, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;`
+
+	if err := db.QueryRowContext(ctx, query, a.ProjectID, a.RuleID, a.VMName, a.Status, a.Value, a.StartedAt).Scan(&a.ID); err != nil {
+		return Alert{}, err
+	}
+
+	return a, nil
+}
+
+// ResolveAlert marks a firing alert resolved, recording the value that resolved it.
+func (db *Database) ResolveAlert(ctx context.Context, id int, value float64, at time.Time) error {
+	query := "UPDATE alerts SET status = 'resolved', value = $2, resolved_at = $3 WHERE id = $1;"
+	res, err := db.ExecContext(ctx, query, id, value, at)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// ListAlerts retrieves a project's most recent alerts, or everyone's if projectID is 0,
+// newest first. An empty status matches every alert.
+func (db *Database) ListAlerts(ctx context.Context, projectID int, status string, limit int) ([]Alert, error) {
+	query := `SELECT a.id, a.project_id, a.rule_id, r.name, a.vm_name, r.metric, r.comparison, r.threshold, a.value,
+		a.status, a.started_at, a.resolved_at
+		FROM alerts a JOIN alert_rules r ON r.id = a.rule_id
+		WHERE ($1 = 0 OR a.project_id = $1) AND ($2 = '' OR a.status = $2)
+		ORDER BY a.started_at DESC LIMIT $3;`
+
+	rows, err := db.QueryContext(ctx, query, projectID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		var (
+			a  Alert
+			at sql.NullTime
+		)
+		err := rows.Scan(&a.ID, &a.ProjectID, &a.RuleID, &a.RuleName, &a.VMName, &a.Metric, &a.Comparison, &a.Threshold,
+			&a.Value, &a.Status, &a.StartedAt, &at)
+		if err != nil {
+			return nil, err
+		}
+		if at.Valid {
+			a.ResolvedAt = &at.Time
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
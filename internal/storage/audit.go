@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Audit results.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// AuditEvent records one mutating API request.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	ActorID    int       `json:"actor_id,omitempty"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	ProjectID  int       `json:"project_id,omitempty"`
+	// Action is the method and route template, e.g. "DELETE /api/v1/webhooks/:id".
+	Action string `json:"action"`
+	// Target is the path the request was made to, e.g. "/api/v1/webhooks/3".
+	Target string `json:"target"`
+	// Payload is the request body with secrets redacted, if it was JSON.
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Status   int             `json:"status"`
+	Result   string          `json:"result"`
+	SourceIP string          `json:"source_ip"`
+}
+
+// AuditFilter narrows ListAuditEvents. Zero fields match everything.
+type AuditFilter struct {
+	ActorID   int
+	ProjectID int
+	// Action matches actions starting with it, e.g. "POST" or "DELETE /api/v1/keys".
+	Action string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	// BeforeID pages backwards, returning only events older than it.
+	BeforeID int64
+	Limit    int
+}
+
+// RecordAuditEvent appends an event to the audit trail.
+func (db *Database) RecordAuditEvent(ctx context.Context, e AuditEvent) error {
+	query := `INSERT INTO audit_events
+		(time, actor_id, actor_email, project_id, action, target, payload, status, result, source_ip)
+		VALUES ($1, NULLIF($2, 0), $3, NULLIF($4, 0), $5, $6, $7, $8, $9, $10);`
+
+	// pq would send a []byte as bytea, which jsonb won't accept.
+	var payload interface{}
+	if len(e.Payload) > 0 {
+		payload = string(e.Payload)
+	}
+	_, err := db.ExecContext(ctx, query, e.Time, e.ActorID, e.ActorEmail, e.ProjectID, e.Action, e.Target, payload,
+		e.Status, e.Result, e.SourceIP)
+	return err
+}
+
+// ListAuditEvents retrieves audit events matching f, newest first.
+func (db *Database) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.ProjectID != 0 {
+		add("project_id = $%d", f.ProjectID)
+	}
+	if f.Action != "" {
+		add("action LIKE $%d || '%%'", f.Action)
+	}
+	if f.Result != "" {
+		add("result = $%d", f.Result)
+	}
+	if !f.Since.IsZero() {
+		add("time >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("time < $%d", f.Until)
+	}
+	if f.BeforeID != 0 {
+		add("id < $%d", f.BeforeID)
+	}
+
+	query := `SELECT id, time, COALESCE(actor_id, 0), actor_email, COALESCE(project_id, 0), action, target,
+		payload, status, result, source_ip FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d;", len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var (
+			e       AuditEvent
+			payload sql.RawBytes
+		)
+		err := rows.Scan(&e.ID, &e.Time, &e.ActorID, &e.ActorEmail, &e.ProjectID, &e.Action, &e.Target,
+			&payload, &e.Status, &e.Result, &e.SourceIP)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) > 0 {
+			e.Payload = append(json.RawMessage(nil), payload...)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/lib/pq"
+)
+
+// ErrConflict is returned when an insert would duplicate a unique value.
+var ErrConflict = apperr.New(apperr.Conflict, "already exists")
+
+// User is someone, or something, that calls the API.
+type User struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	// Admin grants system wide access, over every project and the host itself.
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey authenticates requests on behalf of a user. The token itself is only returned
+// when the key is created; afterwards the key is identified by Prefix.
+type APIKey struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+	// Prefix is the first few characters of the token, to tell keys apart.
+	Prefix     string     `json:"prefix"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateUser inserts a user and returns it with its ID and creation time set. It returns
+// ErrConflict if the email is already taken.
+func (db *Database) CreateUser(ctx context.Context, u User) (User, error) {
+	query := "INSERT INTO users (email, name, is_admin) VALUES ($1, $2, $3) RETURNING id, created_at;"
+
+	if err := db.QueryRowContext(ctx, query, u.Email, u.Name, u.Admin).Scan(&u.ID, &u.CreatedAt); err != nil {
+		return User{}, uniqueViolation(err)
+	}
+
+	return u, nil
+}
+
+// BootstrapAdmin creates the first user, in one transaction with their API key, stored by
+// the hash of its token, and their admin membership of the default project, which is
+// created if it's missing. It returns ErrConflict, storing nothing, if a user already
+// exists.
+func (db *Database) BootstrapAdmin(ctx context.Context, u User, k APIKey, tokenHash string) (User, APIKey, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, APIKey{}, err
+	}
+	defer tx.Rollback()
+
+	// Servers starting together wait for each other here, so only one bootstraps.
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+		return User{}, APIKey{}, err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users);").Scan(&exists); err != nil {
+		return User{}, APIKey{}, err
+	}
+	if exists {
+		return User{}, APIKey{}, ErrConflict
+	}
+
+	query := "INSERT INTO users (email, name, is_admin) VALUES ($1, $2, $3) RETURNING id, created_at;"
+	if err := tx.QueryRowContext(ctx, query, u.Email, u.Name, u.Admin).Scan(&u.ID, &u.CreatedAt); err != nil {
+		return User{}, APIKey{}, err
+	}
+
+	// The schema creates the default project so existing VMs have an owner.
+	var projectID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM projects WHERE name = $1;", DefaultProject).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		query = "INSERT INTO projects (name) VALUES ($1) RETURNING id;"
+		if err = tx.QueryRowContext(ctx, query, DefaultProject).Scan(&projectID); err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO project_quotas (project_id) VALUES ($1);", projectID)
+		}
+	}
+	if err != nil {
+		return User{}, APIKey{}, err
+	}
+	query = "INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3);"
+	if _, err := tx.ExecContext(ctx, query, projectID, u.ID, RoleAdmin); err != nil {
+		return User{}, APIKey{}, err
+	}
+
+	k.UserID = u.ID
+	query = `INSERT INTO api_keys (user_id, name, prefix, token_hash) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`
+	if err := tx.QueryRowContext(ctx, query, k.UserID, k.Name, k.Prefix, tokenHash).Scan(&k.ID, &k.CreatedAt); err != nil {
+		return User{}, APIKey{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return User{}, APIKey{}, err
+	}
+	return u, k, nil
+}
+
+// ListUsers retrieves every user, oldest first.
+func (db *Database) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, email, name, is_admin, created_at FROM users ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Admin, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// CreateAPIKey inserts an API key for a user, storing only the hash of its token. It
+// returns ErrNotFound if the user doesn't exist.
+func (db *Database) CreateAPIKey(ctx context.Context, k APIKey, tokenHash string) (APIKey, error) {
+	query := `INSERT INTO api_keys (user_id, name, prefix, token_hash) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`
+
+	if err := db.QueryRowContext(ctx, query, k.UserID, k.Name, k.Prefix, tokenHash).Scan(&k.ID, &k.CreatedAt); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return APIKey{}, ErrNotFound
+		}
+		return APIKey{}, err
+	}
+
+	return k, nil
+}
+
+// ListAPIKeys retrieves a user's API keys, revoked ones included, oldest first.
+func (db *Database) ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error) {
+	query := `SELECT id, user_id, name, prefix, created_at, last_used_at, revoked_at
+		FROM api_keys WHERE user_id = $1 ORDER BY id ASC;`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var (
+			k       APIKey
+			used    sql.NullTime
+			revoked sql.NullTime
+		)
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.CreatedAt, &used, &revoked); err != nil {
+			return nil, err
+		}
+		if used.Valid {
+			k.LastUsedAt = &used.Time
+		}
+		if revoked.Valid {
+			k.RevokedAt = &revoked.Time
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey stops a user's API key from authenticating any further requests.
+func (db *Database) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	query := "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;"
+	res, err := db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// AuthenticateAPIKey looks up the user owning an unrevoked API key by the hash of its
+// token, marking the key as used. It returns ErrNotFound for unknown or revoked keys.
+func (db *Database) AuthenticateAPIKey(ctx context.Context, tokenHash string) (User, APIKey, error) {
+	query := `UPDATE api_keys k SET last_used_at = NOW()
+		FROM users u
+		WHERE u.id = k.user_id AND k.token_hash = $1 AND k.revoked_at IS NULL
+		RETURNING u.id, u.email, u.name, u.is_admin, u.created_at, k.id, k.name, k.prefix, k.created_at, k.last_used_at;`
+
+	var (
+		u User
+		k APIKey
+	)
+	err := db.QueryRowContext(ctx, query, tokenHash).Scan(&u.ID, &u.Email, &u.Name, &u.Admin, &u.CreatedAt,
+		&k.ID, &k.Name, &k.Prefix, &k.CreatedAt, &k.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return User{}, APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, APIKey{}, err
+	}
+	k.UserID = u.ID
+
+	return u, k, nil
+}
+
+// uniqueViolation turns a Postgres unique constraint violation into ErrConflict.
+func uniqueViolation(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrConflict
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
+)
+
+// ListHostKeys retrieves the SSH host keys accepted from host, or from every host if
+// host is empty, ordered by host and then oldest first.
+func (db *Database) ListHostKeys(ctx context.Context, host string) ([]hostcreds.Key, error) {
+	query := `SELECT host, key_type, public_key, fingerprint, pinned, added_at FROM host_keys
+		WHERE $1 = '' OR host = $1 ORDER BY host ASC, id ASC;`
+
+	rows, err := db.QueryContext(ctx, query, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []hostcreds.Key
+	for rows.Next() {
+		var k hostcreds.Key
+		if err := rows.Scan(&k.Host, &k.Type, &k.PublicKey, &k.Fingerprint, &k.Pinned, &k.AddedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// TrustHostKey stores key if its host has no keys yet, reporting whether it did. An
+// advisory lock on the host stops two first connections from both trusting their key.
+func (db *Database) TrustHostKey(ctx context.Context, key hostcreds.Key) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", key.Host); err != nil {
+		return false, err
+	}
+	query := `INSERT INTO host_keys (host, key_type, public_key, fingerprint, pinned)
+		SELECT $1, $2, $3, $4, FALSE WHERE NOT EXISTS (SELECT 1 FROM host_keys WHERE host = $1);`
+	res, err := tx.ExecContext(ctx, query, key.Host, key.Type, key.PublicKey, key.Fingerprint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, tx.Commit()
+}
+
+// PinHostKey makes key the only one accepted from its host, replacing any others, and
+// returns it with its time added set.
+func (db *Database) PinHostKey(ctx context.Context, key hostcreds.Key) (hostcreds.Key, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return hostcreds.Key{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", key.Host); err != nil {
+		return hostcreds.Key{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM host_keys WHERE host = $1;", key.Host); err != nil {
+		return hostcreds.Key{}, err
+	}
+	query := `INSERT INTO host_keys (host, key_type, public_key, fingerprint, pinned)
+		VALUES ($1, $2, $3, $4, TRUE) RETURNING added_at;`
+	err = tx.QueryRowContext(ctx, query, key.Host, key.Type, key.PublicKey, key.Fingerprint).Scan(&key.AddedAt)
+	if err != nil {
+		return hostcreds.Key{}, err
+	}
+	key.Pinned = true
+
+	return key, tx.Commit()
+}
+
+// DeleteHostKeys forgets every key accepted from host, so the next connection trusts
+// whatever key it presents if trust on first use is on.
+func (db *Database) DeleteHostKeys(ctx context.Context, host string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM host_keys WHERE host = $1;", host)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+)
+
+// Raw measurements are kept for RawRetention before only their hourly rollups remain, and
+// hourly rollups are kept for HourlyRetention before only daily rollups remain.
+const (
+	RawRetention    = 7 * 24 * time.Hour
+	HourlyRetention = 90 * 24 * time.Hour
+)
+
+// Each source aggregates into buckets of `step` seconds ($4), along with how many samples
+// went into each. Rollup tables already hold per bucket aggregates, so they are merged:
+// averages are weighted by sample count and p95 is approximated by the largest p95 in the
+// bucket.
+const (
+	rawSeriesQuery = `SELECT to_timestamp(floor(extract(epoch FROM time) / $4) * $4) AS b, metric, device, count(*),
+		avg(value), min(value), max(value), percentile_cont(0.95) WITHIN GROUP (ORDER BY value)
+		FROM raw_measurements WHERE vm_id = $1 AND time >= $2 AND time < $3
+		GROUP BY b, metric, device;`
+
+	rollupSeriesQuery = `SELECT to_timestamp(floor(extract(epoch FROM bucket) / $4) * $4) AS b, metric, device, sum(samples),
+		sum(avg * samples) / sum(samples), min(min), max(max), max(p95)
+		FROM %s WHERE vm_id = $1 AND bucket >= $2 AND bucket < $3
+		GROUP BY b, metric, device;`
+)
+
+// seriesSource is a table to read part of a metrics range from.
+type seriesSource struct {
+	query      string
+	start, end time.Time
+}
+
+// GetVMMetricSeries downsamples every metric recorded for a VM between q.Start and q.End
+// into q.Step wide buckets. Each part of the range is read from the finest source that
+// still covers it: raw measurements for the last RawRetention, hourly rollups before that
+// and daily rollups before HourlyRetention. The boundaries are rounded up to whole hours
+// and days so that no rollup bucket overlaps the source after it. Step is widened to the
+// resolution of the coarsest source read when it is finer than that.
+func (db *Database) GetVMMetricSeries(ctx context.Context, vmID int, q cloudkit.MetricsQuery) ([]cloudkit.Series, error) {
+	now := time.Now()
+	rawFrom := ceilTime(now.Add(-RawRetention), time.Hour)
+	hourlyFrom := ceilTime(now.Add(-HourlyRetention), 24*time.Hour)
+
+	step := q.Step
+	switch {
+	case q.Start.Before(hourlyFrom):
+		if step < 24*time.Hour {
+			step = 24 * time.Hour
+		}
+	case q.Start.Before(rawFrom):
+		if step < time.Hour {
+			step = time.Hour
+		}
+	}
+
+	sources := []seriesSource{
+		{fmt.Sprintf(rollupSeriesQuery, "measurements_daily"), q.Start, minTime(q.End, hourlyFrom)},
+		{fmt.Sprintf(rollupSeriesQuery, "measurements_hourly"), maxTime(q.Start, hourlyFrom), minTime(q.End, rawFrom)},
+		{rawSeriesQuery, maxTime(q.Start, rawFrom), q.End},
+	}
+
+	var buckets []seriesBucket
+	for _, src := range sources {
+		if !src.start.Before(src.end) {
+			continue
+		}
+		b, err := db.querySeriesBuckets(ctx, src, vmID, step)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b...)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if a.metric != b.metric {
+			return a.metric < b.metric
+		}
+		if a.device != b.device {
+			return a.device < b.device
+		}
+		return a.time.Before(b.time)
+	})
+
+	var series []cloudkit.Series
+	for i := 0; i < len(buckets); i++ {
+		b := buckets[i]
+		// A bucket straddling a source boundary comes back once from each source.
+		for i+1 < len(buckets) && buckets[i+1].sameBucket(b) {
+			i++
+			b = b.merge(buckets[i])
+		}
+
+		// Buckets are sorted by metric and device, so a new series starts whenever either changes.
+		if n := len(series); n == 0 || series[n-1].Metric != b.metric || series[n-1].Device != b.device {
+			series = append(series, cloudkit.Series{Metric: b.metric, Device: b.device})
+		}
+		series[len(series)-1].Points = append(series[len(series)-1].Points, cloudkit.Aggregate{
+			Time: b.time.Format(time.RFC3339Nano),
+			Avg:  b.avg,
+			Min:  b.min,
+			Max:  b.max,
+			P95:  b.p95,
+		})
+	}
+
+	return series, nil
+}
+
+// seriesBucket is one bucket of one metric as read from a single source.
+type seriesBucket struct {
+	time               time.Time
+	metric, device     string
+	samples            int64
+	avg, min, max, p95 float64
+}
+
+func (b seriesBucket) sameBucket(o seriesBucket) bool {
+	return b.metric == o.metric && b.device == o.device && b.time.Equal(o.time)
+}
+
+// merge combines the same bucket read from two sources the way the rollup query does.
+func (b seriesBucket) merge(o seriesBucket) seriesBucket {
+	if total := b.samples + o.samples; total > 0 {
+		b.avg = (b.avg*float64(b.samples) + o.avg*float64(o.samples)) / float64(total)
+		b.samples = total
+	}
+	b.min = math.Min(b.min, o.min)
+	b.max = math.Max(b.max, o.max)
+	b.p95 = math.Max(b.p95, o.p95)
+	return b
+}
+
+func (db *Database) querySeriesBuckets(ctx context.Context, src seriesSource, vmID int, step time.Duration) ([]seriesBucket, error) {
+	rows, err := db.QueryContext(ctx, src.query, vmID, src.start, src.end, step.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []seriesBucket
+	for rows.Next() {
+		var b seriesBucket
+		if err := rows.Scan(&b.time, &b.metric, &b.device, &b.samples, &b.avg, &b.min, &b.max, &b.p95); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// ceilTime rounds t up to a multiple of d since the Unix epoch, matching rollup buckets,
+// which RollupMeasurements truncates in UTC whatever the session's TimeZone.
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	if r := t.Truncate(d); !r.Equal(t) {
+		return r.Add(d)
+	}
+	return t
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// RollupMeasurements aggregates every complete hour of raw measurements into
+// measurements_hourly and every complete day of hourly rollups into measurements_daily,
+// then drops raw and hourly rows that are past retention. It only rolls up buckets newer
+// than the latest existing rollup, so it is cheap to call on every monitor tick. Buckets
+// are truncated in UTC rather than the session's TimeZone so they line up with ceilTime.
+func (db *Database) RollupMeasurements(ctx context.Context, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hourly := `INSERT INTO measurements_hourly (bucket, vm_id, metric, device, samples, avg, min, max, p95)
+		SELECT date_trunc('hour', time AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS b, vm_id, metric, device, count(*), avg(value), min(value),
+			max(value), percentile_cont(0.95) WITHIN GROUP (ORDER BY value)
+		FROM raw_measurements
+		WHERE time < date_trunc('hour', $1::timestamptz AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+			AND time >= COALESCE((SELECT max(bucket) + INTERVAL '1 hour' FROM measurements_hourly), '-infinity')
+		GROUP BY b, vm_id, metric, device
+		ON CONFLICT DO NOTHING;`
+	if _, err := tx.ExecContext(ctx, hourly, now); err != nil {
+		return err
+	}
+
+	daily := `INSERT INTO measurements_daily (bucket, vm_id, metric, device, samples, avg, min, max, p95)
+		SELECT date_trunc('day', bucket AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS b, vm_id, metric, device, sum(samples),
+			sum(avg * samples) / sum(samples), min(min), max(max), max(p95)
+		FROM measurements_hourly
+		WHERE bucket < date_trunc('day', $1::timestamptz AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+			AND bucket >= COALESCE((SELECT max(bucket) + INTERVAL '1 day' FROM measurements_daily), '-infinity')
+		GROUP BY b, vm_id, metric, device
+		ON CONFLICT DO NOTHING;`
+	if _, err := tx.ExecContext(ctx, daily, now); err != nil {
+		return err
+	}
+
+	rawCutoff := now.Add(-RawRetention)
+	for _, table := range []string{"measurements", "cpu_measurements", "disk_measurements", "net_measurements"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE time < $1;", rawCutoff); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM measurements_hourly WHERE bucket < $1;", now.Add(-HourlyRetention)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,21 @@
+-- Drop everything 0001_initial created, dependents first --
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS quota_reservations;
+DROP TABLE IF EXISTS project_quotas;
+DROP TABLE IF EXISTS project_members;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS alerts;
+DROP TABLE IF EXISTS alert_rules;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS vm_state_history;
+DROP TABLE IF EXISTS measurements_daily;
+DROP TABLE IF EXISTS measurements_hourly;
+DROP VIEW IF EXISTS raw_measurements;
+DROP TABLE IF EXISTS net_measurements;
+DROP TABLE IF EXISTS disk_measurements;
+DROP TABLE IF EXISTS cpu_measurements;
+DROP TABLE IF EXISTS measurements;
+DROP TABLE IF EXISTS vms;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,286 @@
+-- Create table for storing VM data
+CREATE TABLE IF NOT EXISTS vms (
+  id SERIAL NOT NULL PRIMARY KEY,
+  domain_id INT NOT NULL,
+  name TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create table for storing VM memory snapshots --
+CREATE TABLE IF NOT EXISTS measurements (
+  id SERIAL NOT NULL PRIMARY KEY,
+	time TIMESTAMPTZ NOT NULL,
+	vm_id INT NOT NULL,
+ 	mem_usage DOUBLE PRECISION NOT NULL,
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+-- Create table for storing VM CPU snapshots --
+CREATE TABLE IF NOT EXISTS cpu_measurements (
+  id SERIAL NOT NULL PRIMARY KEY,
+  time TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  cpu_usage DOUBLE PRECISION NOT NULL,
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+-- Create table for storing per disk VM I/O snapshots --
+CREATE TABLE IF NOT EXISTS disk_measurements (
+  id SERIAL NOT NULL PRIMARY KEY,
+  time TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  device TEXT NOT NULL,
+  read_bytes_per_sec DOUBLE PRECISION NOT NULL,
+  write_bytes_per_sec DOUBLE PRECISION NOT NULL,
+  read_iops DOUBLE PRECISION NOT NULL,
+  write_iops DOUBLE PRECISION NOT NULL,
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+-- Create table for storing per interface VM network snapshots --
+CREATE TABLE IF NOT EXISTS net_measurements (
+  id SERIAL NOT NULL PRIMARY KEY,
+  time TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  interface TEXT NOT NULL,
+  rx_bytes_per_sec DOUBLE PRECISION NOT NULL,
+  tx_bytes_per_sec DOUBLE PRECISION NOT NULL,
+  rx_packets_per_sec DOUBLE PRECISION NOT NULL,
+  tx_packets_per_sec DOUBLE PRECISION NOT NULL,
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+CREATE INDEX IF NOT EXISTS measurements_vm_id_time_idx ON measurements (vm_id, time);
+CREATE INDEX IF NOT EXISTS cpu_measurements_vm_id_time_idx ON cpu_measurements (vm_id, time);
+CREATE INDEX IF NOT EXISTS disk_measurements_vm_id_time_idx ON disk_measurements (vm_id, time);
+CREATE INDEX IF NOT EXISTS net_measurements_vm_id_time_idx ON net_measurements (vm_id, time);
+
+-- Flatten every raw measurement table into (time, vm_id, metric, device, value) rows so
+-- they can be downsampled and rolled up with a single query --
+CREATE OR REPLACE VIEW raw_measurements AS
+  SELECT time, vm_id, 'memory_usage' AS metric, '' AS device, mem_usage AS value FROM measurements
+  UNION ALL SELECT time, vm_id, 'cpu_usage', '', cpu_usage FROM cpu_measurements
+  UNION ALL SELECT time, vm_id, 'disk_read_bytes_per_sec', device, read_bytes_per_sec FROM disk_measurements
+  UNION ALL SELECT time, vm_id, 'disk_write_bytes_per_sec', device, write_bytes_per_sec FROM disk_measurements
+  UNION ALL SELECT time, vm_id, 'disk_read_iops', device, read_iops FROM disk_measurements
+  UNION ALL SELECT time, vm_id, 'disk_write_iops', device, write_iops FROM disk_measurements
+  UNION ALL SELECT time, vm_id, 'net_rx_bytes_per_sec', interface, rx_bytes_per_sec FROM net_measurements
+  UNION ALL SELECT time, vm_id, 'net_tx_bytes_per_sec', interface, tx_bytes_per_sec FROM net_measurements
+  UNION ALL SELECT time, vm_id, 'net_rx_packets_per_sec', interface, rx_packets_per_sec FROM net_measurements
+  UNION ALL SELECT time, vm_id, 'net_tx_packets_per_sec', interface, tx_packets_per_sec FROM net_measurements;
+
+-- Create table for hourly rollups of raw measurements --
+CREATE TABLE IF NOT EXISTS measurements_hourly (
+  bucket TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  metric TEXT NOT NULL,
+  device TEXT NOT NULL DEFAULT '',
+  samples INT NOT NULL,
+  avg DOUBLE PRECISION NOT NULL,
+  min DOUBLE PRECISION NOT NULL,
+  max DOUBLE PRECISION NOT NULL,
+  p95 DOUBLE PRECISION NOT NULL,
+  PRIMARY KEY (vm_id, metric, device, bucket),
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+-- Create table for daily rollups of hourly measurements --
+CREATE TABLE IF NOT EXISTS measurements_daily (
+  bucket TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  metric TEXT NOT NULL,
+  device TEXT NOT NULL DEFAULT '',
+  samples INT NOT NULL,
+  avg DOUBLE PRECISION NOT NULL,
+  min DOUBLE PRECISION NOT NULL,
+  max DOUBLE PRECISION NOT NULL,
+  p95 DOUBLE PRECISION NOT NULL,
+  PRIMARY KEY (vm_id, metric, device, bucket),
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+-- Track each VM's latest known state, kept current by libvirt lifecycle events --
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'unknown';
+
+-- Create table for storing every VM state change --
+CREATE TABLE IF NOT EXISTS vm_state_history (
+  id SERIAL NOT NULL PRIMARY KEY,
+  time TIMESTAMPTZ NOT NULL,
+  vm_id INT NOT NULL,
+  event TEXT NOT NULL,
+  state TEXT NOT NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  CONSTRAINT fk_vm FOREIGN KEY(vm_id) REFERENCES vms(id)
+);
+
+CREATE INDEX IF NOT EXISTS vm_state_history_vm_id_time_idx ON vm_state_history (vm_id, time);
+
+-- Create table for storing outbound webhook endpoints --
+CREATE TABLE IF NOT EXISTS webhooks (
+  id SERIAL NOT NULL PRIMARY KEY,
+  url TEXT NOT NULL,
+  events TEXT[] NOT NULL DEFAULT '{}',
+  secret TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create table for queueing and auditing webhook deliveries --
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id SERIAL NOT NULL PRIMARY KEY,
+  webhook_id INT NOT NULL,
+  event_id BIGINT NOT NULL,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  response_code INT,
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ,
+  CONSTRAINT fk_webhook FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at);
+
+-- Create table for storing alert rules evaluated by the VM monitor --
+CREATE TABLE IF NOT EXISTS alert_rules (
+  id SERIAL NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  metric TEXT NOT NULL,
+  comparison TEXT NOT NULL,
+  threshold DOUBLE PRECISION NOT NULL,
+  duration_seconds INT NOT NULL DEFAULT 0,
+  vm_name TEXT NOT NULL DEFAULT '',
+  notify TEXT[] NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create table for storing firing and resolved alerts --
+CREATE TABLE IF NOT EXISTS alerts (
+  id SERIAL NOT NULL PRIMARY KEY,
+  rule_id INT NOT NULL,
+  vm_name TEXT NOT NULL,
+  status TEXT NOT NULL,
+  value DOUBLE PRECISION NOT NULL,
+  started_at TIMESTAMPTZ NOT NULL,
+  resolved_at TIMESTAMPTZ,
+  CONSTRAINT fk_alert_rule FOREIGN KEY(rule_id) REFERENCES alert_rules(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS alerts_status_idx ON alerts (status, started_at);
+
+-- Optional per VM bounds for the memory balancer, in MiB. NULL uses the balancer's defaults --
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS memory_min_mib INT;
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS memory_max_mib INT;
+
+-- Create table for storing API users --
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL NOT NULL PRIMARY KEY,
+  email TEXT NOT NULL UNIQUE,
+  name TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create table for storing API keys. Only a SHA-256 hash of each token is kept --
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL NOT NULL PRIMARY KEY,
+  user_id INT NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  prefix TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ,
+  CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+
+-- Create table for storing projects, the tenants that own VMs --
+CREATE TABLE IF NOT EXISTS projects (
+  id SERIAL NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create table for storing which users belong to which projects --
+CREATE TABLE IF NOT EXISTS project_members (
+  project_id INT NOT NULL,
+  user_id INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (project_id, user_id),
+  CONSTRAINT fk_project FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
+  CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Every VM belongs to a project. VMs created before projects existed go to "default" --
+INSERT INTO projects (name) VALUES ('default') ON CONFLICT (name) DO NOTHING;
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS project_id INT REFERENCES projects(id);
+UPDATE vms SET project_id = (SELECT id FROM projects WHERE name = 'default') WHERE project_id IS NULL;
+ALTER TABLE vms ALTER COLUMN project_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS vms_project_id_idx ON vms (project_id);
+
+-- System admins manage users, webhooks, alerting and host wide settings --
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Each project member has a role: viewer, operator or admin. Members who joined before --
+-- roles existed had full access, so they become admins --
+ALTER TABLE project_members ADD COLUMN IF NOT EXISTS role TEXT;
+UPDATE project_members SET role = 'admin' WHERE role IS NULL;
+ALTER TABLE project_members ALTER COLUMN role SET DEFAULT 'viewer';
+ALTER TABLE project_members ALTER COLUMN role SET NOT NULL;
+
+-- Resources each VM was created with, counted against its project's quota --
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS vcpus INT NOT NULL DEFAULT 0;
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS memory_mib INT NOT NULL DEFAULT 0;
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS disk_gb INT NOT NULL DEFAULT 0;
+
+-- Create table for storing per project resource limits. -1 means unlimited --
+CREATE TABLE IF NOT EXISTS project_quotas (
+  project_id INT NOT NULL PRIMARY KEY,
+  max_vms INT NOT NULL DEFAULT 10,
+  max_vcpus INT NOT NULL DEFAULT 32,
+  max_memory_mib INT NOT NULL DEFAULT 65536,
+  max_disk_gb INT NOT NULL DEFAULT 500,
+  max_snapshots INT NOT NULL DEFAULT 20,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT fk_project FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE
+);
+
+INSERT INTO project_quotas (project_id) SELECT id FROM projects ON CONFLICT (project_id) DO NOTHING;
+
+-- Create table for storing resources held for VMs that are still being created. Stale --
+-- reservations, left behind by a crash mid create, stop counting after an hour --
+CREATE TABLE IF NOT EXISTS quota_reservations (
+  id SERIAL NOT NULL PRIMARY KEY,
+  project_id INT NOT NULL,
+  vcpus INT NOT NULL,
+  memory_mib INT NOT NULL,
+  disk_gb INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT fk_project FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE
+);
+
+-- Create table for storing an audit trail of every mutating API request --
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+  time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  actor_id INT REFERENCES users(id) ON DELETE SET NULL,
+  actor_email TEXT NOT NULL DEFAULT '',
+  project_id INT REFERENCES projects(id) ON DELETE SET NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  payload JSONB,
+  status INT NOT NULL,
+  result TEXT NOT NULL,
+  source_ip TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_time_idx ON audit_events (time);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_events_project_id_idx ON audit_events (project_id, id);
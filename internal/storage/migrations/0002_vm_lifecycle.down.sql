@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS unmanaged_domains;
+DROP INDEX IF EXISTS vms_live_name_idx;
+ALTER TABLE vms DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE vms DROP COLUMN IF EXISTS ip;
+ALTER TABLE vms DROP COLUMN IF EXISTS host;
@@ -0,0 +1,17 @@
+-- Where each VM runs and how to reach it, kept current by the reconciler --
+ALTER TABLE vms ADD COLUMN host TEXT NOT NULL DEFAULT '';
+ALTER TABLE vms ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+
+-- Deleted VMs are kept, with their history, but stop counting against quotas --
+ALTER TABLE vms ADD COLUMN deleted_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX vms_live_name_idx ON vms (name) WHERE deleted_at IS NULL;
+
+-- Create table for storing libvirt domains the reconciler found that no project owns --
+CREATE TABLE unmanaged_domains (
+  name TEXT NOT NULL PRIMARY KEY,
+  domain_id INT NOT NULL,
+  host TEXT NOT NULL DEFAULT '',
+  state TEXT NOT NULL,
+  first_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,11 @@
+-- Create table for storing the SSH host keys cloudkit accepts from each hypervisor --
+CREATE TABLE host_keys (
+  id SERIAL PRIMARY KEY,
+  host TEXT NOT NULL,
+  key_type TEXT NOT NULL,
+  public_key TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  pinned BOOLEAN NOT NULL DEFAULT FALSE,
+  added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (host, fingerprint)
+);
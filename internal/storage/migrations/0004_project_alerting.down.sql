@@ -0,0 +1,4 @@
+ALTER TABLE alerts DROP COLUMN IF EXISTS project_id;
+ALTER TABLE alert_rules DROP COLUMN IF EXISTS project_id;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS project_id;
+ALTER TABLE webhooks DROP COLUMN IF EXISTS project_id;
@@ -0,0 +1,20 @@
+-- Webhooks and alert rules belong to a project, like the VMs whose events they act on. --
+-- Those created while they were global go to "default" --
+ALTER TABLE webhooks ADD COLUMN project_id INT REFERENCES projects(id) ON DELETE CASCADE;
+UPDATE webhooks SET project_id = (SELECT id FROM projects WHERE name = 'default');
+ALTER TABLE webhooks ALTER COLUMN project_id SET NOT NULL;
+CREATE INDEX webhooks_project_id_idx ON webhooks (project_id);
+
+ALTER TABLE webhook_deliveries ADD COLUMN project_id INT REFERENCES projects(id) ON DELETE CASCADE;
+UPDATE webhook_deliveries d SET project_id = w.project_id FROM webhooks w WHERE w.id = d.webhook_id;
+ALTER TABLE webhook_deliveries ALTER COLUMN project_id SET NOT NULL;
+
+ALTER TABLE alert_rules ADD COLUMN project_id INT REFERENCES projects(id) ON DELETE CASCADE;
+UPDATE alert_rules SET project_id = (SELECT id FROM projects WHERE name = 'default');
+ALTER TABLE alert_rules ALTER COLUMN project_id SET NOT NULL;
+CREATE INDEX alert_rules_project_id_idx ON alert_rules (project_id);
+
+ALTER TABLE alerts ADD COLUMN project_id INT REFERENCES projects(id) ON DELETE CASCADE;
+UPDATE alerts a SET project_id = r.project_id FROM alert_rules r WHERE r.id = a.rule_id;
+ALTER TABLE alerts ALTER COLUMN project_id SET NOT NULL;
+CREATE INDEX alerts_project_id_idx ON alerts (project_id, started_at);
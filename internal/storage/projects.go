@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/lib/pq"
+)
+
+// DefaultProject is created by the schema and owns VMs created before projects existed.
+const DefaultProject = "default"
+
+// Project roles, from least to most privileged.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Roles lists every project role, from least to most privileged.
+var Roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+// Project is a tenant. Every VM cloudkit manages belongs to exactly one project, and
+// users only see the VMs of projects they are members of.
+type Project struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the listing user's role in the project, when listed for a user.
+	Role string `json:"role,omitempty"`
+}
+
+// ProjectMember is a user along with their role in a project.
+type ProjectMember struct {
+	User
+	Role string `json:"role"`
+}
+
+// CreateProject inserts a project, with the default quota, and owner as its first member
+// and admin. It returns ErrConflict if the name is already taken.
+func (db *Database) CreateProject(ctx context.Context, p Project, ownerID int) (Project, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Project{}, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO projects (name) VALUES ($1) RETURNING id, created_at;"
+	if err := tx.QueryRowContext(ctx, query, p.Name).Scan(&p.ID, &p.CreatedAt); err != nil {
+		return Project{}, uniqueViolation(err)
+	}
+
+	query = "INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3);"
+	if _, err := tx.ExecContext(ctx, query, p.ID, ownerID, RoleAdmin); err != nil {
+		return Project{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO project_quotas (project_id) VALUES ($1);", p.ID); err != nil {
+		return Project{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Project{}, err
+	}
+	p.Role = RoleAdmin
+	return p, nil
+}
+
+// GetProjectByName retrieves a project by its unique name.
+func (db *Database) GetProjectByName(ctx context.Context, name string) (Project, error) {
+	var p Project
+	query := "SELECT id, name, created_at FROM projects WHERE name = $1;"
+
+	err := db.QueryRowContext(ctx, query, name).Scan(&p.ID, &p.Name, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Project{}, ErrNotFound
+	}
+	if err != nil {
+		return Project{}, err
+	}
+
+	return p, nil
+}
+
+// ListProjects retrieves the projects a user is a member of, with their role in each,
+// oldest first.
+func (db *Database) ListProjects(ctx context.Context, userID int) ([]Project, error) {
+	query := `SELECT p.id, p.name, p.created_at, m.role FROM projects p
+		JOIN project_members m ON m.project_id = p.id
+		WHERE m.user_id = $1 ORDER BY p.id ASC;`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.Role); err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
+
+// GetProjectRole retrieves a user's role in a project. It returns ErrNotFound if they
+// aren't a member.
+func (db *Database) GetProjectRole(ctx context.Context, projectID, userID int) (string, error) {
+	var role string
+	query := "SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2;"
+
+	err := db.QueryRowContext(ctx, query, projectID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// ListProjectMembers retrieves the users belonging to a project, oldest member first.
+func (db *Database) ListProjectMembers(ctx context.Context, projectID int) ([]ProjectMember, error) {
+	query := `SELECT u.id, u.email, u.name, u.is_admin, u.created_at, m.role FROM users u
+		JOIN project_members m ON m.user_id = u.id
+		WHERE m.project_id = $1 ORDER BY m.created_at ASC;`
+
+	rows, err := db.QueryContext(ctx, query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []ProjectMember
+	for rows.Next() {
+		var m ProjectMember
+		if err := rows.Scan(&m.ID, &m.Email, &m.Name, &m.Admin, &m.CreatedAt, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// AddProjectMember adds a user to a project with a role. It returns ErrConflict if they
+// are already a member and ErrNotFound if the user or project doesn't exist.
+func (db *Database) AddProjectMember(ctx context.Context, projectID, userID int, role string) error {
+	query := "INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3);"
+	if _, err := db.ExecContext(ctx, query, projectID, userID, role); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return ErrNotFound
+		}
+		return uniqueViolation(err)
+	}
+	return nil
+}
+
+// ErrLastAdmin is returned when a membership change would leave a project without an
+// admin, and so without anyone who could manage it short of a system admin.
+var ErrLastAdmin = apperr.New(apperr.Conflict, "a project must keep at least one admin")
+
+// SetProjectMemberRole changes a member's role in a project. It returns ErrLastAdmin if
+// they are the project's only admin and the new role isn't admin.
+func (db *Database) SetProjectMemberRole(ctx context.Context, projectID, userID int, role string) error {
+	query := "UPDATE project_members SET role = $3 WHERE project_id = $1 AND user_id = $2;"
+	return db.changeMembers(ctx, projectID, query, projectID, userID, role)
+}
+
+// RemoveProjectMember removes a user from a project. It returns ErrLastAdmin if they are
+// the project's only admin.
+func (db *Database) RemoveProjectMember(ctx context.Context, projectID, userID int) error {
+	query := "DELETE FROM project_members WHERE project_id = $1 AND user_id = $2;"
+	return db.changeMembers(ctx, projectID, query, projectID, userID)
+}
+
+// changeMembers runs a statement changing a single membership of a project, rolling it
+// back if it leaves the project without an admin. The project row is locked first so two
+// admins demoting each other at once can't both succeed.
+func (db *Database) changeMembers(ctx context.Context, projectID int, query string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM projects WHERE id = $1 FOR UPDATE;", projectID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res); err != nil {
+		return err
+	}
+
+	var admins int
+	query = "SELECT count(*) FROM project_members WHERE project_id = $1 AND role = $2;"
+	if err := tx.QueryRowContext(ctx, query, projectID, RoleAdmin).Scan(&admins); err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+
+	return tx.Commit()
+}
+
+// GetProjectVM retrieves a project's VM that hasn't been deleted by its ID. It returns
+// ErrNotFound when the VM belongs to another project, so callers can't tell the two apart.
+func (db *Database) GetProjectVM(ctx context.Context, projectID, id int) (VMRecord, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE project_id = $1 AND id = $2 AND deleted_at IS NULL;"
+	vm, err := scanVM(db.QueryRowContext(ctx, query, projectID, id))
+	if err == sql.ErrNoRows {
+		return VMRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return VMRecord{}, err
+	}
+	return vm, nil
+}
+
+// ListProjectVMNames retrieves the names of every VM a project owns.
+func (db *Database) ListProjectVMNames(ctx context.Context, projectID int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM vms WHERE project_id = $1 AND deleted_at IS NULL ORDER BY id ASC;", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// ListVMProjects retrieves the project that owns each VM, keyed by VM name.
+func (db *Database) ListVMProjects(ctx context.Context) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, project_id FROM vms WHERE deleted_at IS NULL;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := make(map[string]int)
+	for rows.Next() {
+		var (
+			name string
+			id   int
+		)
+		if err := rows.Scan(&name, &id); err != nil {
+			return nil, err
+		}
+		projects[name] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
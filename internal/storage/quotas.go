@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+)
+
+// Unlimited disables a quota limit.
+const Unlimited = -1
+
+// reservationTTL is how long a quota reservation counts against a project's usage. It
+// only matters for reservations left behind by a crash partway through creating a VM.
+const reservationTTL = "1 hour"
+
+// Resources counts what a project has, or may have, allocated.
+type Resources struct {
+	VMs       int `json:"vms"`
+	VCPUs     int `json:"vcpus"`
+	MemoryMiB int `json:"memory_mib"`
+	DiskGB    int `json:"disk_gb"`
+	Snapshots int `json:"snapshots"`
+}
+
+// QuotaError is returned when an allocation would take a project past one of its limits.
+type QuotaError struct {
+	Resource  string `json:"resource"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Requested int    `json:"requested"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s: %d used + %d requested > %d allowed", e.Resource, e.Used, e.Requested, e.Limit)
+}
+
+// check returns a QuotaExceeded error, wrapping a *QuotaError, for the first limit adding
+// req to used would exceed.
+func (limits Resources) check(used, req Resources) error {
+	checks := []struct {
+		name             string
+		limit, used, req int
+	}{
+		{"vms", limits.VMs, used.VMs, req.VMs},
+		{"vcpus", limits.VCPUs, used.VCPUs, req.VCPUs},
+		{"memory_mib", limits.MemoryMiB, used.MemoryMiB, req.MemoryMiB},
+		{"disk_gb", limits.DiskGB, used.DiskGB, req.DiskGB},
+		{"snapshots", limits.Snapshots, used.Snapshots, req.Snapshots},
+	}
+	for _, c := range checks {
+		if c.req > 0 && c.limit != Unlimited && c.used+c.req > c.limit {
+			qe := &QuotaError{Resource: c.name, Limit: c.limit, Used: c.used, Requested: c.req}
+			return &apperr.Error{Code: apperr.QuotaExceeded, Message: qe.Error(), Details: qe, Err: qe}
+		}
+	}
+	return nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// GetProjectQuota retrieves a project's limits.
+func (db *Database) GetProjectQuota(ctx context.Context, projectID int) (Resources, error) {
+	return projectQuota(ctx, db, projectID, false)
+}
+
+func projectQuota(ctx context.Context, q queryer, projectID int, lock bool) (Resources, error) {
+	query := `SELECT max_vms, max_vcpus, max_memory_mib, max_disk_gb, max_snapshots
+		FROM project_quotas WHERE project_id = $1`
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	var r Resources
+	err := q.QueryRowContext(ctx, query, projectID).Scan(&r.VMs, &r.VCPUs, &r.MemoryMiB, &r.DiskGB, &r.Snapshots)
+	if err == sql.ErrNoRows {
+		return Resources{}, ErrNotFound
+	}
+	if err != nil {
+		return Resources{}, err
+	}
+
+	return r, nil
+}
+
+// SetProjectQuota replaces a project's limits.
+func (db *Database) SetProjectQuota(ctx context.Context, projectID int, limits Resources) error {
+	query := `INSERT INTO project_quotas
+		(project_id, max_vms, max_vcpus, max_memory_mib, max_disk_gb, max_snapshots)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project_id) DO UPDATE SET max_vms = $2, max_vcpus = $3, max_memory_mib = $4,
+			max_disk_gb = $5, max_snapshots = $6, updated_at = NOW();`
+
+	_, err := db.ExecContext(ctx, query, projectID, limits.VMs, limits.VCPUs, limits.MemoryMiB, limits.DiskGB, limits.Snapshots)
+	return err
+}
+
+// GetProjectUsage totals the resources a project's VMs and pending creates hold.
+func (db *Database) GetProjectUsage(ctx context.Context, projectID int) (Resources, error) {
+	return projectUsage(ctx, db, projectID)
+}
+
+func projectUsage(ctx context.Context, q queryer, projectID int) (Resources, error) {
+	// cloudkit can't take snapshots yet, so there are never any to count.
+	query := `SELECT COUNT(*), COALESCE(SUM(vcpus), 0), COALESCE(SUM(memory_mib), 0), COALESCE(SUM(disk_gb), 0)
+		FROM (
+			SELECT vcpus, memory_mib, disk_gb FROM vms WHERE project_id = $1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT vcpus, memory_mib, disk_gb FROM quota_reservations
+			WHERE project_id = $1 AND created_at > NOW() - INTERVAL '` + reservationTTL + `'
+		) allocated;`
+
+	var r Resources
+	if err := q.QueryRowContext(ctx, query, projectID).Scan(&r.VMs, &r.VCPUs, &r.MemoryMiB, &r.DiskGB); err != nil {
+		return Resources{}, err
+	}
+
+	return r, nil
+}
+
+// ReserveQuota holds resources for a VM about to be created, returning the reservation
+// to pass to CreateVM once it exists or to ReleaseQuota if creating it fails. The
+// project's quota row is locked while usage is checked, so concurrent creates can't both
+// squeeze under the limit. It returns an error wrapping a *QuotaError if the VM doesn't fit.
+func (db *Database) ReserveQuota(ctx context.Context, projectID int, req Resources) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	limits, err := projectQuota(ctx, tx, projectID, true)
+	if err != nil {
+		return 0, err
+	}
+	used, err := projectUsage(ctx, tx, projectID)
+	if err != nil {
+		return 0, err
+	}
+	if err := limits.check(used, req); err != nil {
+		return 0, err
+	}
+
+	var id int
+	query := `INSERT INTO quota_reservations (project_id, vcpus, memory_mib, disk_gb)
+		VALUES ($1, $2, $3, $4) RETURNING id;`
+	if err := tx.QueryRowContext(ctx, query, projectID, req.VCPUs, req.MemoryMiB, req.DiskGB).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// ReleaseQuota drops a reservation for a VM that failed to be created.
+func (db *Database) ReleaseQuota(ctx context.Context, reservationID int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM quota_reservations WHERE id = $1;", reservationID)
+	return err
+}
+
+// ImportVM brings a libvirt domain cloudkit didn't create under a project's management,
+// counting its resources against the project's quota. It returns ErrConflict if a VM
+// with the same name is already managed and a *QuotaError if it doesn't fit.
+func (db *Database) ImportVM(ctx context.Context, projectID int, vm cloudkit.VM, res Resources) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	limits, err := projectQuota(ctx, tx, projectID, true)
+	if err != nil {
+		return 0, err
+	}
+	used, err := projectUsage(ctx, tx, projectID)
+	if err != nil {
+		return 0, err
+	}
+	res.VMs = 1
+	if err := limits.check(used, res); err != nil {
+		return 0, err
+	}
+
+	var id int
+	query := `INSERT INTO vms (name, domain_id, state, project_id, vcpus, memory_mib, disk_gb, host, ip)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9
+		WHERE NOT EXISTS (SELECT 1 FROM vms WHERE name = $1 AND deleted_at IS NULL)
+		RETURNING id;`
+	err = tx.QueryRowContext(ctx, query, vm.Name, vm.DomainID, vm.State, projectID, res.VCPUs, res.MemoryMiB, res.DiskGB,
+		vm.Host, knownIP(vm.IP)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
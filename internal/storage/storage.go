@@ -1,12 +1,15 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/bradford-hamilton/cloudkit-core/internal/cloudkit"
+	"github.com/bradford-hamilton/cloudkit-core/internal/config"
+	"github.com/bradford-hamilton/cloudkit-core/internal/hostcreds"
 
 	// postgres driver
 	_ "github.com/lib/pq"
@@ -14,10 +17,74 @@ import (
 
 // Datastore descirbes all the behaviors the persistance layer must implement.
 type Datastore interface {
-	CreateVM(vm cloudkit.VM) (int, error)
-	RecordVMMemory(domainID int, usage float64) error
-	GetVMIDFromDomainID(domainID int) (int, error)
-	GetLast15MinVMMemUsage(vmID int) ([]cloudkit.MemUsage, error)
+	CreateVM(ctx context.Context, projectID int, vm cloudkit.VM, reservationID int) (int, error)
+	RecordVMMemory(ctx context.Context, vmID int, usage float64) error
+	GetVMIDByName(ctx context.Context, name string) (int, error)
+	GetLast15MinVMMemUsage(ctx context.Context, vmID int) ([]cloudkit.MemUsage, error)
+	RecordVMUsage(ctx context.Context, vmID int, usage cloudkit.VMUsage) error
+	GetVMMetricSeries(ctx context.Context, vmID int, q cloudkit.MetricsQuery) ([]cloudkit.Series, error)
+	RollupMeasurements(ctx context.Context, now time.Time) error
+	RecordVMEvent(ctx context.Context, ev cloudkit.VMEvent) error
+	GetVMStateHistory(ctx context.Context, vmID int, limit int) ([]cloudkit.VMEvent, error)
+	GetVMMemoryBounds(ctx context.Context) (map[string]cloudkit.MemoryBounds, error)
+	SetVMMemoryBounds(ctx context.Context, vmID int, b cloudkit.MemoryBounds) error
+	ListVMs(ctx context.Context, f VMFilter) ([]VMRecord, error)
+	GetVM(ctx context.Context, id int) (VMRecord, error)
+	UpdateVM(ctx context.Context, id int, u VMUpdate) error
+	DeleteVM(ctx context.Context, id int) error
+	SyncUnmanagedDomains(ctx context.Context, found []UnmanagedDomain) ([]UnmanagedDomain, error)
+	ListUnmanagedDomains(ctx context.Context) ([]UnmanagedDomain, error)
+
+	CreateWebhook(ctx context.Context, w Webhook) (Webhook, error)
+	ListWebhooks(ctx context.Context, projectID int) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, projectID, id int) error
+	EnqueueWebhookDelivery(ctx context.Context, webhookID int, eventID uint64, eventType string, payload []byte) error
+	ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, d WebhookDelivery) error
+	ListWebhookDeliveries(ctx context.Context, projectID, webhookID int, limit int) ([]WebhookDelivery, error)
+	ReplayWebhookDelivery(ctx context.Context, projectID, webhookID, deliveryID int) error
+
+	CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error)
+	ListAlertRules(ctx context.Context, projectID int) ([]AlertRule, error)
+	DeleteAlertRule(ctx context.Context, projectID, id int) error
+	CreateAlert(ctx context.Context, a Alert) (Alert, error)
+	ResolveAlert(ctx context.Context, id int, value float64, at time.Time) error
+	ListAlerts(ctx context.Context, projectID int, status string, limit int) ([]Alert, error)
+
+	CreateUser(ctx context.Context, u User) (User, error)
+	BootstrapAdmin(ctx context.Context, u User, k APIKey, tokenHash string) (User, APIKey, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	CreateAPIKey(ctx context.Context, k APIKey, tokenHash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, id int) error
+	AuthenticateAPIKey(ctx context.Context, tokenHash string) (User, APIKey, error)
+
+	CreateProject(ctx context.Context, p Project, ownerID int) (Project, error)
+	GetProjectByName(ctx context.Context, name string) (Project, error)
+	ListProjects(ctx context.Context, userID int) ([]Project, error)
+	GetProjectRole(ctx context.Context, projectID, userID int) (string, error)
+	ListProjectMembers(ctx context.Context, projectID int) ([]ProjectMember, error)
+	AddProjectMember(ctx context.Context, projectID, userID int, role string) error
+	SetProjectMemberRole(ctx context.Context, projectID, userID int, role string) error
+	RemoveProjectMember(ctx context.Context, projectID, userID int) error
+	GetProjectVM(ctx context.Context, projectID, id int) (VMRecord, error)
+	ListProjectVMNames(ctx context.Context, projectID int) ([]string, error)
+	ListVMProjects(ctx context.Context) (map[string]int, error)
+	ImportVM(ctx context.Context, projectID int, vm cloudkit.VM, res Resources) (int, error)
+
+	GetProjectQuota(ctx context.Context, projectID int) (Resources, error)
+	SetProjectQuota(ctx context.Context, projectID int, limits Resources) error
+	GetProjectUsage(ctx context.Context, projectID int) (Resources, error)
+	ReserveQuota(ctx context.Context, projectID int, req Resources) (int, error)
+	ReleaseQuota(ctx context.Context, reservationID int) error
+
+	RecordAuditEvent(ctx context.Context, e AuditEvent) error
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+
+	ListHostKeys(ctx context.Context, host string) ([]hostcreds.Key, error)
+	TrustHostKey(ctx context.Context, key hostcreds.Key) (bool, error)
+	PinHostKey(ctx context.Context, key hostcreds.Key) (hostcreds.Key, error)
+	DeleteHostKeys(ctx context.Context, host string) error
 }
 
 // Database implements our Datastore interface.
@@ -25,55 +92,77 @@ type Database struct {
 	*sql.DB
 }
 
-// NewDatabase aquires a connection to Postgres, embeds it in a Database, and pings
-// the db before returning it.
-func NewDatabase() (*Database, error) {
+// NewDatabase aquires a connection to the Postgres described by cfg, embeds it in a
+// Database, and pings the db before returning it. ctx bounds only the ping.
+func NewDatabase(ctx context.Context, cfg config.Database) (*Database, error) {
 	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		os.Getenv("CLOUDKIT_DB_HOST"),
-		os.Getenv("CLOUDKIT_DB_PORT"),
-		os.Getenv("CLOUDKIT_DB_USER"),
-		os.Getenv("CLOUDKIT_DB_PASSWORD"),
-		os.Getenv("CLOUDKIT_DB_NAME"),
-		os.Getenv("CLOUDKIT_SSL_MODE"),
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		connValue(cfg.Host),
+		cfg.Port,
+		connValue(cfg.User),
+		connValue(cfg.Password),
+		connValue(cfg.Name),
+		connValue(cfg.SSLMode),
 	)
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		return nil, err
 	}
 
 	return &Database{db}, nil
 }
 
-// CreateVM inserts a cloud kit VM into our datastore.
-func (db *Database) CreateVM(vm cloudkit.VM) (int, error) {
+// connValue quotes v for a key=value connection string so values with spaces or quotes,
+// most likely passwords, survive intact.
+func connValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// CreateVM inserts a cloud kit VM owned by a project into our datastore, converting the
+// quota reservation made for it into the VM's own allocation.
+func (db *Database) CreateVM(ctx context.Context, projectID int, vm cloudkit.VM, reservationID int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	var id int
-	query := "INSERT INTO vms (name, domain_id) VALUES ($1, $2) RETURNING id;"
+	query := `INSERT INTO vms (name, domain_id, state, project_id, vcpus, memory_mib, disk_gb, host, ip)
+		SELECT $1, $2, $3, $4, vcpus, memory_mib, disk_gb, $6, $7 FROM quota_reservations
+		WHERE id = $5 AND project_id = $4
+		RETURNING id;`
 
-	row := db.QueryRow(query, vm.Name, vm.DomainID)
-	if err := row.Err(); err != nil {
+	err = tx.QueryRowContext(ctx, query, vm.Name, vm.DomainID, vm.State, projectID, reservationID, vm.Host, knownIP(vm.IP)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
 		return 0, err
 	}
-	if err := row.Scan(&id); err != nil {
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM quota_reservations WHERE id = $1;", reservationID); err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	return id, tx.Commit()
 }
 
-// GetVMIDFromDomainID gets a domain's storage ID by its domain_id.
-func (db *Database) GetVMIDFromDomainID(domainID int) (int, error) {
+// GetVMIDByName gets the storage ID of the VM that hasn't been deleted with the given
+// domain name. Domains cloudkit doesn't manage return ErrNotFound. Unlike domain IDs,
+// which libvirt reuses, a name belongs to one VM for as long as it's stored.
+func (db *Database) GetVMIDByName(ctx context.Context, name string) (int, error) {
 	var id int
-	query := "SELECT id FROM vms WHERE domain_id = $1;"
+	query := "SELECT id FROM vms WHERE name = $1 AND deleted_at IS NULL;"
 
-	row := db.QueryRow(query, domainID)
-	if err := row.Err(); err != nil {
-		return 0, err
+	err := db.QueryRowContext(ctx, query, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
 	}
-	if err := row.Scan(&id); err != nil {
+	if err != nil {
 		return 0, err
 	}
 
@@ -81,14 +170,9 @@ func (db *Database) GetVMIDFromDomainID(domainID int) (int, error) {
 }
 
 // RecordVMMemory inserts a snapshot of a VMs memory into storage.
-func (db *Database) RecordVMMemory(domainID int, usage float64) error {
-	vmID, err := db.GetVMIDFromDomainID(domainID)
-	if err != nil {
-		return err
-	}
-
+func (db *Database) RecordVMMemory(ctx context.Context, vmID int, usage float64) error {
 	query := "INSERT INTO measurements (time, vm_id, mem_usage) VALUES ($1, $2, $3);"
-	row := db.QueryRow(query, time.Now(), vmID, usage)
+	row := db.QueryRowContext(ctx, query, time.Now(), vmID, usage)
 	if err := row.Err(); err != nil {
 		return err
 	}
@@ -96,12 +180,12 @@ func (db *Database) RecordVMMemory(domainID int, usage float64) error {
 	return nil
 }
 
-// GetLast15MinVMMemUsage retrieves the last 30 minutes of a VM's usage.
-func (db *Database) GetLast15MinVMMemUsage(vmID int) ([]cloudkit.MemUsage, error) {
-	subQ := "SELECT time, mem_usage FROM measurements WHERE vm_id = $1 ORDER BY time DESC LIMIT 15"
-	query := "SELECT q.* FROM (" + subQ + ") q ORDER BY q.time ASC;"
+// GetLast15MinVMMemUsage retrieves the last 15 minutes of a VM's usage.
+func (db *Database) GetLast15MinVMMemUsage(ctx context.Context, vmID int) ([]cloudkit.MemUsage, error) {
+	query := `SELECT time, mem_usage FROM measurements
+		WHERE vm_id = $1 AND time >= NOW() - INTERVAL '15 minutes' ORDER BY time ASC;`
 
-	rows, err := db.Query(query, vmID)
+	rows, err := db.QueryContext(ctx, query, vmID)
 	if err != nil {
 		return nil, err
 	}
@@ -118,3 +202,136 @@ func (db *Database) GetLast15MinVMMemUsage(vmID int) ([]cloudkit.MemUsage, error
 
 	return usages, nil
 }
+
+// RecordVMUsage inserts a snapshot of a VM's CPU, disk and network rates into storage. All
+// rows share the snapshot's timestamp and are written in a single transaction.
+func (db *Database) RecordVMUsage(ctx context.Context, vmID int, usage cloudkit.VMUsage) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO cpu_measurements (time, vm_id, cpu_usage) VALUES ($1, $2, $3);"
+	if _, err := tx.ExecContext(ctx, query, usage.CPU.Time, vmID, usage.CPU.Usage); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO disk_measurements
+		(time, vm_id, device, read_bytes_per_sec, write_bytes_per_sec, read_iops, write_iops)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`
+	for _, d := range usage.Disks {
+		_, err := tx.ExecContext(ctx, query, d.Time, vmID, d.Device, d.ReadBytesPS, d.WriteBytesPS, d.ReadIOPS, d.WriteIOPS)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `INSERT INTO net_measurements
+		(time, vm_id, interface, rx_bytes_per_sec, tx_bytes_per_sec, rx_packets_per_sec, tx_packets_per_sec)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`
+	for _, n := range usage.Interfaces {
+		_, err := tx.ExecContext(ctx, query, n.Time, vmID, n.Interface, n.RxBytesPS, n.TxBytesPS, n.RxPacketsPS, n.TxPacketsPS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecordVMEvent updates a VM's stored state and domain ID and appends the change to its
+// state history. VMs are matched by name because a domain's ID changes every time it
+// starts. Events for domains cloudkit doesn't know about, or VMs that were deleted, are
+// ignored.
+func (db *Database) RecordVMEvent(ctx context.Context, ev cloudkit.VMEvent) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var vmID int
+	query := `UPDATE vms SET state = $1, domain_id = $2, updated_at = NOW()
+		WHERE name = $3 AND deleted_at IS NULL RETURNING id;`
+	err = tx.QueryRowContext(ctx, query, ev.State, ev.DomainID, ev.VMName).Scan(&vmID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	query = "INSERT INTO vm_state_history (time, vm_id, event, state, reason) VALUES ($1, $2, $3, $4, $5);"
+	if _, err := tx.ExecContext(ctx, query, ev.Time, vmID, ev.Type, ev.State, ev.Reason); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetVMStateHistory retrieves a VM's most recent state changes, newest first.
+func (db *Database) GetVMStateHistory(ctx context.Context, vmID int, limit int) ([]cloudkit.VMEvent, error) {
+	query := `SELECT h.time, h.event, h.state, h.reason, v.name FROM vm_state_history h
+		JOIN vms v ON v.id = h.vm_id WHERE h.vm_id = $1 ORDER BY h.time DESC LIMIT $2;`
+
+	rows, err := db.QueryContext(ctx, query, vmID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []cloudkit.VMEvent
+	for rows.Next() {
+		var ev cloudkit.VMEvent
+		if err := rows.Scan(&ev.Time, &ev.Type, &ev.State, &ev.Reason, &ev.VMName); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// GetVMMemoryBounds retrieves the memory balancer bounds for every VM, keyed by name.
+func (db *Database) GetVMMemoryBounds(ctx context.Context) (map[string]cloudkit.MemoryBounds, error) {
+	query := `SELECT name, COALESCE(memory_min_mib, 0), COALESCE(memory_max_mib, 0) FROM vms
+		WHERE deleted_at IS NULL;`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bounds := make(map[string]cloudkit.MemoryBounds)
+	for rows.Next() {
+		var (
+			name string
+			b    cloudkit.MemoryBounds
+		)
+		if err := rows.Scan(&name, &b.MinMiB, &b.MaxMiB); err != nil {
+			return nil, err
+		}
+		bounds[name] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bounds, nil
+}
+
+// SetVMMemoryBounds stores the memory balancer bounds for a VM. Zero clears a bound.
+func (db *Database) SetVMMemoryBounds(ctx context.Context, vmID int, b cloudkit.MemoryBounds) error {
+	query := `UPDATE vms SET memory_min_mib = NULLIF($2, 0), memory_max_mib = NULLIF($3, 0),
+		updated_at = NOW() WHERE id = $1 AND deleted_at IS NULL;`
+	res, err := db.ExecContext(ctx, query, vmID, b.MinMiB, b.MaxMiB)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// VMRecord is a VM as cloudkit has it stored, which can differ from what libvirt reports
+// until the reconciler or a lifecycle event brings the two back in line.
+type VMRecord struct {
+	ID        int        `json:"id"`
+	ProjectID int        `json:"project_id"`
+	DomainID  int        `json:"domain_id"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Host      string     `json:"host"`
+	IP        string     `json:"ip"`
+	VCPUs     int        `json:"vcpus"`
+	MemoryMiB int        `json:"memory_mib"`
+	DiskGB    int        `json:"disk_gb"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// VMFilter narrows ListVMs. Zero fields match everything.
+type VMFilter struct {
+	ProjectID int
+	State     string
+	// IncludeDeleted also returns soft deleted VMs.
+	IncludeDeleted bool
+	// AfterID pages forwards, returning only VMs created after it.
+	AfterID int
+	Limit   int
+}
+
+// VMUpdate changes a VM's stored details. Nil fields are left as they are.
+type VMUpdate struct {
+	State *string
+	Host  *string
+	IP    *string
+}
+
+// UnmanagedDomain is a libvirt domain the reconciler found that no project owns. It can
+// be brought under management with ImportVM.
+type UnmanagedDomain struct {
+	Name        string    `json:"name"`
+	DomainID    int       `json:"domain_id"`
+	Host        string    `json:"host"`
+	State       string    `json:"state"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+const vmColumns = `id, project_id, domain_id, name, state, host, ip, vcpus, memory_mib, disk_gb,
+	created_at, updated_at, deleted_at`
+
+func scanVM(row interface{ Scan(...interface{}) error }) (VMRecord, error) {
+	var vm VMRecord
+	err := row.Scan(&vm.ID, &vm.ProjectID, &vm.DomainID, &vm.Name, &vm.State, &vm.Host, &vm.IP,
+		&vm.VCPUs, &vm.MemoryMiB, &vm.DiskGB, &vm.CreatedAt, &vm.UpdatedAt, &vm.DeletedAt)
+	return vm, err
+}
+
+// knownIP drops the "pending" placeholder cloudkit reports before a VM has a DHCP lease.
+func knownIP(ip string) string {
+	if ip == "pending" {
+		return ""
+	}
+	return ip
+}
+
+// ListVMs retrieves VMs matching f, oldest first.
+func (db *Database) ListVMs(ctx context.Context, f VMFilter) ([]VMRecord, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ProjectID != 0 {
+		add("project_id = $%d", f.ProjectID)
+	}
+	if f.State != "" {
+		add("state = $%d", f.State)
+	}
+	if f.AfterID != 0 {
+		add("id > $%d", f.AfterID)
+	}
+	if !f.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+
+	query := "SELECT " + vmColumns + " FROM vms"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY id ASC LIMIT $%d;", len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vms []VMRecord
+	for rows.Next() {
+		vm, err := scanVM(rows)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return vms, nil
+}
+
+// GetVM retrieves a VM that hasn't been deleted by its storage ID.
+func (db *Database) GetVM(ctx context.Context, id int) (VMRecord, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE id = $1 AND deleted_at IS NULL;"
+	vm, err := scanVM(db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return VMRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return VMRecord{}, err
+	}
+	return vm, nil
+}
+
+// UpdateVM changes the stored state, host or IP of a VM that hasn't been deleted. State
+// changes made this way don't appear in the VM's state history; use RecordVMEvent for
+// those.
+func (db *Database) UpdateVM(ctx context.Context, id int, u VMUpdate) error {
+	var ip *string
+	if u.IP != nil {
+		v := knownIP(*u.IP)
+		ip = &v
+	}
+	query := `UPDATE vms SET state = COALESCE($2, state), host = COALESCE($3, host), ip = COALESCE($4, ip),
+		updated_at = NOW() WHERE id = $1 AND deleted_at IS NULL;`
+	res, err := db.ExecContext(ctx, query, id, u.State, u.Host, ip)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// DeleteVM soft deletes a VM. It keeps its history but no longer counts against its
+// project's quota, and its name may be reused.
+func (db *Database) DeleteVM(ctx context.Context, id int) error {
+	query := "UPDATE vms SET deleted_at = NOW(), updated_at = NOW() WHERE id = $1 AND deleted_at IS NULL;"
+	res, err := db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// SyncUnmanagedDomains replaces the stored unmanaged domains with found, returning those
+// that weren't stored before.
+func (db *Database) SyncUnmanagedDomains(ctx context.Context, found []UnmanagedDomain) ([]UnmanagedDomain, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	names := make([]string, 0, len(found))
+	for _, d := range found {
+		names = append(names, d.Name)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM unmanaged_domains WHERE NOT (name = ANY($1));", pq.Array(names)); err != nil {
+		return nil, err
+	}
+
+	var added []UnmanagedDomain
+	query := `INSERT INTO unmanaged_domains (name, domain_id, host, state) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET domain_id = $2, host = $3, state = $4, last_seen_at = NOW()
+		RETURNING first_seen_at, last_seen_at, (xmax = 0);`
+	for _, d := range found {
+		var inserted bool
+		err := tx.QueryRowContext(ctx, query, d.Name, d.DomainID, d.Host, d.State).Scan(&d.FirstSeenAt, &d.LastSeenAt, &inserted)
+		if err != nil {
+			return nil, err
+		}
+		if inserted {
+			added = append(added, d)
+		}
+	}
+
+	return added, tx.Commit()
+}
+
+// ListUnmanagedDomains retrieves the domains the reconciler last found that no project
+// owns.
+func (db *Database) ListUnmanagedDomains(ctx context.Context) ([]UnmanagedDomain, error) {
+	query := `SELECT name, domain_id, host, state, first_seen_at, last_seen_at FROM unmanaged_domains
+		ORDER BY first_seen_at ASC;`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []UnmanagedDomain
+	for rows.Next() {
+		var d UnmanagedDomain
+		if err := rows.Scan(&d.Name, &d.DomainID, &d.Host, &d.State, &d.FirstSeenAt, &d.LastSeenAt); err != nil {
+			return nil, err
+		}
+		domains = append(domains, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
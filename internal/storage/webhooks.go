@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/apperr"
+	"github.com/lib/pq"
+)
+
+// ErrNotFound is returned when a lookup, update or delete matches no rows.
+var ErrNotFound = apperr.New(apperr.NotFound, "not found")
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint that receives signed JSON deliveries of cloudkit events.
+type Webhook struct {
+	ID        int `json:"id"`
+	ProjectID int `json:"project_id"`
+	// URL is where deliveries are POSTed.
+	URL string `json:"url"`
+	// Events filters which event types are delivered, e.g. "vm.crashed" or "vm.*". Empty
+	// means every event webhooks support.
+	Events []string `json:"events"`
+	// Secret signs each delivery. It is only ever returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one attempt, or series of retried attempts, to deliver an event to
+// a webhook.
+type WebhookDelivery struct {
+	ID            int        `json:"id"`
+	WebhookID     int        `json:"webhook_id"`
+	ProjectID     int        `json:"project_id"`
+	EventID       uint64     `json:"event_id"`
+	EventType     string     `json:"event_type"`
+	Payload       []byte     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ResponseCode  *int       `json:"response_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+
+	// URL and Secret are filled in when a delivery is claimed for sending.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// CreateWebhook inserts a webhook and returns it with its ID and creation time set.
+func (db *Database) CreateWebhook(ctx context.Context, w Webhook) (Webhook, error) {
+	query := `INSERT INTO webhooks (project_id, url, events, secret) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`
+
+	row := db.QueryRowContext(ctx, query, w.ProjectID, w.URL, pq.Array(w.Events), w.Secret)
+	if err := row.Scan(&w.ID, &w.CreatedAt); err != nil {
+		return Webhook{}, err
+	}
+
+	return w, nil
+}
+
+// ListWebhooks retrieves a project's webhooks, or every webhook if projectID is 0,
+// including secrets, oldest first. Callers exposing webhooks over the API must clear
+// Secret.
+func (db *Database) ListWebhooks(ctx context.Context, projectID int) ([]Webhook, error) {
+	query := `SELECT id, project_id, url, events, secret, created_at FROM webhooks
+		WHERE $1 = 0 OR project_id = $1 ORDER BY id ASC;`
+
+	rows, err := db.QueryContext(ctx, query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.ProjectID, &w.URL, pq.Array(&w.Events), &w.Secret, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes a project's webhook and, by cascade, its delivery history.
+func (db *Database) DeleteWebhook(ctx context.Context, projectID, id int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1 AND project_id = $2;", id, projectID)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// EnqueueWebhookDelivery queues an event for delivery to a webhook as soon as possible.
+func (db *Database) EnqueueWebhookDelivery(ctx context.Context, webhookID int, eventID uint64, eventType string, payload []byte) error {
+	query := `INSERT INTO webhook_deliveries (webhook_id, project_id, event_id, event_type, payload)
+		SELECT id, project_id, $2, $3, $4 FROM webhooks WHERE id = $1;`
+	_, err := db.ExecContext(ctx, query, webhookID, eventID, eventType, payload)
+	return err
+}
+
+// ClaimDueWebhookDeliveries picks up to limit pending deliveries whose next attempt is due
+// and pushes their next attempt out by lease, so that another cloudkit instance polling
+// the same queue won't send them again while this one is. SKIP LOCKED keeps concurrent
+// claimers from blocking on each other.
+func (db *Database) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	query := `UPDATE webhook_deliveries d SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at ASC LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.project_id, d.event_id, d.event_type, d.payload, d.attempts, d.created_at, w.url, w.secret;`
+
+	rows, err := db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		d := WebhookDelivery{Status: DeliveryPending}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.ProjectID, &d.EventID, &d.EventType, &d.Payload, &d.Attempts,
+			&d.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to send a delivery.
+func (db *Database) RecordWebhookAttempt(ctx context.Context, d WebhookDelivery) error {
+	query := `UPDATE webhook_deliveries SET status = $2, attempts = $3, next_attempt_at = $4,
+		response_code = $5, last_error = $6, delivered_at = $7 WHERE id = $1;`
+	res, err := db.ExecContext(ctx, query, d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.ResponseCode, d.LastError, d.DeliveredAt)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// ListWebhookDeliveries retrieves the most recent deliveries of a project's webhook,
+// newest first.
+func (db *Database) ListWebhookDeliveries(ctx context.Context, projectID, webhookID int, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT id, webhook_id, project_id, event_id, event_type, status, attempts, next_attempt_at,
+		response_code, last_error, created_at, delivered_at
+		FROM webhook_deliveries WHERE webhook_id = $1 AND project_id = $2 ORDER BY id DESC LIMIT $3;`
+
+	rows, err := db.QueryContext(ctx, query, webhookID, projectID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var (
+			d    WebhookDelivery
+			code sql.NullInt64
+			at   sql.NullTime
+		)
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.ProjectID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &code, &d.LastError, &d.CreatedAt, &at)
+		if err != nil {
+			return nil, err
+		}
+		if code.Valid {
+			c := int(code.Int64)
+			d.ResponseCode = &c
+		}
+		if at.Valid {
+			d.DeliveredAt = &at.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// ReplayWebhookDelivery puts a delivery of a project's webhook back on the queue to be
+// sent again immediately, with a fresh set of attempts.
+func (db *Database) ReplayWebhookDelivery(ctx context.Context, projectID, webhookID, deliveryID int) error {
+	query := `UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW(),
+		last_error = '' WHERE id = $1 AND webhook_id = $2 AND project_id = $3;`
+	res, err := db.ExecContext(ctx, query, deliveryID, webhookID, projectID)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// expectRows turns an update or delete that matched nothing into ErrNotFound.
+func expectRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
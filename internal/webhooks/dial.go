@@ -0,0 +1,108 @@
+package webhooks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// blockedNets are the ranges webhooks can't be delivered to, so that registering one
+// can't be used to reach the host's own network: loopback, private, shared and link-local
+// addresses, the last including cloud metadata services such as 169.254.169.254.
+var blockedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// checkIP returns an error if ip is in one of blockedNets.
+func checkIP(ip net.IP) error {
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return fmt.Errorf("webhooks can't be delivered to %s, which isn't a public address", ip)
+		}
+	}
+	return nil
+}
+
+// CheckURL returns an error if u's host is an address webhooks can't be delivered to.
+// Host names are only checked once a delivery resolves them, since what they resolve to
+// can change.
+func CheckURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("webhooks can't be delivered to %s", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkIP(ip)
+	}
+	return nil
+}
+
+// newClient returns the client deliveries are sent with. It refuses to connect to the
+// addresses CheckURL refuses, checking each connection's resolved address so a host name
+// can't be pointed at one later, and returns redirects rather than following them. It
+// doesn't use the environment's proxy, which would be the address checked instead.
+func newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// dialControl refuses connections to blocked addresses once they're resolved.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("webhooks can't be delivered to %s, which isn't an IP address", host)
+	}
+	return checkIP(ip)
+}
@@ -0,0 +1,52 @@
+package webhooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/cloudkit", true},
+		{"http://93.184.216.34/hook", true},
+		{"http://localhost:8080/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://172.20.0.1/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]/hook", false},
+		{"http://[fe80::1]/hook", false},
+		{"http://[::ffff:10.0.0.1]/hook", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckURL(u); (err == nil) != tt.ok {
+			t.Errorf("CheckURL(%s) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the delivery reached a loopback address")
+	}))
+	defer srv.Close()
+
+	// A host name resolving to loopback is refused when it's dialed.
+	u, _ := url.Parse(srv.URL)
+	res, err := newClient(time.Second).Post("http://localhost:"+u.Port(), "application/json", nil)
+	if err == nil {
+		res.Body.Close()
+		t.Fatal("Post() succeeded, want the connection refused")
+	}
+}
@@ -0,0 +1,287 @@
+// Package webhooks delivers cloudkit events to registered HTTP endpoints.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradford-hamilton/cloudkit-core/internal/events"
+	"github.com/bradford-hamilton/cloudkit-core/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Headers set on every delivery. Receivers should verify SignatureHeader by computing
+// "sha256=" + hex(HMAC-SHA256(secret, body)) and comparing in constant time.
+const (
+	EventHeader     = "X-Cloudkit-Event"
+	DeliveryHeader  = "X-Cloudkit-Delivery"
+	SignatureHeader = "X-Cloudkit-Signature"
+)
+
+// DeliverableTypes are the event families webhooks can subscribe to.
+var DeliverableTypes = []string{"vm.*", "alert.*"}
+
+// Config controls delivery timing.
+type Config struct {
+	// PollInterval is how often the queue is checked for due deliveries.
+	PollInterval time.Duration
+	// BatchSize caps how many deliveries are claimed per poll.
+	BatchSize int
+	// Workers caps how many deliveries are sent at once.
+	Workers int
+	// Timeout bounds a single HTTP attempt.
+	Timeout time.Duration
+	// MaxAttempts is how many times a delivery is tried before it is marked failed.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles on each retry after that.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultConfig retries for roughly a day before giving up on a delivery.
+func DefaultConfig() Config {
+	return Config{
+		PollInterval: 5 * time.Second,
+		BatchSize:    20,
+		Workers:      4,
+		Timeout:      10 * time.Second,
+		MaxAttempts:  10,
+		Backoff:      30 * time.Second,
+		MaxBackoff:   6 * time.Hour,
+	}
+}
+
+// Dispatcher queues matching events for every webhook and sends queued deliveries,
+// retrying failures with exponential backoff. The queue lives in storage so pending
+// deliveries survive restarts.
+type Dispatcher struct {
+	storage storage.Datastore
+	broker  *events.Broker
+	owners  *events.Owners
+	client  *http.Client
+	logger  *logrus.Logger
+	cfg     Config
+}
+
+// NewDispatcher creates a Dispatcher. Call Run to start it.
+func NewDispatcher(db storage.Datastore, b *events.Broker, cfg Config, log *logrus.Logger) *Dispatcher {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	return &Dispatcher{
+		storage: db,
+		broker:  b,
+		owners:  events.NewOwners(db),
+		client:  newClient(cfg.Timeout),
+		logger:  log,
+		cfg:     cfg,
+	}
+}
+
+// Run enqueues events and sends due deliveries until ctx is cancelled. Deliveries are
+// sent from their own goroutine so that slow endpoints don't hold up draining events.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.deliverLoop(ctx)
+	}()
+	defer wg.Wait()
+
+	filter := events.Filter{Types: DeliverableTypes}
+	_, sub := d.broker.Subscribe(filter, 0)
+	defer func() { sub.Close() }()
+	var lastID uint64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				// We fell behind the broker; pick up where we left off.
+				d.logger.Warn("webhook dispatcher fell behind the event broker, resubscribing")
+				var replay []events.Event
+				replay, sub = d.broker.Subscribe(filter, lastID)
+				for _, ev := range replay {
+					d.enqueue(ctx, ev)
+					lastID = ev.ID
+				}
+				continue
+			}
+			d.enqueue(ctx, ev)
+			lastID = ev.ID
+		}
+	}
+}
+
+// deliverLoop sends due deliveries every poll interval until ctx is cancelled.
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.deliverDue(ctx)
+		}
+	}
+}
+
+// enqueue queues ev for every webhook in its project whose filter matches it. Events
+// that belong to no project, such as those about unmanaged domains, aren't delivered.
+func (d *Dispatcher) enqueue(ctx context.Context, ev events.Event) {
+	project := d.owners.Project(ctx, ev)
+	if project == 0 {
+		return
+	}
+	hooks, err := d.storage.ListWebhooks(ctx, project)
+	if err != nil {
+		d.logger.Errorf("failed to list webhooks, err: %+v", err)
+		return
+	}
+
+	var payload []byte
+	for _, w := range hooks {
+		if !(events.Filter{Types: w.Events}).Match(ev) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(ev); err != nil {
+				d.logger.Errorf("failed to marshal event %d, err: %+v", ev.ID, err)
+				return
+			}
+		}
+		if err := d.storage.EnqueueWebhookDelivery(ctx, w.ID, ev.ID, ev.Type, payload); err != nil {
+			d.logger.Errorf("failed to enqueue delivery for webhook %d, err: %+v", w.ID, err)
+		}
+	}
+}
+
+// deliverDue claims every delivery whose next attempt is due and sends them on up to
+// cfg.Workers at a time.
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	// The lease must outlast a full batch of attempts so nothing is claimed twice.
+	rounds := (d.cfg.BatchSize + d.cfg.Workers - 1) / d.cfg.Workers
+	lease := d.cfg.Timeout * time.Duration(rounds+1)
+	deliveries, err := d.storage.ClaimDueWebhookDeliveries(ctx, d.cfg.BatchSize, lease)
+	if err != nil {
+		d.logger.Errorf("failed to claim webhook deliveries, err: %+v", err)
+		return
+	}
+
+	jobs := make(chan storage.WebhookDelivery)
+	var wg sync.WaitGroup
+	for i := 0; i < d.cfg.Workers && i < len(deliveries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for del := range jobs {
+				d.attempt(ctx, del)
+			}
+		}()
+	}
+
+feed:
+	for _, del := range deliveries {
+		select {
+		case jobs <- del:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// attempt sends a delivery once and records the outcome, scheduling a retry on failure.
+func (d *Dispatcher) attempt(ctx context.Context, del storage.WebhookDelivery) {
+	del.Attempts++
+	code, err := d.send(ctx, del)
+	if code != 0 {
+		del.ResponseCode = &code
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		del.Status = storage.DeliverySucceeded
+		del.LastError = ""
+		del.NextAttemptAt = now
+		del.DeliveredAt = &now
+	case del.Attempts >= d.cfg.MaxAttempts:
+		del.Status = storage.DeliveryFailed
+		del.LastError = err.Error()
+		del.NextAttemptAt = now
+		d.logger.Warnf("giving up on webhook %d delivery %d after %d attempts, err: %+v",
+			del.WebhookID, del.ID, del.Attempts, err)
+	default:
+		del.Status = storage.DeliveryPending
+		del.LastError = err.Error()
+		del.NextAttemptAt = now.Add(d.backoff(del.Attempts))
+	}
+
+	if err := d.storage.RecordWebhookAttempt(ctx, del); err != nil {
+		d.logger.Errorf("failed to record webhook delivery %d, err: %+v", del.ID, err)
+	}
+}
+
+// send POSTs the signed payload. Any 2xx response counts as delivered; redirects aren't
+// followed, so they count as failures.
+func (d *Dispatcher) send(ctx context.Context, del storage.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cloudkit-webhooks")
+	req.Header.Set(EventHeader, del.EventType)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(del.ID))
+	req.Header.Set(SignatureHeader, Sign(del.Secret, del.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff returns the delay before the given attempt's retry.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.Backoff
+	for i := 1; i < attempts && delay < d.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.cfg.MaxBackoff {
+		delay = d.cfg.MaxBackoff
+	}
+	return delay
+}
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}